@@ -0,0 +1,257 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a right granted to an API key.
+type Scope string
+
+const (
+	// ScopeSend allows sending emails and managing templates.
+	ScopeSend Scope = "send"
+	// ScopeReadLogs allows reading the log, message lifecycles and provider
+	// state.
+	ScopeReadLogs Scope = "read-logs"
+	// ScopeAdmin allows managing API keys, and implies all other scopes.
+	ScopeAdmin Scope = "admin"
+)
+
+// Key describes an API key. The secret is only known to its owner, while the
+// store keeps a hash of it. The quotas limit the number of messages sent with
+// the key per day and month, where zero is unlimited.
+type Key struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Scopes       []Scope    `json:"scopes"`
+	DailyQuota   int        `json:"daily_quota"`
+	MonthlyQuota int        `json:"monthly_quota"`
+	Created      time.Time  `json:"created"`
+	Revoked      *time.Time `json:"revoked,omitempty"`
+}
+
+// Has reports whether the key grants scope.
+func (k Key) Has(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type journalRecord struct {
+	Key  Key    `json:"key"`
+	Hash string `json:"hash"`
+}
+
+type entry struct {
+	key  Key
+	hash []byte
+}
+
+// Store keeps the API keys in memory, backed by a journal on disk.
+type Store struct {
+	mu      sync.Mutex
+	journal *journal.Journal
+	keys    map[string]*entry
+}
+
+// Open opens the store at path.
+func Open(path string) (*Store, error) {
+	s := &Store{keys: map[string]*entry{}}
+	j, err := journal.Open(path, func(raw json.RawMessage) error {
+		var r journalRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		hash, err := hex.DecodeString(r.Hash)
+		if err != nil {
+			return err
+		}
+		s.keys[r.Key.ID] = &entry{key: r.Key, hash: hash}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	return s, nil
+}
+
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create creates a key with the given name and scopes, and returns it along
+// with its token. The token is not stored and cannot be recovered later.
+func (s *Store) Create(name string, scopes []Scope) (Key, string, error) {
+	if name == "" {
+		return Key{}, "", errors.New("API key name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return Key{}, "", errors.New("API key must have at least one scope")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeSend, ScopeReadLogs, ScopeAdmin:
+		default:
+			return Key{}, "", fmt.Errorf("Unknown scope %s", scope)
+		}
+	}
+	key := Key{
+		ID:      randomHex(8),
+		Name:    name,
+		Scopes:  append([]Scope(nil), scopes...),
+		Created: time.Now().UTC(),
+	}
+	secret := randomHex(32)
+	hash := hashSecret(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.Append(journalRecord{Key: key, Hash: hex.EncodeToString(hash)}); err != nil {
+		return Key{}, "", err
+	}
+	s.keys[key.ID] = &entry{key: key, hash: hash}
+	return key, key.ID + "." + secret, nil
+}
+
+// Revoke revokes the key with the given id, and reports whether it existed.
+// Revoked keys are kept, so they remain visible to admins.
+func (s *Store) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[id]
+	if !ok {
+		return false, nil
+	}
+	if e.key.Revoked != nil {
+		return true, nil
+	}
+	key := e.key
+	now := time.Now().UTC()
+	key.Revoked = &now
+	if err := s.journal.Append(journalRecord{Key: key, Hash: hex.EncodeToString(e.hash)}); err != nil {
+		return false, err
+	}
+	e.key = key
+	return true, nil
+}
+
+// SetQuotas changes the daily and monthly quotas of the key with the given id,
+// and reports whether it exists.
+func (s *Store) SetQuotas(id string, daily int, monthly int) (Key, bool, error) {
+	return s.UpdateQuotas(id, &daily, &monthly)
+}
+
+// UpdateQuotas is like SetQuotas, but keeps the current value of a quota which
+// is nil.
+func (s *Store) UpdateQuotas(id string, daily *int, monthly *int) (Key, bool, error) {
+	if (daily != nil && *daily < 0) || (monthly != nil && *monthly < 0) {
+		return Key{}, false, errors.New("Quotas must not be negative")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[id]
+	if !ok {
+		return Key{}, false, nil
+	}
+	key := e.key
+	if daily != nil {
+		key.DailyQuota = *daily
+	}
+	if monthly != nil {
+		key.MonthlyQuota = *monthly
+	}
+	if err := s.journal.Append(journalRecord{Key: key, Hash: hex.EncodeToString(e.hash)}); err != nil {
+		return Key{}, false, err
+	}
+	e.key = key
+	return key, true, nil
+}
+
+// Authenticate returns the key of the given token, unless it is unknown or
+// revoked.
+func (s *Store) Authenticate(token string) (Key, bool) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return Key{}, false
+	}
+	return s.authenticate(token[:i], token[i+1:])
+}
+
+// AuthenticateBasic is like Authenticate, but takes the id and secret of the
+// token separately, as sent in a Basic Authorization header.
+func (s *Store) AuthenticateBasic(id, secret string) (Key, bool) {
+	return s.authenticate(id, secret)
+}
+
+func (s *Store) authenticate(id, secret string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[id]
+	if !ok || e.key.Revoked != nil {
+		return Key{}, false
+	}
+	if subtle.ConstantTimeCompare(e.hash, hashSecret(secret)) != 1 {
+		return Key{}, false
+	}
+	return e.key, true
+}
+
+// Get returns the key with the given id, including a revoked one.
+func (s *Store) Get(id string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[id]
+	if !ok {
+		return Key{}, false
+	}
+	return e.key, true
+}
+
+// List returns all keys, including the revoked ones, oldest first.
+func (s *Store) List() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Key, 0, len(s.keys))
+	for _, e := range s.keys {
+		list = append(list, e.key)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created.Equal(list[j].Created) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Len returns the number of keys, including the revoked ones.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+func (s *Store) Close() error {
+	return s.journal.Close()
+}
@@ -1,8 +1,14 @@
 package emailprovider
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"mime"
 	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode"
 )
 
 // Enhanced string types to validate and enforce static checks of email arguments.
@@ -23,9 +29,11 @@ func (e emailAddress) Address() string {
 }
 
 func MakeEmailAddress(name, address string) (EmailAddress, error) {
-	_, err := mail.ParseAddress(address)
-	if err != nil {
-		return nil, err
+	if address == "" {
+		return nil, Invalid("address", CodeRequired, "Address must not be empty")
+	}
+	if _, err := mail.ParseAddress(address); err != nil {
+		return nil, Invalid("address", CodeInvalidAddress, "Address %q is invalid: %s", address, err)
 	}
 	return emailAddress{
 		address: address,
@@ -43,10 +51,10 @@ func (s subject) String() string {
 }
 func MakeSubject(sub string) (Subject, error) {
 	if sub == "" {
-		return nil, errors.New("Subject must not be empty")
+		return nil, Invalid("", CodeRequired, "Subject must not be empty")
 	}
 	if len(sub) > 78 {
-		return nil, errors.New("Subject must not be longer than 78 characters")
+		return nil, Invalid("", CodeTooLong, "Subject must not be longer than 78 characters")
 	}
 	return subject{sub}, nil
 }
@@ -65,17 +73,340 @@ func MakeHtmlBody(body string) HtmlBody {
 	return htmlBody{body}
 }
 
+// Limits on attachments, which are well within what the providers accept.
+const (
+	MaxAttachmentSize      = 10 * 1024 * 1024
+	MaxTotalAttachmentSize = 20 * 1024 * 1024
+)
+
+// Dispositions of attachments. Inline attachments are shown in the html body,
+// where they are referenced by their content-ID as cid:<content-ID>.
+const (
+	DispositionAttachment = "attachment"
+	DispositionInline     = "inline"
+)
+
+// allowedAttachmentTypes are the accepted media types of attachments. A type
+// ending in a slash or a dot allows everything starting with it.
+var allowedAttachmentTypes = []string{
+	"image/",
+	"text/",
+	"application/pdf",
+	"application/zip",
+	"application/json",
+	"application/xml",
+	"application/rtf",
+	"application/msword",
+	"application/vnd.ms-excel",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.oasis.opendocument.",
+	"application/vnd.openxmlformats-officedocument.",
+}
+
+type Attachment interface {
+	Filename() string
+	ContentType() string
+	Data() []byte
+	Disposition() string
+	ContentID() string
+}
+type attachment struct {
+	filename    string
+	contentType string
+	data        []byte
+	disposition string
+	contentID   string
+}
+
+func (a attachment) Filename() string {
+	return a.filename
+}
+func (a attachment) ContentType() string {
+	return a.contentType
+}
+func (a attachment) Data() []byte {
+	return a.data
+}
+func (a attachment) Disposition() string {
+	return a.disposition
+}
+func (a attachment) ContentID() string {
+	return a.contentID
+}
+
+// MakeAttachment validates an attachment. The disposition defaults to
+// attachment, and inline attachments must be images with a content-ID.
+func MakeAttachment(filename, contentType string, data []byte, disposition, contentID string) (Attachment, error) {
+	if filename == "" || strings.ContainsAny(filename, "/\\\r\n") {
+		return nil, Invalid("filename", CodeInvalidValue, "Attachment filename must be a plain file name")
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, Invalid("content_type", CodeInvalidValue, "Attachment %s has an invalid content type", filename)
+	}
+	if !allowedAttachmentType(mediaType) {
+		return nil, Invalid("content_type", CodeTypeNotAllowed, "Attachment %s has a content type which is not allowed: %s", filename, mediaType)
+	}
+	if len(data) == 0 {
+		return nil, Invalid("content", CodeRequired, "Attachment %s is empty", filename)
+	}
+	if len(data) > MaxAttachmentSize {
+		return nil, Invalid("content", CodeTooLarge, "Attachment %s must not be larger than %d bytes", filename, MaxAttachmentSize)
+	}
+	if disposition == "" {
+		disposition = DispositionAttachment
+	}
+	switch disposition {
+	case DispositionAttachment:
+	case DispositionInline:
+		if contentID == "" {
+			return nil, Invalid("content_id", CodeRequired, "Inline attachment %s must have a content-ID", filename)
+		}
+		if !strings.HasPrefix(mediaType, "image/") {
+			return nil, Invalid("content_type", CodeTypeNotAllowed, "Inline attachment %s must be an image", filename)
+		}
+	default:
+		return nil, Invalid("disposition", CodeInvalidValue, "Attachment %s has an unknown disposition: %s", filename, disposition)
+	}
+	if strings.ContainsAny(contentID, "<>\r\n ") {
+		return nil, Invalid("content_id", CodeInvalidValue, "Attachment %s has an invalid content-ID", filename)
+	}
+	return attachment{
+		filename:    filename,
+		contentType: contentType,
+		data:        data,
+		disposition: disposition,
+		contentID:   contentID,
+	}, nil
+}
+
+func allowedAttachmentType(mediaType string) bool {
+	for _, allowed := range allowedAttachmentTypes {
+		if mediaType == allowed {
+			return true
+		}
+		isPrefix := strings.HasSuffix(allowed, "/") || strings.HasSuffix(allowed, ".")
+		if isPrefix && strings.HasPrefix(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAttachmentsSize validates the combined size of attachments.
+func CheckAttachmentsSize(attachments []Attachment) error {
+	total := 0
+	for _, a := range attachments {
+		total += len(a.Data())
+	}
+	if total > MaxTotalAttachmentSize {
+		return Invalid("", CodeTooLarge, "Attachments must not be larger than %d bytes in total", MaxTotalAttachmentSize)
+	}
+	return nil
+}
+
+// reservedHeaders are the headers owned by the service or the providers,
+// which therefore cannot be set as custom headers.
+var reservedHeaders = map[string]bool{
+	"From":                      true,
+	"Sender":                    true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Content-Disposition":       true,
+	"Content-Id":                true,
+	"Return-Path":               true,
+	"Received":                  true,
+	"Dkim-Signature":            true,
+	"X-Sg-Eid":                  true,
+	"X-Sg-Id":                   true,
+	"X-Msys-Api":                true,
+}
+
+// MakeHeaders validates custom headers, returning them with canonical names.
+func MakeHeaders(headers map[string]string) (map[string]string, error) {
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if name == "" {
+			return nil, Invalid("", CodeInvalidValue, "Header name must not be empty")
+		}
+		for _, c := range name {
+			// Header names are printable US-ASCII, except colon (RFC 5322)
+			if c < 33 || c > 126 || c == ':' {
+				return nil, Invalid(name, CodeInvalidValue, "Header name is invalid: %q", name)
+			}
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if reservedHeaders[key] {
+			return nil, Invalid(name, CodeReserved, "Header %s is set by the service and cannot be overridden", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, Invalid(name, CodeInvalidValue, "Header %s must not contain line breaks", key)
+		}
+		canonical[key] = value
+	}
+	return canonical, nil
+}
+
+// Limits on tags and metadata, chosen to fit what both providers accept.
+const (
+	MaxTags             = 10
+	MaxTagLength        = 64
+	MaxMetadataKeys     = 10
+	MaxMetadataKeyLen   = 64
+	MaxMetadataValueLen = 1000
+)
+
+// MakeTags validates tags, which are used to group emails in the statistics
+// of the providers.
+func MakeTags(tags []string) ([]string, error) {
+	if len(tags) > MaxTags {
+		return nil, Invalid("", CodeTooMany, "Email must not have more than %d tags", MaxTags)
+	}
+	for i, tag := range tags {
+		field := fmt.Sprintf("[%d]", i)
+		if tag == "" {
+			return nil, Invalid(field, CodeRequired, "Tags must be between 1 and %d characters", MaxTagLength)
+		}
+		if len(tag) > MaxTagLength {
+			return nil, Invalid(field, CodeTooLong, "Tags must be between 1 and %d characters", MaxTagLength)
+		}
+		if strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+			return nil, Invalid(field, CodeInvalidValue, "Tag must not contain control characters: %q", tag)
+		}
+	}
+	return tags, nil
+}
+
+// Message streams separate transactional emails, such as receipts and
+// password resets, from broadcasts such as newsletters. Providers which
+// distinguish them deliver the streams apart, so that the reputation of one
+// does not affect the other.
+const (
+	StreamTransactional = "transactional"
+	StreamBroadcast     = "broadcast"
+)
+
+// MakeStream validates the message stream of an email, which defaults to the
+// transactional stream.
+func MakeStream(stream string) (string, error) {
+	switch stream {
+	case "":
+		return StreamTransactional, nil
+	case StreamTransactional, StreamBroadcast:
+		return stream, nil
+	}
+	return "", Invalid("", CodeInvalidValue, "Stream must be %s or %s", StreamTransactional, StreamBroadcast)
+}
+
+// MessageIDMetadataKey is the metadata key the providers send the message id
+// in, so it is returned along with their webhook events.
+const MessageIDMetadataKey = "message_id"
+
+// MakeMetadata validates free-form metadata, which the providers return along
+// with the events of the email.
+func MakeMetadata(metadata map[string]string) (map[string]string, error) {
+	if len(metadata) > MaxMetadataKeys {
+		return nil, Invalid("", CodeTooMany, "Email must not have more than %d metadata keys", MaxMetadataKeys)
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > MaxMetadataKeyLen {
+			return nil, Invalid(key, CodeInvalidValue, "Metadata keys must be between 1 and %d characters", MaxMetadataKeyLen)
+		}
+		if key == MessageIDMetadataKey || key == "tags" {
+			return nil, Invalid(key, CodeReserved, "Metadata key %s is set by the service", key)
+		}
+		if len(value) > MaxMetadataValueLen {
+			return nil, Invalid(key, CodeTooLong, "Metadata value of %s must not be longer than %d characters", key, MaxMetadataValueLen)
+		}
+	}
+	return metadata, nil
+}
+
 type Email struct {
-	To       []EmailAddress
-	Cc       []EmailAddress
-	Bcc      []EmailAddress
-	From     EmailAddress
-	Subject  Subject
-	Body     string
-	HtmlBody HtmlBody
+	// ID identifies the message throughout its lifecycle. It is assigned when
+	// the message is accepted, and is empty for emails that are not tracked.
+	ID          string
+	To          []EmailAddress
+	Cc          []EmailAddress
+	Bcc         []EmailAddress
+	From        EmailAddress
+	ReplyTo     EmailAddress
+	Subject     Subject
+	Body        string
+	HtmlBody    HtmlBody
+	Attachments []Attachment
+	// Headers are custom headers, validated by MakeHeaders.
+	Headers map[string]string
+	// Tags and Metadata are validated by MakeTags and MakeMetadata.
+	Tags     []string
+	Metadata map[string]string
+	// Stream is the message stream of the email, validated by MakeStream.
+	Stream string
 }
 
+// Provider sends emails through an email service. Send returns the id the
+// provider assigned to the transmission, if any, which is needed to match
+// later events from the provider to the message. Send gives up once ctx is
+// done.
 type Provider interface {
-	Send(m Email) error
+	Name() string
+	Send(ctx context.Context, m Email) (string, error)
 	Init() error
 }
+
+// TimeoutProvider bounds every send of the embedded provider by Timeout, such
+// that a hanging provider cannot hold up the strategy.
+type TimeoutProvider struct {
+	Provider
+	Timeout time.Duration
+}
+
+func (t TimeoutProvider) Send(ctx context.Context, m Email) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	return t.Provider.Send(ctx, m)
+}
+
+// BatchResult is the outcome of a single email of a batch.
+type BatchResult struct {
+	TransmissionID string
+	Err            error
+}
+
+// BatchProvider is a provider which can send several emails in a single
+// request. SendBatch returns the result of every email, in order, or an error
+// if the request as a whole failed.
+type BatchProvider interface {
+	Provider
+	SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error)
+}
+
+// TimeoutBatchProvider is a TimeoutProvider which keeps the batch sends of
+// its provider, bounding every batch by Timeout.
+type TimeoutBatchProvider struct {
+	TimeoutProvider
+}
+
+func (t TimeoutBatchProvider) SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	return t.Provider.(BatchProvider).SendBatch(ctx, emails)
+}
+
+// WithTimeout bounds every send of p by timeout, keeping its batch sends if
+// it has any.
+func WithTimeout(p Provider, timeout time.Duration) Provider {
+	bounded := TimeoutProvider{Provider: p, Timeout: timeout}
+	if _, ok := p.(BatchProvider); ok {
+		return TimeoutBatchProvider{bounded}
+	}
+	return bounded
+}
@@ -0,0 +1,66 @@
+package emailprovider
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Codes of validation errors, which clients can rely on.
+const (
+	CodeRequired          = "required"
+	CodeInvalidAddress    = "invalid_address"
+	CodeTooLong           = "too_long"
+	CodeTooMany           = "too_many"
+	CodeTooLarge          = "too_large"
+	CodeInvalidValue      = "invalid_value"
+	CodeInvalidEncoding   = "invalid_encoding"
+	CodeTypeNotAllowed    = "type_not_allowed"
+	CodeReserved          = "reserved"
+	CodeUnknownTemplate   = "unknown_template"
+	CodeTemplateRendering = "template_rendering"
+	CodeConflict          = "conflict"
+)
+
+// ValidationError describes a single invalid value of an email. Field is the
+// path of the value, such as "cc[2].address". Functions validating a part of
+// an email report the path within that part, which the caller places with At.
+type ValidationError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// At returns a copy of e with its field placed below path.
+func (e *ValidationError) At(path string) *ValidationError {
+	located := *e
+	switch {
+	case e.Field == "":
+		located.Field = path
+	case strings.HasPrefix(e.Field, "["):
+		located.Field = path + e.Field
+	default:
+		located.Field = path + "." + e.Field
+	}
+	return &located
+}
+
+// Invalid creates a validation error of field.
+func Invalid(field, code, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// AsValidationError returns err as a validation error, wrapping errors of
+// other types with the given code.
+func AsValidationError(err error, code string) *ValidationError {
+	if v, ok := err.(*ValidationError); ok {
+		return v
+	}
+	return &ValidationError{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,113 @@
+package emailprovider
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FailureKind classifies why a provider could not send an email.
+type FailureKind string
+
+const (
+	// FailureInvalidRecipient is a recipient the provider will never deliver
+	// to, which no other provider will either.
+	FailureInvalidRecipient FailureKind = "invalid_recipient"
+	// FailureAuth is a provider rejecting its credentials, which only affects
+	// that provider.
+	FailureAuth FailureKind = "auth"
+	// FailureRateLimited is a provider throttling the service. RetryAfter is
+	// the time to wait before using the provider again, if known.
+	FailureRateLimited FailureKind = "rate_limited"
+	// FailureRejected is an email the provider refused, such as one that is
+	// too large or malformed, which other providers will refuse as well.
+	FailureRejected FailureKind = "rejected"
+	// FailureTransient is a failure which may pass, such as a network error
+	// or an outage of the provider.
+	FailureTransient FailureKind = "transient"
+)
+
+// SendError is the error returned by providers when a send fails.
+type SendError struct {
+	Provider   string
+	Kind       FailureKind
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *SendError) Error() string {
+	if e.Provider == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s failed (%s): %s", e.Provider, e.Kind, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether the email would fail the same way with every
+// provider, such that failing over or retrying is pointless.
+func (e *SendError) Permanent() bool {
+	return e.Kind == FailureInvalidRecipient || e.Kind == FailureRejected
+}
+
+// Fail creates a send error of the provider.
+func Fail(provider string, kind FailureKind, err error) *SendError {
+	return &SendError{Provider: provider, Kind: kind, Err: err}
+}
+
+// IsPermanent reports whether err is a permanent send error. Errors of other
+// types are considered transient.
+func IsPermanent(err error) bool {
+	var e *SendError
+	return errors.As(err, &e) && e.Permanent()
+}
+
+// KindOf returns the kind of failure of err. Errors other than send errors
+// are considered transient.
+func KindOf(err error) FailureKind {
+	var e *SendError
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return FailureTransient
+}
+
+// RetryAfter returns how long to wait before retrying after err, which is
+// zero unless err is a rate limited send error.
+func RetryAfter(err error) time.Duration {
+	var e *SendError
+	if errors.As(err, &e) && e.Kind == FailureRateLimited {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// FailureOfStatus classifies a failed HTTP response of a provider API by its
+// status code. Responses with status 400 and 422 are rejections, as the
+// payload was refused.
+func FailureOfStatus(code int) FailureKind {
+	switch {
+	case code == 401 || code == 403:
+		return FailureAuth
+	case code == 429:
+		return FailureRateLimited
+	case code == 400 || code == 413 || code == 422:
+		return FailureRejected
+	}
+	return FailureTransient
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	var seconds int
+	if _, err := fmt.Sscanf(value, "%d", &seconds); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := time.Parse(time.RFC1123, value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+package emailprovider
+
+import (
+	"encoding/json"
+)
+
+// The validated types are hidden behind interfaces, so an Email is stored by
+// converting it to and from plain structures. Unmarshalling validates again,
+// so a tampered store cannot produce an invalid Email.
+
+type jsonEmailAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type jsonAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type jsonEmail struct {
+	ID          string             `json:"id,omitempty"`
+	To          []jsonEmailAddress `json:"to,omitempty"`
+	Cc          []jsonEmailAddress `json:"cc,omitempty"`
+	Bcc         []jsonEmailAddress `json:"bcc,omitempty"`
+	From        *jsonEmailAddress  `json:"from,omitempty"`
+	ReplyTo     *jsonEmailAddress  `json:"reply_to,omitempty"`
+	Subject     string             `json:"subject"`
+	Body        string             `json:"body,omitempty"`
+	HtmlBody    string             `json:"html,omitempty"`
+	Attachments []jsonAttachment   `json:"attachments,omitempty"`
+	Headers     map[string]string  `json:"headers,omitempty"`
+	Tags        []string           `json:"tags,omitempty"`
+	Metadata    map[string]string  `json:"metadata,omitempty"`
+	Stream      string             `json:"stream,omitempty"`
+}
+
+func toJSONAddress(e EmailAddress) jsonEmailAddress {
+	return jsonEmailAddress{Name: e.Name(), Address: e.Address()}
+}
+
+func toJSONAddresses(list []EmailAddress) []jsonEmailAddress {
+	converted := make([]jsonEmailAddress, 0, len(list))
+	for _, e := range list {
+		converted = append(converted, toJSONAddress(e))
+	}
+	return converted
+}
+
+func fromJSONAddresses(list []jsonEmailAddress) ([]EmailAddress, error) {
+	if list == nil {
+		return nil, nil
+	}
+	converted := make([]EmailAddress, 0, len(list))
+	for _, e := range list {
+		address, err := MakeEmailAddress(e.Name, e.Address)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, address)
+	}
+	return converted, nil
+}
+
+func (m Email) MarshalJSON() ([]byte, error) {
+	j := jsonEmail{
+		ID:       m.ID,
+		To:       toJSONAddresses(m.To),
+		Cc:       toJSONAddresses(m.Cc),
+		Bcc:      toJSONAddresses(m.Bcc),
+		Body:     m.Body,
+		Headers:  m.Headers,
+		Tags:     m.Tags,
+		Metadata: m.Metadata,
+		Stream:   m.Stream,
+	}
+	if m.From != nil {
+		from := toJSONAddress(m.From)
+		j.From = &from
+	}
+	if m.ReplyTo != nil {
+		replyTo := toJSONAddress(m.ReplyTo)
+		j.ReplyTo = &replyTo
+	}
+	if m.Subject != nil {
+		j.Subject = m.Subject.String()
+	}
+	if m.HtmlBody != nil {
+		j.HtmlBody = m.HtmlBody.String()
+	}
+	for _, a := range m.Attachments {
+		j.Attachments = append(j.Attachments, jsonAttachment{
+			Filename:    a.Filename(),
+			ContentType: a.ContentType(),
+			Data:        a.Data(),
+			Disposition: a.Disposition(),
+			ContentID:   a.ContentID(),
+		})
+	}
+	return json.Marshal(j)
+}
+
+func (m *Email) UnmarshalJSON(data []byte) error {
+	var j jsonEmail
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	email := Email{ID: j.ID}
+	var err error
+	if email.To, err = fromJSONAddresses(j.To); err != nil {
+		return err
+	}
+	if email.Cc, err = fromJSONAddresses(j.Cc); err != nil {
+		return err
+	}
+	if email.Bcc, err = fromJSONAddresses(j.Bcc); err != nil {
+		return err
+	}
+	if j.From != nil {
+		if email.From, err = MakeEmailAddress(j.From.Name, j.From.Address); err != nil {
+			return err
+		}
+	}
+	if j.ReplyTo != nil {
+		if email.ReplyTo, err = MakeEmailAddress(j.ReplyTo.Name, j.ReplyTo.Address); err != nil {
+			return err
+		}
+	}
+	if email.Subject, err = MakeSubject(j.Subject); err != nil {
+		return err
+	}
+	if j.Headers != nil {
+		if email.Headers, err = MakeHeaders(j.Headers); err != nil {
+			return err
+		}
+	}
+	if email.Tags, err = MakeTags(j.Tags); err != nil {
+		return err
+	}
+	if email.Metadata, err = MakeMetadata(j.Metadata); err != nil {
+		return err
+	}
+	if email.Stream, err = MakeStream(j.Stream); err != nil {
+		return err
+	}
+	email.Body = j.Body
+	email.HtmlBody = MakeHtmlBody(j.HtmlBody)
+	for _, a := range j.Attachments {
+		attachment, err := MakeAttachment(a.Filename, a.ContentType, a.Data, a.Disposition, a.ContentID)
+		if err != nil {
+			return err
+		}
+		email.Attachments = append(email.Attachments, attachment)
+	}
+	*m = email
+	return nil
+}
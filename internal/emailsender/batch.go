@@ -0,0 +1,180 @@
+package emailsender
+
+import (
+	"context"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"time"
+)
+
+// BatchStrategy is implemented by strategies which can hand several emails to
+// a provider at once. SendBatch returns the error of every email, in order.
+type BatchStrategy interface {
+	Strategy
+	SendBatch(ctx context.Context, emails []emailprovider.Email) []error
+}
+
+var errBatchMismatch = errors.New("Provider returned a result for a different number of emails than sent.")
+
+// SendBatch sends emails through s, as a batch if s supports it, and one by
+// one otherwise.
+func SendBatch(ctx context.Context, s Strategy, emails []emailprovider.Email) []error {
+	if b, ok := s.(BatchStrategy); ok {
+		return b.SendBatch(ctx, emails)
+	}
+	return sendEach(ctx, s, emails)
+}
+
+func sendEach(ctx context.Context, s Strategy, emails []emailprovider.Email) []error {
+	errs := make([]error, len(emails))
+	for i, m := range emails {
+		errs[i] = s.Send(ctx, m)
+	}
+	return errs
+}
+
+// batchProvider returns p as a batch provider, if it is one and there is more
+// than a single email to send.
+func batchProvider(p emailprovider.Provider, emails []emailprovider.Email) (emailprovider.BatchProvider, bool) {
+	b, ok := p.(emailprovider.BatchProvider)
+	return b, ok && len(emails) > 1
+}
+
+// attemptBatch sends emails through p in a single request and reports the
+// outcome of every email to o, if any. If the request as a whole failed, its
+// error is the error of every email.
+func attemptBatch(ctx context.Context, o Observer, p emailprovider.BatchProvider, emails []emailprovider.Email) ([]emailprovider.BatchResult, error) {
+	start := time.Now()
+	results, err := p.SendBatch(ctx, emails)
+	if err != nil || len(results) != len(emails) {
+		if err == nil {
+			err = emailprovider.Fail(p.Name(), emailprovider.FailureTransient, errBatchMismatch)
+		}
+		results = make([]emailprovider.BatchResult, len(emails))
+		for i := range results {
+			results[i].Err = err
+		}
+	}
+	if o != nil {
+		duration := time.Since(start)
+		for i, r := range results {
+			o.Attempted(Attempt{
+				Email:          emails[i],
+				Provider:       p.Name(),
+				TransmissionID: r.TransmissionID,
+				Err:            r.Err,
+				Duration:       duration,
+			})
+		}
+	}
+	return results, err
+}
+
+// batchFailure is the provider an email of a batch failed through, and its
+// error. Retrying the email skips the provider, and counts the error as its
+// attempt.
+type batchFailure struct {
+	provider string
+	err      error
+}
+
+// retryFailed returns the errors of a batch, after sending every email which
+// failed with an error other providers may not have one by one through send,
+// which fails over to the providers other than the one of the batch.
+func retryFailed(ctx context.Context, send func(context.Context, emailprovider.Email, batchFailure) error, provider string, emails []emailprovider.Email, results []emailprovider.BatchResult) []error {
+	errs := make([]error, len(emails))
+	for i, r := range results {
+		switch {
+		case r.Err == nil || emailprovider.IsPermanent(r.Err):
+			errs[i] = r.Err
+		case ctx.Err() != nil:
+			errs[i] = ctx.Err()
+		default:
+			errs[i] = send(ctx, emails[i], batchFailure{provider: provider, err: r.Err})
+		}
+	}
+	return errs
+}
+
+// SendBatch hands emails to the provider the next send would start with, if
+// it is a batch provider.
+func (s *RoundRobinSender) SendBatch(ctx context.Context, emails []emailprovider.Email) []error {
+	if len(s.Providers) == 0 {
+		return sendEach(ctx, s, emails)
+	}
+	s.mu.Lock()
+	p := s.Providers[s.lastIndex]
+	s.mu.Unlock()
+	b, ok := batchProvider(p, emails)
+	if !ok || s.throttle.wait(p.Name(), time.Now()) > 0 {
+		return sendEach(ctx, s, emails)
+	}
+	results, err := attemptBatch(ctx, s.Observer, b, emails)
+	s.throttle.record(p.Name(), err, time.Now())
+	return retryFailed(ctx, s.send, p.Name(), emails, results)
+}
+
+// SendBatch hands emails to the current provider, if it is a batch provider.
+func (s *PrioritySender) SendBatch(ctx context.Context, emails []emailprovider.Email) []error {
+	if len(s.Providers) == 0 {
+		return sendEach(ctx, s, emails)
+	}
+	p := s.Providers[s.start()]
+	b, ok := batchProvider(p, emails)
+	if !ok || s.throttle.wait(p.Name(), s.now()) > 0 {
+		return sendEach(ctx, s, emails)
+	}
+	results, err := attemptBatch(ctx, s.Observer, b, emails)
+	s.throttle.record(p.Name(), err, s.now())
+	return retryFailed(ctx, s.send, p.Name(), emails, results)
+}
+
+// SendBatch hands emails to a provider picked by weight, if it is a batch
+// provider.
+func (s *WeightedSender) SendBatch(ctx context.Context, emails []emailprovider.Email) []error {
+	if len(s.Providers) == 0 {
+		return sendEach(ctx, s, emails)
+	}
+	p := s.Providers[s.pick(s.Providers)].Provider
+	b, ok := batchProvider(p, emails)
+	if !ok || s.throttle.wait(p.Name(), time.Now()) > 0 {
+		return sendEach(ctx, s, emails)
+	}
+	results, err := attemptBatch(ctx, s.Observer, b, emails)
+	s.throttle.record(p.Name(), err, time.Now())
+	return retryFailed(ctx, s.send, p.Name(), emails, results)
+}
+
+// SendBatch hands emails to the first provider whose breaker lets it through,
+// if it is a batch provider. The batch counts as a single outcome for the
+// breaker, which fails only if the request as a whole failed.
+func (s *CircuitBreakerSender) SendBatch(ctx context.Context, emails []emailprovider.Email) []error {
+	for i, p := range s.Providers {
+		if s.throttle.wait(p.Name(), s.now()) > 0 {
+			continue
+		}
+		probe, ok := s.allow(i)
+		if !ok {
+			continue
+		}
+		b, ok := batchProvider(p, emails)
+		if !ok {
+			s.report(i, probe, nil, false)
+			break
+		}
+		results, err := attemptBatch(ctx, s.Observer, b, emails)
+		switch {
+		case ctx.Err() != nil:
+			s.report(i, probe, nil, false)
+		case emailprovider.IsPermanent(err):
+			s.report(i, probe, nil, true)
+		case emailprovider.KindOf(err) == emailprovider.FailureRateLimited:
+			s.report(i, probe, nil, false)
+			s.throttle.record(p.Name(), err, s.now())
+		default:
+			s.report(i, probe, err, true)
+		}
+		return retryFailed(ctx, s.send, p.Name(), emails, results)
+	}
+	return sendEach(ctx, s, emails)
+}
@@ -0,0 +1,278 @@
+package emailsender
+
+import (
+	"context"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker of a single provider.
+type BreakerState string
+
+const (
+	// BreakerClosed lets all sends through to the provider.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen skips the provider until the cool-down has passed.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe send through at a time, to find out
+	// whether the provider has recovered.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerStatus describes the breaker of a single provider.
+type BreakerStatus struct {
+	Provider            string       `json:"provider"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	ErrorRate           float64      `json:"error_rate"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+// BreakerReporter is implemented by strategies that can report the state of
+// their circuit breakers.
+type BreakerReporter interface {
+	Breakers() []BreakerStatus
+}
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+type breaker struct {
+	state               BreakerState
+	consecutiveFailures int
+	outcomes            []outcome
+	openedAt            time.Time
+	probing             bool
+	probeSuccesses      int
+}
+
+// CircuitBreakerSender tries the providers in order, but stops sending to a
+// provider once it fails too often. Its breaker opens after FailureThreshold
+// consecutive failures, or when more than ErrorRate of at least MinRequests
+// attempts within Window failed. After CoolDown the breaker half-opens and
+// lets probe sends through; HalfOpenProbes successful probes close it again,
+// while a failed probe opens it for another cool-down.
+//
+// Zero values are replaced by sensible defaults on the first send.
+type CircuitBreakerSender struct {
+	Providers        []emailprovider.Provider
+	Observer         Observer
+	FailureThreshold int
+	ErrorRate        float64
+	MinRequests      int
+	Window           time.Duration
+	CoolDown         time.Duration
+	HalfOpenProbes   int
+	// Now returns the current time, and can be replaced in tests.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	breakers []*breaker
+	throttle throttle
+}
+
+func (s *CircuitBreakerSender) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *CircuitBreakerSender) init() {
+	if s.breakers != nil {
+		return
+	}
+	if s.FailureThreshold == 0 {
+		s.FailureThreshold = 5
+	}
+	if s.ErrorRate == 0 {
+		s.ErrorRate = 0.5
+	}
+	if s.MinRequests == 0 {
+		s.MinRequests = 10
+	}
+	if s.Window == 0 {
+		s.Window = time.Minute
+	}
+	if s.CoolDown == 0 {
+		s.CoolDown = 30 * time.Second
+	}
+	if s.HalfOpenProbes == 0 {
+		s.HalfOpenProbes = 1
+	}
+	s.breakers = make([]*breaker, len(s.Providers))
+	for i := range s.breakers {
+		s.breakers[i] = &breaker{state: BreakerClosed}
+	}
+}
+
+func (s *CircuitBreakerSender) Send(ctx context.Context, m emailprovider.Email) error {
+	return s.send(ctx, m, batchFailure{})
+}
+
+// send sends m through the providers whose breakers let it through, skipping
+// the provider of prior.
+func (s *CircuitBreakerSender) send(ctx context.Context, m emailprovider.Email, prior batchFailure) error {
+	if len(s.Providers) == 0 {
+		return errors.New("Empty list of providers. It seems impossible to send an email through a provider if no email providers are provided.")
+	}
+	tried := 0
+	var failed failures
+	for i, p := range s.Providers {
+		if p.Name() == prior.provider {
+			tried++
+			failed.add(prior.err)
+			continue
+		}
+		if wait := s.throttle.wait(p.Name(), s.now()); wait > 0 {
+			failed.limit(wait)
+			continue
+		}
+		probe, ok := s.allow(i)
+		if !ok {
+			continue
+		}
+		err := attempt(ctx, s.Observer, p, m, tried)
+		tried++
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about the provider.
+			s.report(i, probe, nil, false)
+			return ctx.Err()
+		}
+		if emailprovider.IsPermanent(err) {
+			// The provider is healthy, but every other provider would refuse
+			// the email as well.
+			s.report(i, probe, nil, true)
+			return err
+		}
+		if emailprovider.KindOf(err) == emailprovider.FailureRateLimited {
+			// Throttling says nothing about the health of the provider either.
+			s.report(i, probe, nil, false)
+			s.throttle.record(p.Name(), err, s.now())
+			failed.add(err)
+			continue
+		}
+		s.report(i, probe, err, true)
+		if err == nil {
+			return nil
+		}
+		failed.add(err)
+	}
+	if tried == 0 && failed.limited == 0 {
+		return errors.New("All providers are unavailable while their circuit breakers are open.")
+	}
+	return failed.err("All providers reported an error while attempting to send.")
+}
+
+// allow reports whether the provider at index i may be used, and whether the
+// send is a probe of a half-open breaker.
+func (s *CircuitBreakerSender) allow(i int) (probe bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	b := s.breakers[i]
+	if b.state == BreakerOpen && s.now().Sub(b.openedAt) >= s.CoolDown {
+		b.state = BreakerHalfOpen
+		b.probeSuccesses = 0
+	}
+	switch b.state {
+	case BreakerClosed:
+		return false, true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return false, false
+}
+
+// report records the outcome of a send to the provider at index i, and opens
+// or closes its breaker accordingly. Sends that were cancelled only release
+// the probe, without counting as an outcome.
+func (s *CircuitBreakerSender) report(i int, probe bool, err error, counted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.breakers[i]
+	now := s.now()
+	if probe {
+		b.probing = false
+	}
+	if !counted {
+		return
+	}
+	b.outcomes = append(pruneOutcomes(b.outcomes, now.Add(-s.Window)), outcome{at: now, failed: err != nil})
+	if err == nil {
+		b.consecutiveFailures = 0
+		if b.state == BreakerHalfOpen {
+			b.probeSuccesses++
+			if b.probeSuccesses >= s.HalfOpenProbes {
+				b.state = BreakerClosed
+				b.outcomes = nil
+			}
+		}
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == BreakerHalfOpen ||
+		b.consecutiveFailures >= s.FailureThreshold ||
+		(len(b.outcomes) >= s.MinRequests && errorRate(b.outcomes) > s.ErrorRate) {
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
+
+// Breakers returns the current state of the breaker of every provider.
+func (s *CircuitBreakerSender) Breakers() []BreakerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	now := s.now()
+	statuses := make([]BreakerStatus, 0, len(s.Providers))
+	for i, p := range s.Providers {
+		b := s.breakers[i]
+		state := b.state
+		if state == BreakerOpen && now.Sub(b.openedAt) >= s.CoolDown {
+			state = BreakerHalfOpen
+		}
+		status := BreakerStatus{
+			Provider:            p.Name(),
+			State:               state,
+			ConsecutiveFailures: b.consecutiveFailures,
+			ErrorRate:           errorRate(pruneOutcomes(b.outcomes, now.Add(-s.Window))),
+		}
+		if state != BreakerClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// pruneOutcomes drops the outcomes from before since.
+func pruneOutcomes(outcomes []outcome, since time.Time) []outcome {
+	i := 0
+	for i < len(outcomes) && outcomes[i].at.Before(since) {
+		i++
+	}
+	return outcomes[i:]
+}
+
+func errorRate(outcomes []outcome) float64 {
+	if len(outcomes) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, o := range outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(outcomes))
+}
@@ -1,32 +1,188 @@
 package emailsender
 
 import (
+	"context"
 	"errors"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"sync"
+	"time"
 )
 
+// Strategy sends an email through one of its providers. Send stops trying
+// further providers once ctx is done, and then returns its error.
 type Strategy interface {
-	Send(m emailprovider.Email) error
+	Send(ctx context.Context, m emailprovider.Email) error
 }
 
+// Attempt is the outcome of handing an email to a single provider. Failover
+// is set if the strategy tried another provider for the email first.
+type Attempt struct {
+	Email          emailprovider.Email
+	Provider       string
+	TransmissionID string
+	Err            error
+	Duration       time.Duration
+	Failover       bool
+}
+
+// Observer is notified by strategies about every attempt they make, such
+// that the lifecycle of a message can be followed.
+type Observer interface {
+	Attempted(a Attempt)
+}
+
+// Observers notifies every observer in the list.
+type Observers []Observer
+
+func (o Observers) Attempted(a Attempt) {
+	for _, observer := range o {
+		observer.Attempted(a)
+	}
+}
+
+// attempt sends m through p and reports the outcome to o, if any. tried is
+// the number of providers the strategy tried before p.
+func attempt(ctx context.Context, o Observer, p emailprovider.Provider, m emailprovider.Email, tried int) error {
+	start := time.Now()
+	transmissionID, err := p.Send(ctx, m)
+	if o != nil {
+		o.Attempted(Attempt{
+			Email:          m,
+			Provider:       p.Name(),
+			TransmissionID: transmissionID,
+			Err:            err,
+			Duration:       time.Since(start),
+			Failover:       tried > 0,
+		})
+	}
+	return err
+}
+
+// throttle remembers the providers which rate limited a send, and skips them
+// until the time they asked to be left alone for has passed. Its zero value is
+// ready for use.
+type throttle struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// wait returns how long the provider is still throttled for.
+func (t *throttle) wait(provider string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until, ok := t.until[provider]; ok && until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// record throttles the provider if err asks to retry after a while.
+func (t *throttle) record(provider string, err error, now time.Time) {
+	wait := emailprovider.RetryAfter(err)
+	if wait <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.until == nil {
+		t.until = make(map[string]time.Time)
+	}
+	t.until[provider] = now.Add(wait)
+}
+
+// failures tallies the providers a send could not go through. Providers which
+// are rate limiting are counted apart, so that a send which only failed by
+// throttling can tell the caller how long to wait.
+type failures struct {
+	failed     int
+	limited    int
+	retryAfter time.Duration
+}
+
+// add counts the error of a provider.
+func (f *failures) add(err error) {
+	if emailprovider.KindOf(err) == emailprovider.FailureRateLimited {
+		f.limit(emailprovider.RetryAfter(err))
+		return
+	}
+	f.failed++
+}
+
+// limit counts a provider which is throttled for wait.
+func (f *failures) limit(wait time.Duration) {
+	if f.limited == 0 || wait < f.retryAfter {
+		f.retryAfter = wait
+	}
+	f.limited++
+}
+
+// err returns a rate limited send error if every provider was throttled, and
+// otherwise an error with the given message.
+func (f *failures) err(message string) error {
+	if f.failed == 0 && f.limited > 0 {
+		return &emailprovider.SendError{
+			Kind:       emailprovider.FailureRateLimited,
+			RetryAfter: f.retryAfter,
+			Err:        errors.New("All providers are rate limiting sends."),
+		}
+	}
+	return errors.New(message)
+}
+
+// RoundRobinSender is safe for concurrent use, such as by the queue workers.
 type RoundRobinSender struct {
 	Providers []emailprovider.Provider
+	Observer  Observer
+	mu        sync.Mutex
 	lastIndex int
+	throttle  throttle
 }
 
-func (s *RoundRobinSender) Send(m emailprovider.Email) error {
+func (s *RoundRobinSender) Send(ctx context.Context, m emailprovider.Email) error {
+	return s.send(ctx, m, batchFailure{})
+}
+
+// send sends m through the providers in turn, skipping the provider of prior.
+func (s *RoundRobinSender) send(ctx context.Context, m emailprovider.Email, prior batchFailure) error {
 	if len(s.Providers) == 0 {
 		return errors.New("Empty list of providers. It seems impossible to send an email through a provider if no email providers are provided.")
 	}
-	currentIndex := s.lastIndex
-	for do := true; do; do = currentIndex != s.lastIndex {
-		current := s.Providers[currentIndex]
-		err := current.Send(m)
+	s.mu.Lock()
+	lastIndex := s.lastIndex
+	s.mu.Unlock()
+	currentIndex := lastIndex
+	var failed failures
+	tried := 0
+	for do := true; do; do = currentIndex != lastIndex {
+		i := currentIndex
+		current := s.Providers[i]
+		currentIndex = (currentIndex + 1) % len(s.Providers)
+		if current.Name() == prior.provider {
+			tried++
+			failed.add(prior.err)
+			continue
+		}
+		if wait := s.throttle.wait(current.Name(), time.Now()); wait > 0 {
+			failed.limit(wait)
+			continue
+		}
+		err := attempt(ctx, s.Observer, current, m, tried)
+		tried++
 		if err == nil {
-			s.lastIndex = currentIndex
+			s.mu.Lock()
+			s.lastIndex = i
+			s.mu.Unlock()
 			return nil
 		}
-		currentIndex = (currentIndex + 1) % len(s.Providers)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if emailprovider.IsPermanent(err) {
+			// Every other provider would refuse the email as well.
+			return err
+		}
+		s.throttle.record(current.Name(), err, time.Now())
+		failed.add(err)
 	}
-	return errors.New("All providers reported an error while attempting to send.")
+	return failed.err("All providers reported an error while attempting to send.")
 }
@@ -0,0 +1,94 @@
+package emailsender
+
+import (
+	"context"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"sync"
+	"time"
+)
+
+// PrioritySender prefers the providers in the order they are listed. When a
+// provider fails it fails over to the next one, which is then used for all
+// sends until RecoveryWindow has passed, after which it starts over with the
+// primary provider.
+type PrioritySender struct {
+	Providers      []emailprovider.Provider
+	Observer       Observer
+	RecoveryWindow time.Duration
+	// Now returns the current time, and can be replaced in tests.
+	Now func() time.Time
+
+	mu           sync.Mutex
+	current      int
+	failedOverAt time.Time
+	throttle     throttle
+}
+
+func (s *PrioritySender) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// start returns the index of the provider to try first, returning to the
+// primary once the recovery window has passed.
+func (s *PrioritySender) start() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != 0 && s.now().Sub(s.failedOverAt) >= s.RecoveryWindow {
+		s.current = 0
+	}
+	return s.current
+}
+
+func (s *PrioritySender) Send(ctx context.Context, m emailprovider.Email) error {
+	return s.send(ctx, m, batchFailure{})
+}
+
+// send sends m through the providers in order of priority, skipping the
+// provider of prior.
+func (s *PrioritySender) send(ctx context.Context, m emailprovider.Email, prior batchFailure) error {
+	if len(s.Providers) == 0 {
+		return errors.New("Empty list of providers. It seems impossible to send an email through a provider if no email providers are provided.")
+	}
+	start := s.start()
+	var failed failures
+	tried := 0
+	for offset := 0; offset < len(s.Providers); offset++ {
+		i := (start + offset) % len(s.Providers)
+		p := s.Providers[i]
+		if p.Name() == prior.provider {
+			tried++
+			failed.add(prior.err)
+			continue
+		}
+		if wait := s.throttle.wait(p.Name(), s.now()); wait > 0 {
+			failed.limit(wait)
+			continue
+		}
+		err := attempt(ctx, s.Observer, p, m, tried)
+		tried++
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if emailprovider.IsPermanent(err) {
+				// Every other provider would refuse the email as well.
+				return err
+			}
+			s.throttle.record(p.Name(), err, s.now())
+			failed.add(err)
+			continue
+		}
+		if i != start {
+			s.mu.Lock()
+			s.current = i
+			s.failedOverAt = s.now()
+			s.mu.Unlock()
+		}
+		return nil
+	}
+	return failed.err("All providers reported an error while attempting to send.")
+}
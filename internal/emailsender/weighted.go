@@ -0,0 +1,152 @@
+package emailsender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WeightedProvider is a provider along with its share of the traffic. A
+// negative weight counts as zero.
+type WeightedProvider struct {
+	Provider emailprovider.Provider
+	Weight   int
+}
+
+// ParseWeights pairs the providers with the weights given by spec, such as
+// "sparkpost=80,sendgrid=20". Providers left out of spec get a weight of 1.
+// Weights must be non-negative integers, and name one of the providers.
+func ParseWeights(spec string, providers []emailprovider.Provider) ([]WeightedProvider, error) {
+	weights := map[string]int{}
+	known := map[string]bool{}
+	for _, p := range providers {
+		known[p.Name()] = true
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Provider weight %q is not of the form name=weight", pair)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !known[name] {
+			return nil, fmt.Errorf("Weight given for unknown provider %s", name)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Weight of provider %s must be a non-negative integer: %s", name, parts[1])
+		}
+		weights[name] = weight
+	}
+	weighted := make([]WeightedProvider, 0, len(providers))
+	for _, p := range providers {
+		weight, ok := weights[p.Name()]
+		if !ok {
+			weight = 1
+		}
+		weighted = append(weighted, WeightedProvider{Provider: p, Weight: weight})
+	}
+	return weighted, nil
+}
+
+// WeightedSender splits the traffic between the providers by their weights,
+// such that weights of 80 and 20 send four out of five emails through the
+// first provider. If the chosen provider fails, the remaining providers are
+// tried, again picked by weight.
+type WeightedSender struct {
+	Providers []WeightedProvider
+	Observer  Observer
+	// Rand returns a number in [0, 1), and can be replaced in tests.
+	Rand func() float64
+
+	mu       sync.Mutex
+	random   *rand.Rand
+	throttle throttle
+}
+
+func (s *WeightedSender) Send(ctx context.Context, m emailprovider.Email) error {
+	return s.send(ctx, m, batchFailure{})
+}
+
+// send sends m through providers picked by weight, skipping the provider of prior.
+func (s *WeightedSender) send(ctx context.Context, m emailprovider.Email, prior batchFailure) error {
+	if len(s.Providers) == 0 {
+		return errors.New("Empty list of providers. It seems impossible to send an email through a provider if no email providers are provided.")
+	}
+	remaining := append([]WeightedProvider(nil), s.Providers...)
+	var failed failures
+	tried := 0
+	for len(remaining) > 0 {
+		i := s.pick(remaining)
+		p := remaining[i].Provider
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		if p.Name() == prior.provider {
+			tried++
+			failed.add(prior.err)
+			continue
+		}
+		if wait := s.throttle.wait(p.Name(), time.Now()); wait > 0 {
+			failed.limit(wait)
+			continue
+		}
+		err := attempt(ctx, s.Observer, p, m, tried)
+		tried++
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if emailprovider.IsPermanent(err) {
+			// Every other provider would refuse the email as well.
+			return err
+		}
+		s.throttle.record(p.Name(), err, time.Now())
+		failed.add(err)
+	}
+	return failed.err("All providers reported an error while attempting to send.")
+}
+
+// pick returns the index of a provider chosen with a probability proportional
+// to its weight. Providers with a weight of zero are only picked once all
+// others have been tried.
+func (s *WeightedSender) pick(providers []WeightedProvider) int {
+	total := 0
+	for _, p := range providers {
+		if p.Weight > 0 {
+			total += p.Weight
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	target := s.float64() * float64(total)
+	for i, p := range providers {
+		if p.Weight <= 0 {
+			continue
+		}
+		target -= float64(p.Weight)
+		if target < 0 {
+			return i
+		}
+	}
+	return len(providers) - 1
+}
+
+func (s *WeightedSender) float64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Rand != nil {
+		return s.Rand()
+	}
+	if s.random == nil {
+		s.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return s.random.Float64()
+}
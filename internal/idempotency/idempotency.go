@@ -0,0 +1,229 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long responses are kept, unless set by Store.TTL.
+const DefaultTTL = 24 * time.Hour
+
+// DefaultCompactInterval is how often a started store drops the expired
+// responses, unless set by Store.CompactInterval.
+const DefaultCompactInterval = time.Hour
+
+// Errors returned by Begin when a key cannot be used for a request.
+var (
+	// ErrMismatch means the key was used for a request with another payload.
+	ErrMismatch = errors.New("Idempotency key was used for a different request")
+	// ErrInProgress means a request with the key has not finished yet.
+	ErrInProgress = errors.New("A request with the idempotency key is in progress")
+)
+
+// Response is the stored response of a request, which is replayed to
+// retries of it.
+type Response struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+// entry is a key along with the fingerprint of the request it was first used
+// for. Its response is nil while the request is in progress.
+type entry struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Response    *Response `json:"response,omitempty"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Fingerprint identifies a request by its method, path and body.
+func Fingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Store keeps the responses of requests by their idempotency keys for TTL,
+// backed by a journal on disk. Requests in progress are only held in memory,
+// so they are forgotten if the process stops.
+type Store struct {
+	// TTL is how long a response is kept after the request finished, and
+	// defaults to DefaultTTL.
+	TTL time.Duration
+	// CompactInterval is how often the expired responses are dropped once
+	// the store is started, and defaults to DefaultCompactInterval.
+	CompactInterval time.Duration
+	// Now returns the current time, and can be replaced in tests.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	journal *journal.Journal
+	entries map[string]*entry
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// Open opens the store at path, compacting its journal to the responses which
+// have not expired.
+func Open(path string) (*Store, error) {
+	s := &Store{entries: map[string]*entry{}}
+	j, err := journal.Open(path, func(raw json.RawMessage) error {
+		var e entry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		s.entries[e.Key] = &e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	if err := s.compact(); err != nil {
+		j.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *Store) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return DefaultTTL
+}
+
+// Compact drops the expired responses, and rewrites the journal to the ones
+// left.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// compact drops the expired responses. Requests in progress never expire, and
+// are not written to the journal.
+func (s *Store) compact() error {
+	now := s.now()
+	records := make([]interface{}, 0, len(s.entries))
+	for key, e := range s.entries {
+		switch {
+		case e.Response == nil:
+		case !e.Expires.After(now):
+			delete(s.entries, key)
+		default:
+			records = append(records, e)
+		}
+	}
+	return s.journal.Rewrite(records)
+}
+
+// Start compacts the store every CompactInterval until it is stopped.
+func (s *Store) Start() error {
+	interval := s.CompactInterval
+	if interval <= 0 {
+		interval = DefaultCompactInterval
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return errors.New("Idempotency store has already been started")
+	}
+	s.stop = make(chan struct{})
+	s.done.Add(1)
+	go s.run(interval, s.stop)
+	return nil
+}
+
+// Stop stops compacting the store.
+func (s *Store) Stop() {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		s.done.Wait()
+	}
+}
+
+func (s *Store) run(interval time.Duration, stop <-chan struct{}) {
+	defer s.done.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				log.Printf("Could not compact the idempotency journal: %s\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Begin starts a request with the key. If the key was used before for the
+// same request, its response is returned for replay. Otherwise the request
+// must be completed by Finish or Abort.
+func (s *Store) Begin(key, fingerprint string) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && (e.Response == nil || e.Expires.After(s.now())) {
+		if e.Fingerprint != fingerprint {
+			return nil, ErrMismatch
+		}
+		if e.Response == nil {
+			return nil, ErrInProgress
+		}
+		return e.Response, nil
+	}
+	s.entries[key] = &entry{Key: key, Fingerprint: fingerprint}
+	return nil, nil
+}
+
+// Finish stores the response of the request begun with the key.
+func (s *Store) Finish(key string, response Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return errors.New("Idempotency key was not begun")
+	}
+	finished := &entry{Key: key, Fingerprint: e.Fingerprint, Response: &response, Expires: s.now().Add(s.ttl())}
+	if err := s.journal.Append(finished); err != nil {
+		delete(s.entries, key)
+		return err
+	}
+	s.entries[key] = finished
+	return nil
+}
+
+// Abort forgets the request begun with the key, such that it can be retried.
+func (s *Store) Abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && e.Response == nil {
+		delete(s.entries, key)
+	}
+}
+
+func (s *Store) Close() error {
+	s.Stop()
+	return s.journal.Close()
+}
@@ -0,0 +1,131 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// Journal is an append-only log of JSON records, one per line. Stores replay
+// the journal on start-up to rebuild their state, and compact it by rewriting
+// only the records that still matter.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens or creates the journal at path and calls replay with every
+// record in it, in the order they were appended. A trailing partial line,
+// as left by a crash in the middle of a write, is skipped.
+func Open(path string, replay func(record json.RawMessage) error) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			log.Printf("Skipping corrupt record in journal %s\n", path)
+			continue
+		}
+		if err := replay(json.RawMessage(line)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+// Append writes record to the end of the journal and syncs it to disk before
+// returning, so an acknowledged record survives a crash.
+func (j *Journal) Append(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// AppendAll is like Append, but writes all records at once, which are synced
+// to disk together.
+func (j *Journal) AppendAll(records []interface{}) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Rewrite atomically replaces the content of the journal with records.
+func (j *Journal) Rewrite(records []interface{}) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,181 @@
+package maildir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is returned for ids of messages which are not in the Maildir.
+var ErrNotFound = errors.New("Message not found")
+
+// MaildirProvider delivers emails into a Maildir on disk instead of sending
+// them, such that no mail leaves the service in development and staging. The
+// messages can be read by any mail client supporting Maildir, or through List
+// and Read.
+type MaildirProvider struct {
+	// Dir is the Maildir, and is read from MAILDIR_PATH by Init if empty.
+	Dir string
+	// Now returns the time of delivery, and defaults to time.Now.
+	Now func() time.Time
+}
+
+// deliveries numbers the deliveries of the process, which keeps the names of
+// messages delivered at the same time apart.
+var deliveries int64
+
+func (s *MaildirProvider) Init() error {
+	if s.Dir == "" {
+		s.Dir = os.Getenv("MAILDIR_PATH")
+	}
+	if s.Dir == "" {
+		log.Println("Could not initialize Maildir provider.")
+		return errors.New("Maildir provider requires a directory")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(s.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MaildirProvider) Name() string {
+	return "maildir"
+}
+
+// Send writes m into the new directory of the Maildir, and returns the name
+// of the message file as transmission id. The envelope recipients, including
+// Bcc, are recorded in Delivered-To headers, as a local delivery agent would.
+func (s *MaildirProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	if s.Dir == "" {
+		return "", errors.New("Maildir provider not initialized correctly")
+	}
+	message, err := mimemessage.Build(m)
+	if err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "Return-Path: <%s>\r\n", m.From.Address())
+	for _, recipient := range mimemessage.Recipients(m) {
+		fmt.Fprintf(&buffer, "Delivered-To: %s\r\n", recipient)
+	}
+	buffer.Write(message)
+	name := s.uniqueName()
+	// Messages are written to tmp and moved to new once complete, such that
+	// readers never see a partial message.
+	tmp := filepath.Join(s.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, buffer.Bytes(), 0600); err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+	}
+	log.Printf("Delivered to Maildir %s: %s\n", name, m)
+	return name, nil
+}
+
+func (s *MaildirProvider) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// uniqueName returns a name for a new message, following the conventions of
+// Maildir: the time, the process and delivery, and the host.
+func (s *MaildirProvider) uniqueName() string {
+	now := s.now()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&deliveries, 1), host)
+}
+
+// Message summarizes a message of the Maildir. Its id is the unique part of
+// the file name, which stays the same when a mail client moves it to cur.
+type Message struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Subject  string    `json:"subject"`
+	Size     int64     `json:"size"`
+}
+
+// List returns the messages of the Maildir, newest first.
+func (s *MaildirProvider) List() ([]Message, error) {
+	messages := []Message{}
+	for _, sub := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(s.Dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			message := Message{
+				ID:       strings.SplitN(file.Name(), ":", 2)[0],
+				Received: file.ModTime(),
+				Size:     file.Size(),
+			}
+			if raw, err := ioutil.ReadFile(filepath.Join(s.Dir, sub, file.Name())); err == nil {
+				if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+					message.From = decodeHeader(parsed.Header.Get("From"))
+					message.To = decodeHeader(parsed.Header.Get("To"))
+					message.Subject = decodeHeader(parsed.Header.Get("Subject"))
+				}
+			}
+			messages = append(messages, message)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Received.After(messages[j].Received)
+	})
+	return messages, nil
+}
+
+// Read returns the raw message with the given id.
+func (s *MaildirProvider) Read(id string) ([]byte, error) {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\:`) {
+		return nil, ErrNotFound
+	}
+	if raw, err := ioutil.ReadFile(filepath.Join(s.Dir, "new", id)); err == nil {
+		return raw, nil
+	}
+	// Mail clients append flags to the names of messages they have seen
+	matches, _ := filepath.Glob(filepath.Join(s.Dir, "cur", id+":*"))
+	if len(matches) == 0 {
+		return nil, ErrNotFound
+	}
+	return ioutil.ReadFile(matches[0])
+}
+
+var wordDecoder mime.WordDecoder
+
+// decodeHeader decodes the encoded words of a header value, keeping the value
+// as is if it cannot be decoded.
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
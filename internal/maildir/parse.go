@@ -0,0 +1,136 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Header is a header of a parsed message, with its encoded words decoded.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Part is an attachment or inline part of a parsed message.
+type Part struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Size        int
+}
+
+// Parsed is a message split into its headers, its text and html bodies, and
+// the remaining parts.
+type Parsed struct {
+	Headers []Header
+	Text    string
+	Html    string
+	Parts   []Part
+}
+
+// Get returns the value of the first header with the given name.
+func (p *Parsed) Get(name string) string {
+	for _, h := range p.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// Parse parses a raw RFC 5322 message. The first text/plain and text/html
+// bodies which are not attachments become the text and html of the message.
+func Parse(raw []byte) (*Parsed, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	parsed := &Parsed{}
+	// The headers are read again to keep their order, which mail.Header loses.
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	for {
+		line, err := reader.ReadContinuedLine()
+		if err != nil || line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			parsed.Headers = append(parsed.Headers, Header{Name: line[:i], Value: decodeHeader(strings.TrimSpace(line[i+1:]))})
+		}
+	}
+	header := textproto.MIMEHeader(message.Header)
+	if err := parsed.walk(header, decode(header, message.Body)); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// walk adds the entity with the given header and decoded body to p,
+// descending into multipart entities.
+func (p *Parsed) walk(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// The multipart reader decodes quoted-printable parts itself.
+			if err := p.walk(part.Header, decode(part.Header, part)); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if disposition != "attachment" && filename == "" {
+		if mediaType == "text/plain" && p.Text == "" {
+			p.Text = string(data)
+			return nil
+		}
+		if mediaType == "text/html" && p.Html == "" {
+			p.Html = string(data)
+			return nil
+		}
+	}
+	p.Parts = append(p.Parts, Part{
+		Filename:    filename,
+		ContentType: mediaType,
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+		Size:        len(data),
+	})
+	return nil
+}
+
+// decode undoes the content transfer encoding of a body.
+func decode(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
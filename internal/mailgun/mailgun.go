@@ -0,0 +1,215 @@
+package mailgun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// Regions of the Mailgun API. Domains belong to a region, and can only be
+// used through its API.
+const (
+	RegionUS = "us"
+	RegionEU = "eu"
+)
+
+var regionURLs = map[string]string{
+	RegionUS: "https://api.mailgun.net",
+	RegionEU: "https://api.eu.mailgun.net",
+}
+
+// MaxTags is the number of tags Mailgun accepts per message. Further tags are
+// left out.
+const MaxTags = 3
+
+// MailgunProvider sends through the messages API of Mailgun. Fields left empty
+// are read from the environment by Init, and BaseURL defaults to the API of
+// the region.
+type MailgunProvider struct {
+	Domain     string
+	APIKey     string
+	Region     string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (s *MailgunProvider) Init() error {
+	if s.Domain == "" {
+		s.Domain = os.Getenv("MAILGUN_DOMAIN")
+	}
+	if s.APIKey == "" {
+		s.APIKey = os.Getenv("MAILGUN_API_KEY")
+	}
+	if s.Region == "" {
+		s.Region = strings.ToLower(os.Getenv("MAILGUN_REGION"))
+	}
+	if s.Region == "" {
+		s.Region = RegionUS
+	}
+	if s.Domain == "" || s.APIKey == "" {
+		log.Println("Could not initialize Mailgun provider.")
+		return errors.New("Mailgun provider requires a domain and an API key")
+	}
+	if s.BaseURL == "" {
+		url, ok := regionURLs[s.Region]
+		if !ok {
+			return fmt.Errorf("Unknown Mailgun region: %s", s.Region)
+		}
+		s.BaseURL = url
+	}
+	return nil
+}
+
+func (s *MailgunProvider) Name() string {
+	return "mailgun"
+}
+
+// Send returns the Message-Id assigned by Mailgun, without angle brackets, as
+// transmission id.
+func (s *MailgunProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	if s.Domain == "" || s.BaseURL == "" {
+		return "", errors.New("Mailgun provider not initialized correctly")
+	}
+	log.Printf("Sending through Mailgun: %s\n", m)
+	body, contentType, err := form(m)
+	if err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	url := strings.TrimSuffix(s.BaseURL, "/") + "/v3/" + s.Domain + "/messages"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth("api", s.APIKey)
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending through Mailgun: %s\n", err)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+	}
+	defer res.Body.Close()
+	raw, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	var response struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(raw, &response)
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Error sending through Mailgun: %d %s\n", res.StatusCode, raw)
+		return "", s.failure(res, response.Message)
+	}
+	return strings.Trim(response.ID, "<>"), nil
+}
+
+// failure classifies a failed response. Mailgun reports refused recipients
+// in the message of a 400 response, and an unknown domain with 404, which is
+// a misconfiguration of the provider like a wrong API key.
+func (s *MailgunProvider) failure(res *http.Response, message string) *emailprovider.SendError {
+	kind := emailprovider.FailureOfStatus(res.StatusCode)
+	if res.StatusCode == http.StatusNotFound {
+		kind = emailprovider.FailureAuth
+	}
+	lower := strings.ToLower(message)
+	if kind == emailprovider.FailureRejected && (strings.Contains(lower, "recipient") || strings.Contains(lower, "to parameter") || strings.Contains(lower, "address")) {
+		kind = emailprovider.FailureInvalidRecipient
+	}
+	if message == "" {
+		message = http.StatusText(res.StatusCode)
+	}
+	failure := emailprovider.Fail(s.Name(), kind, fmt.Errorf("Mailgun responded with status %d: %s", res.StatusCode, message))
+	if kind == emailprovider.FailureRateLimited {
+		failure.RetryAfter = emailprovider.ParseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+	return failure
+}
+
+// form encodes m as the multipart form of the messages API.
+func form(m emailprovider.Email) (*bytes.Buffer, string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	// Fields are written to memory, which cannot fail
+	field := func(name, value string) {
+		w.WriteField(name, value)
+	}
+	field("from", mimemessage.FormatAddress(m.From))
+	for _, to := range m.To {
+		field("to", mimemessage.FormatAddress(to))
+	}
+	for _, cc := range m.Cc {
+		field("cc", mimemessage.FormatAddress(cc))
+	}
+	for _, bcc := range m.Bcc {
+		field("bcc", mimemessage.FormatAddress(bcc))
+	}
+	field("subject", m.Subject.String())
+	if m.Body != "" {
+		field("text", m.Body)
+	}
+	if m.HtmlBody != nil && m.HtmlBody.String() != "" {
+		field("html", m.HtmlBody.String())
+	}
+	if m.ReplyTo != nil {
+		field("h:Reply-To", mimemessage.FormatAddress(m.ReplyTo))
+	}
+	for name, value := range m.Headers {
+		field("h:"+name, value)
+	}
+	tags := m.Tags
+	if len(tags) > MaxTags {
+		log.Printf("Mailgun accepts %d tags, leaving out %v\n", MaxTags, tags[MaxTags:])
+		tags = tags[:MaxTags]
+	}
+	for _, tag := range tags {
+		field("o:tag", tag)
+	}
+	for key, value := range m.Metadata {
+		field("v:"+key, value)
+	}
+	// The message id is attached as a user variable, like the metadata, so
+	// that the events of the message in Mailgun can be matched to it.
+	if m.ID != "" {
+		field("v:"+emailprovider.MessageIDMetadataKey, m.ID)
+	}
+	for _, a := range m.Attachments {
+		// Inline attachments are referenced by their filename in Mailgun, so
+		// the content-ID is sent as the filename.
+		name, filename := "attachment", a.Filename()
+		if a.Disposition() == emailprovider.DispositionInline {
+			name, filename = "inline", a.ContentID()
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, name, filename))
+		header.Set("Content-Type", a.ContentType())
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(a.Data()); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return &body, w.FormDataContentType(), nil
+}
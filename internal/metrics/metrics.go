@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+)
+
+// Metrics are the metrics of the service, which are served at /metrics. It
+// implements emailsender.Observer to follow the attempts of the strategy.
+type Metrics struct {
+	Registry *Registry
+	// MessagesAccepted counts the messages accepted for sending.
+	MessagesAccepted *Counter
+	// MessagesRejected counts the messages rejected, by the code of the
+	// problem they were rejected with.
+	MessagesRejected *Counter
+	// ProviderAttempts counts the sends to each provider, by their outcome.
+	ProviderAttempts *Counter
+	// ProviderFailures counts the failed sends to each provider, by the kind
+	// of failure.
+	ProviderFailures *Counter
+	// Failovers counts the sends a strategy made to a provider after trying
+	// another one for the same message.
+	Failovers *Counter
+	// ProviderLatency observes the duration of the sends to each provider.
+	ProviderLatency *Histogram
+	// RequestLatency observes the duration of the requests to each endpoint.
+	RequestLatency *Histogram
+}
+
+// New creates the metrics of the service in a new registry.
+func New() *Metrics {
+	r := &Registry{}
+	return &Metrics{
+		Registry:         r,
+		MessagesAccepted: r.NewCounter("email_messages_accepted_total", "Messages accepted for sending."),
+		MessagesRejected: r.NewCounter("email_messages_rejected_total", "Messages rejected, by the code of the problem.", "reason"),
+		ProviderAttempts: r.NewCounter("email_provider_attempts_total", "Sends to a provider, by outcome.", "provider", "outcome"),
+		ProviderFailures: r.NewCounter("email_provider_failures_total", "Failed sends to a provider, by kind of failure.", "provider", "kind"),
+		Failovers:        r.NewCounter("email_provider_failovers_total", "Sends to a provider after another provider was tried for the message.", "provider"),
+		ProviderLatency:  r.NewHistogram("email_provider_latency_seconds", "Duration of the sends to a provider.", DefaultBuckets, "provider"),
+		RequestLatency:   r.NewHistogram("email_request_duration_seconds", "Duration of the requests to the api, by endpoint.", DefaultBuckets, "path", "method"),
+	}
+}
+
+// Attempted records an attempt of the strategy.
+func (m *Metrics) Attempted(a emailsender.Attempt) {
+	outcome := "success"
+	if a.Err != nil {
+		outcome = "failure"
+		m.ProviderFailures.Inc(a.Provider, string(emailprovider.KindOf(a.Err)))
+	}
+	m.ProviderAttempts.Inc(a.Provider, outcome)
+	if a.Failover {
+		m.Failovers.Inc(a.Provider)
+	}
+	m.ProviderLatency.Observe(a.Duration.Seconds(), a.Provider)
+}
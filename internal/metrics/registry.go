@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds, suited
+// for the latency of requests and providers.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metric is a metric family which can write itself in the text exposition
+// format of Prometheus.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics, and writes them in the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the text exposition format.
+func (r *Registry) Write(out io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	w := bufio.NewWriter(out)
+	for _, m := range metrics {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+// labelSet is the values of the labels of a single series, joined to be used
+// as a map key.
+type labelSet string
+
+func makeLabelSet(names []string, values []string) labelSet {
+	if len(values) != len(names) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(names), len(values)))
+	}
+	return labelSet(strings.Join(values, "\xff"))
+}
+
+// format returns the labels as {name="value",...}, with extra appended.
+func (l labelSet) format(names []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	if len(names) > 0 {
+		for i, value := range strings.Split(string(l), "\xff") {
+			pairs = append(pairs, names[i]+"="+quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortLabelSets(keys []labelSet) []labelSet {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Counter is a monotonically increasing value per combination of labels.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[labelSet]float64
+}
+
+// NewCounter registers a counter with the given label names. Series are
+// written once they have been added to.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, series: map[labelSet]float64{}}
+	if len(labels) == 0 {
+		// A counter without labels has a single series, which starts at zero.
+		c.series[""] = 0
+	}
+	r.register(c)
+	return c
+}
+
+// Add adds v, which must not be negative, to the series of the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	key := makeLabelSet(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[key] += v
+}
+
+// Inc adds one to the series of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the value of the series of the label values.
+func (c *Counter) Value(values ...string) float64 {
+	key := makeLabelSet(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.series[key]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]labelSet, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	for _, key := range sortLabelSets(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key.format(c.labels), formatFloat(c.series[key]))
+	}
+}
+
+// Gauge is a value read whenever the metrics are written, such as the length
+// of a queue.
+type Gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGauge registers a gauge reporting the result of value.
+func (r *Registry) NewGauge(name, help string, value func() float64) *Gauge {
+	g := &Gauge{name: name, help: help, value: value}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// Histogram counts observations in cumulative buckets per combination of
+// labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[labelSet]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[labelSet]*histogramSeries{}}
+	r.register(h)
+	return h
+}
+
+// Observe records v in the series of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := makeLabelSet(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Count returns the number of observations in the series of the label
+// values.
+func (h *Histogram) Count(values ...string) uint64 {
+	key := makeLabelSet(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]labelSet, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	for _, key := range sortLabelSets(keys) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, key.format(h.labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, key.format(h.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key.format(h.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key.format(h.labels), s.count)
+	}
+}
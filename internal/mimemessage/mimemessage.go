@@ -0,0 +1,269 @@
+package mimemessage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Build renders m as an RFC 5322 message with MIME bodies, ready to be handed
+// to anything speaking raw mail, such as an SMTP server. Bcc recipients are
+// deliberately left out of the headers; they only belong in the envelope.
+func Build(m emailprovider.Email) ([]byte, error) {
+	if m.From == nil {
+		return nil, errors.New("Email has no sender")
+	}
+	if m.Subject == nil {
+		return nil, errors.New("Email has no subject")
+	}
+	var buffer bytes.Buffer
+	writeHeader(&buffer, "From", FormatAddress(m.From))
+	if len(m.To) > 0 {
+		writeHeader(&buffer, "To", FormatAddresses(m.To))
+	}
+	if len(m.Cc) > 0 {
+		writeHeader(&buffer, "Cc", FormatAddresses(m.Cc))
+	}
+	if m.ReplyTo != nil {
+		writeHeader(&buffer, "Reply-To", FormatAddress(m.ReplyTo))
+	}
+	writeHeader(&buffer, "Subject", mime.QEncoding.Encode("utf-8", m.Subject.String()))
+	writeHeader(&buffer, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&buffer, "Message-ID", MessageID(m))
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(&buffer, name, mime.QEncoding.Encode("utf-8", m.Headers[name]))
+	}
+	writeHeader(&buffer, "MIME-Version", "1.0")
+	if err := writeBody(&buffer, m); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Recipients returns the envelope recipients of m, which includes the Bcc
+// addresses that are not part of the message headers.
+func Recipients(m emailprovider.Email) []string {
+	recipients := make([]string, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	for _, list := range [][]emailprovider.EmailAddress{m.To, m.Cc, m.Bcc} {
+		for _, e := range list {
+			recipients = append(recipients, e.Address())
+		}
+	}
+	return recipients
+}
+
+// entity is a MIME entity: its content headers and a function writing its
+// encoded body.
+type entity struct {
+	header textproto.MIMEHeader
+	body   func(w io.Writer) error
+}
+
+// writeBody writes the content headers and the body. The bodies are nested as
+// follows, leaving out the levels that are not needed:
+//
+//	multipart/mixed
+//	  multipart/related
+//	    multipart/alternative
+//	      text/plain
+//	      text/html
+//	    inline images
+//	  attachments
+func writeBody(w io.Writer, m emailprovider.Email) error {
+	var inline, attached []entity
+	for _, a := range m.Attachments {
+		if a.Disposition() == emailprovider.DispositionInline {
+			inline = append(inline, attachmentEntity(a))
+		} else {
+			attached = append(attached, attachmentEntity(a))
+		}
+	}
+	root := contentEntity(m)
+	if len(inline) > 0 {
+		root = multipartEntity("related", append([]entity{root}, inline...))
+	}
+	if len(attached) > 0 {
+		root = multipartEntity("mixed", append([]entity{root}, attached...))
+	}
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Id"} {
+		if value := root.header.Get(key); value != "" {
+			writeHeader(w, key, value)
+		}
+	}
+	io.WriteString(w, "\r\n")
+	return root.body(w)
+}
+
+// contentEntity returns the text and html bodies of m. A message with both
+// becomes multipart/alternative, with the plain text first as the least
+// preferred alternative.
+func contentEntity(m emailprovider.Email) entity {
+	html := ""
+	if m.HtmlBody != nil {
+		html = m.HtmlBody.String()
+	}
+	if html == "" {
+		return textEntity("text/plain; charset=utf-8", m.Body)
+	}
+	if m.Body == "" {
+		return textEntity("text/html; charset=utf-8", html)
+	}
+	return multipartEntity("alternative", []entity{
+		textEntity("text/plain; charset=utf-8", m.Body),
+		textEntity("text/html; charset=utf-8", html),
+	})
+}
+
+func textEntity(contentType, content string) entity {
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: func(w io.Writer) error {
+			return writeQuotedPrintable(w, content)
+		},
+	}
+}
+
+func multipartEntity(subtype string, parts []entity) entity {
+	boundary := multipart.NewWriter(nil).Boundary()
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})},
+		},
+		body: func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			if err := mw.SetBoundary(boundary); err != nil {
+				return err
+			}
+			for _, part := range parts {
+				pw, err := mw.CreatePart(part.header)
+				if err != nil {
+					return err
+				}
+				if err := part.body(pw); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		},
+	}
+}
+
+func attachmentEntity(a emailprovider.Attachment) entity {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {withParam(a.ContentType(), "name", a.Filename())},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType(a.Disposition(), map[string]string{"filename": a.Filename()})},
+	}
+	if a.ContentID() != "" {
+		header.Set("Content-Id", "<"+a.ContentID()+">")
+	}
+	return entity{
+		header: header,
+		body: func(w io.Writer) error {
+			return writeBase64(w, a.Data())
+		},
+	}
+}
+
+// withParam adds a parameter to a media type, keeping its other parameters.
+func withParam(contentType, key, value string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	params[key] = value
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qw, normalizeNewlines(content)); err != nil {
+		return err
+	}
+	if err := qw.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// normalizeNewlines converts all line endings to CRLF as required by RFC 5322.
+func normalizeNewlines(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\n", "\r\n", -1)
+}
+
+func writeHeader(w io.Writer, key, value string) {
+	fmt.Fprintf(w, "%s: %s\r\n", key, value)
+}
+
+// FormatAddress formats e as an address header would carry it, quoting and
+// encoding the name as needed. Addresses without a name are left bare.
+func FormatAddress(e emailprovider.EmailAddress) string {
+	if e.Name() == "" {
+		return e.Address()
+	}
+	return (&mail.Address{Name: e.Name(), Address: e.Address()}).String()
+}
+
+// FormatAddresses formats the addresses as a comma separated list.
+func FormatAddresses(list []emailprovider.EmailAddress) string {
+	formatted := make([]string, 0, len(list))
+	for _, e := range list {
+		formatted = append(formatted, FormatAddress(e))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// MessageID returns the Message-ID header of m in the domain of the sender.
+// It is derived from the id of m, such that it can be used to match the
+// message later, and is random for emails without an id.
+func MessageID(m emailprovider.Email) string {
+	from := m.From.Address()
+	domain := from[strings.LastIndex(from, "@")+1:]
+	if domain == "" {
+		domain, _ = os.Hostname()
+	}
+	id := m.ID
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return fmt.Sprintf("<%s@%s>", id, domain)
+}
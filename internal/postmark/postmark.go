@@ -0,0 +1,299 @@
+package postmark
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Defaults of the Postmark API. Every server has a transactional stream named
+// outbound and a broadcast stream named broadcast.
+const (
+	DefaultBaseURL             = "https://api.postmarkapp.com"
+	DefaultTransactionalStream = "outbound"
+	DefaultBroadcastStream     = "broadcast"
+)
+
+// MaxBatchSize is the number of emails Postmark accepts in a batch. Larger
+// batches are split into several requests.
+const MaxBatchSize = 500
+
+// Error codes of Postmark which are not rejections of the email itself.
+// Inactive recipients have bounced or complained before, and Postmark refuses
+// to send to them.
+const (
+	errorInvalidToken          = 10
+	errorInvalidRequest        = 300
+	errorSenderNotFound        = 400
+	errorSenderNotConfirmed    = 401
+	errorNotAllowedToSend      = 405
+	errorInactiveRecipient     = 406
+	errorAccountPending        = 412
+	errorStreamNotFound        = 1235
+	errorStreamNotAllowedToUse = 1236
+)
+
+// PostmarkProvider sends through the email API of Postmark. Transactional
+// emails go through TransactionalStream and broadcasts through
+// BroadcastStream. Fields left empty are read from the environment by Init,
+// falling back to the defaults of Postmark.
+type PostmarkProvider struct {
+	ServerToken         string
+	TransactionalStream string
+	BroadcastStream     string
+	BaseURL             string
+	HTTPClient          *http.Client
+}
+
+func (s *PostmarkProvider) Init() error {
+	if s.ServerToken == "" {
+		s.ServerToken = os.Getenv("POSTMARK_SERVER_TOKEN")
+	}
+	if s.TransactionalStream == "" {
+		s.TransactionalStream = os.Getenv("POSTMARK_TRANSACTIONAL_STREAM")
+	}
+	if s.TransactionalStream == "" {
+		s.TransactionalStream = DefaultTransactionalStream
+	}
+	if s.BroadcastStream == "" {
+		s.BroadcastStream = os.Getenv("POSTMARK_BROADCAST_STREAM")
+	}
+	if s.BroadcastStream == "" {
+		s.BroadcastStream = DefaultBroadcastStream
+	}
+	if s.BaseURL == "" {
+		s.BaseURL = DefaultBaseURL
+	}
+	if s.ServerToken == "" {
+		log.Println("Could not initialize Postmark provider.")
+		return errors.New("Postmark provider requires a server token")
+	}
+	return nil
+}
+
+func (s *PostmarkProvider) Name() string {
+	return "postmark"
+}
+
+// Send returns the MessageID assigned by Postmark as transmission id.
+func (s *PostmarkProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	if s.ServerToken == "" {
+		return "", errors.New("Postmark provider not initialized correctly")
+	}
+	log.Printf("Sending through Postmark: %s\n", m)
+	var response sendResponse
+	if err := s.post(ctx, "/email", s.message(m), &response); err != nil {
+		return "", err
+	}
+	if response.ErrorCode != 0 {
+		return "", s.failure(http.StatusUnprocessableEntity, response.ErrorCode, response.Message)
+	}
+	return response.MessageID, nil
+}
+
+// SendBatch sends the emails through the batch endpoint, in requests of at
+// most MaxBatchSize emails. Postmark accepts or refuses every email of a batch
+// on its own.
+func (s *PostmarkProvider) SendBatch(ctx context.Context, emails []emailprovider.Email) ([]emailprovider.BatchResult, error) {
+	if s.ServerToken == "" {
+		return nil, errors.New("Postmark provider not initialized correctly")
+	}
+	log.Printf("Sending batch of %d emails through Postmark\n", len(emails))
+	results := make([]emailprovider.BatchResult, 0, len(emails))
+	for start := 0; start < len(emails); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(emails) {
+			end = len(emails)
+		}
+		messages := make([]message, 0, end-start)
+		for _, m := range emails[start:end] {
+			messages = append(messages, s.message(m))
+		}
+		var responses []sendResponse
+		err := s.post(ctx, "/email/batch", messages, &responses)
+		if err == nil && len(responses) != len(messages) {
+			err = emailprovider.Fail(s.Name(), emailprovider.FailureTransient, fmt.Errorf("Postmark returned %d results for %d emails", len(responses), len(messages)))
+		}
+		if err != nil {
+			if start == 0 {
+				return nil, err
+			}
+			// The earlier requests were sent, so only the rest failed.
+			for range emails[start:] {
+				results = append(results, emailprovider.BatchResult{Err: err})
+			}
+			return results, nil
+		}
+		for _, response := range responses {
+			result := emailprovider.BatchResult{TransmissionID: response.MessageID}
+			if response.ErrorCode != 0 {
+				result = emailprovider.BatchResult{Err: s.failure(http.StatusUnprocessableEntity, response.ErrorCode, response.Message)}
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// post sends body as json to the path of the API, and decodes a successful
+// response into response. Failed responses are classified as send errors.
+func (s *PostmarkProvider) post(ctx context.Context, path string, body interface{}, response interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(s.BaseURL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", s.ServerToken)
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending through Postmark: %s\n", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+	}
+	defer res.Body.Close()
+	raw, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4*1024*1024))
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Error sending through Postmark: %d %s\n", res.StatusCode, raw)
+		var failed sendResponse
+		json.Unmarshal(raw, &failed)
+		err := s.failure(res.StatusCode, failed.ErrorCode, failed.Message)
+		if err.Kind == emailprovider.FailureRateLimited {
+			err.RetryAfter = emailprovider.ParseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		}
+		return err
+	}
+	if err := json.Unmarshal(raw, response); err != nil {
+		return emailprovider.Fail(s.Name(), emailprovider.FailureTransient, fmt.Errorf("Invalid response from Postmark: %s", err))
+	}
+	return nil
+}
+
+// failure classifies a failure by its status and the error code of Postmark.
+// Problems with the token, the sender signature or the streams only affect
+// Postmark, and are reported as auth failures.
+func (s *PostmarkProvider) failure(status int, code int, message string) *emailprovider.SendError {
+	kind := emailprovider.FailureOfStatus(status)
+	switch code {
+	case errorInvalidToken, errorSenderNotFound, errorSenderNotConfirmed, errorNotAllowedToSend,
+		errorAccountPending, errorStreamNotFound, errorStreamNotAllowedToUse:
+		kind = emailprovider.FailureAuth
+	case errorInactiveRecipient:
+		kind = emailprovider.FailureInvalidRecipient
+	case errorInvalidRequest:
+		kind = emailprovider.FailureRejected
+		if strings.Contains(strings.ToLower(message), "address") {
+			kind = emailprovider.FailureInvalidRecipient
+		}
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return emailprovider.Fail(s.Name(), kind, fmt.Errorf("Postmark responded with status %d, error code %d: %s", status, code, message))
+}
+
+type header struct {
+	Name  string
+	Value string
+}
+
+type attachment struct {
+	Name        string
+	Content     []byte
+	ContentType string
+	ContentID   string `json:",omitempty"`
+}
+
+type message struct {
+	From          string
+	To            string
+	Cc            string `json:",omitempty"`
+	Bcc           string `json:",omitempty"`
+	ReplyTo       string `json:",omitempty"`
+	Subject       string
+	TextBody      string            `json:",omitempty"`
+	HtmlBody      string            `json:",omitempty"`
+	Headers       []header          `json:",omitempty"`
+	Tag           string            `json:",omitempty"`
+	Metadata      map[string]string `json:",omitempty"`
+	Attachments   []attachment      `json:",omitempty"`
+	MessageStream string
+}
+
+type sendResponse struct {
+	MessageID string
+	ErrorCode int
+	Message   string
+}
+
+// message converts m to a message of the API. Postmark takes a single tag, so
+// only the first tag of m is sent, while the message id is sent along with
+// the metadata to be returned in the webhook events.
+func (s *PostmarkProvider) message(m emailprovider.Email) message {
+	msg := message{
+		From:          mimemessage.FormatAddress(m.From),
+		To:            mimemessage.FormatAddresses(m.To),
+		Cc:            mimemessage.FormatAddresses(m.Cc),
+		Bcc:           mimemessage.FormatAddresses(m.Bcc),
+		Subject:       m.Subject.String(),
+		TextBody:      m.Body,
+		MessageStream: s.TransactionalStream,
+	}
+	if m.Stream == emailprovider.StreamBroadcast {
+		msg.MessageStream = s.BroadcastStream
+	}
+	if m.HtmlBody != nil {
+		msg.HtmlBody = m.HtmlBody.String()
+	}
+	if m.ReplyTo != nil {
+		msg.ReplyTo = mimemessage.FormatAddress(m.ReplyTo)
+	}
+	for name, value := range m.Headers {
+		msg.Headers = append(msg.Headers, header{Name: name, Value: value})
+	}
+	if len(m.Tags) > 0 {
+		msg.Tag = m.Tags[0]
+		if len(m.Tags) > 1 {
+			log.Printf("Postmark accepts a single tag, leaving out %v\n", m.Tags[1:])
+		}
+	}
+	if len(m.Metadata) > 0 || m.ID != "" {
+		msg.Metadata = make(map[string]string, len(m.Metadata)+1)
+		for key, value := range m.Metadata {
+			msg.Metadata[key] = value
+		}
+		if m.ID != "" {
+			msg.Metadata[emailprovider.MessageIDMetadataKey] = m.ID
+		}
+	}
+	for _, a := range m.Attachments {
+		converted := attachment{Name: a.Filename(), Content: a.Data(), ContentType: a.ContentType()}
+		if a.Disposition() == emailprovider.DispositionInline {
+			converted.ContentID = "cid:" + a.ContentID()
+		}
+		msg.Attachments = append(msg.Attachments, converted)
+	}
+	return msg
+}
+
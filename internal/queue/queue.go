@@ -0,0 +1,600 @@
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email waiting in the queue. SendAt is the time a scheduled
+// message is held until, and is zero for messages sent right away.
+type Message struct {
+	ID          string              `json:"id"`
+	Email       emailprovider.Email `json:"email"`
+	Attempts    int                 `json:"attempts"`
+	NextAttempt time.Time           `json:"next_attempt"`
+	Enqueued    time.Time           `json:"enqueued"`
+	SendAt      time.Time           `json:"send_at,omitempty"`
+	// KeyID is the API key the message was sent with, which alone may see
+	// and cancel it while it is scheduled.
+	KeyID string `json:"key_id,omitempty"`
+	// Group is shared by the messages enqueued together, such as the
+	// messages of a templated email, which are handed to the strategy at once
+	// when they are due together.
+	Group string `json:"group,omitempty"`
+
+	// index is the position of the message in the due heap, or -1 while it
+	// is being sent.
+	index int
+}
+
+// Errors returned when cancelling a message.
+var (
+	ErrUnknownMessage = errors.New("Unknown message")
+	ErrDispatched     = errors.New("Message is already being sent")
+)
+
+// record is a single entry of the queue journal. An enqueue record carries
+// the message, a retry record the updated attempt counters, and a done record
+// removes the message from the queue.
+type record struct {
+	Op          string    `json:"op"`
+	ID          string    `json:"id"`
+	Message     *Message  `json:"message,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+const (
+	opEnqueue = "enqueue"
+	opRetry   = "retry"
+	opDone    = "done"
+)
+
+// Queue is a durable queue of emails, drained through an
+// emailsender.Strategy by a pool of workers. Every change is written to a
+// journal before it is acknowledged, so accepted emails survive a crash.
+type Queue struct {
+	// MaxAttempts is the number of times a message is handed to the strategy
+	// before it is given up.
+	MaxAttempts int
+	// Backoff returns the delay before the given attempt number is retried.
+	Backoff func(attempt int) time.Duration
+	// Tracker is optional, and records when messages are queued, retried
+	// and given up.
+	Tracker *status.Tracker
+	// Suppressions is optional, and removes the recipients suppressed since
+	// a message was queued before every attempt.
+	Suppressions *suppression.Store
+	// CompactAfter is the number of messages which are sent, given up or
+	// cancelled before the journal is compacted while the queue runs.
+	CompactAfter int
+
+	mu       sync.Mutex
+	journal  *journal.Journal
+	finished int
+	pending  map[string]*Message
+	inFlight map[string]bool
+	due      dueHeap
+	groups   map[string][]*Message
+	wake     chan struct{}
+	stop     chan struct{}
+	workers  sync.WaitGroup
+}
+
+// DefaultBackoff doubles the delay for every attempt, starting at one second
+// and never waiting more than ten minutes.
+func DefaultBackoff(attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < 10*time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > 10*time.Minute {
+		delay = 10 * time.Minute
+	}
+	return delay
+}
+
+// Open opens the queue stored at path, restoring all messages that were
+// pending when the process last stopped.
+func Open(path string) (*Queue, error) {
+	q := &Queue{
+		MaxAttempts:  5,
+		Backoff:      DefaultBackoff,
+		CompactAfter: 1000,
+		pending:      map[string]*Message{},
+		inFlight:     map[string]bool{},
+		groups:       map[string][]*Message{},
+		wake:         make(chan struct{}, 1),
+	}
+	j, err := journal.Open(path, q.replay)
+	if err != nil {
+		return nil, err
+	}
+	q.journal = j
+	if err := q.compact(); err != nil {
+		j.Close()
+		return nil, err
+	}
+	for _, m := range q.pending {
+		q.add(m)
+	}
+	if len(q.pending) > 0 {
+		log.Printf("Restored %d queued messages\n", len(q.pending))
+	}
+	return q, nil
+}
+
+func (q *Queue) replay(raw json.RawMessage) error {
+	var r record
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return err
+	}
+	switch r.Op {
+	case opEnqueue:
+		if r.Message != nil {
+			q.pending[r.ID] = r.Message
+		}
+	case opRetry:
+		if m, ok := q.pending[r.ID]; ok {
+			m.Attempts = r.Attempts
+			m.NextAttempt = r.NextAttempt
+		}
+	case opDone:
+		delete(q.pending, r.ID)
+	}
+	return nil
+}
+
+// compact rewrites the journal to contain only the pending messages.
+func (q *Queue) compact() error {
+	records := make([]interface{}, 0, len(q.pending))
+	for _, m := range q.sorted() {
+		records = append(records, record{Op: opEnqueue, ID: m.ID, Message: m})
+	}
+	if err := q.journal.Rewrite(records); err != nil {
+		return err
+	}
+	q.finished = 0
+	return nil
+}
+
+// add puts a pending message in the queue to be sent when it is due.
+func (q *Queue) add(m *Message) {
+	q.pending[m.ID] = m
+	heap.Push(&q.due, m)
+	if m.Group != "" {
+		q.groups[m.Group] = append(q.groups[m.Group], m)
+	}
+}
+
+// remove deletes a finished message from the queue, and compacts the journal
+// once CompactAfter messages have finished since it was last compacted. The
+// caller holds q.mu, so no record is appended during the rewrite.
+func (q *Queue) remove(id string) {
+	if m, ok := q.pending[id]; ok && m.Group != "" {
+		members := q.groups[m.Group]
+		for i, member := range members {
+			if member == m {
+				members = append(members[:i], members[i+1:]...)
+				break
+			}
+		}
+		if len(members) == 0 {
+			delete(q.groups, m.Group)
+		} else {
+			q.groups[m.Group] = members
+		}
+	}
+	delete(q.pending, id)
+	q.finished++
+	if q.CompactAfter <= 0 || q.finished < q.CompactAfter {
+		return
+	}
+	if err := q.compact(); err != nil {
+		log.Printf("Could not compact the queue journal: %s\n", err)
+	}
+}
+
+// sorted returns the pending messages ordered by when they are due.
+func (q *Queue) sorted() []*Message {
+	messages := make([]*Message, 0, len(q.pending))
+	for _, m := range q.pending {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool { return dueBefore(messages[i], messages[j]) })
+	return messages
+}
+
+// dueBefore orders messages by when they are due, and then by when they
+// were enqueued.
+func dueBefore(a, b *Message) bool {
+	if a.NextAttempt.Equal(b.NextAttempt) {
+		return a.Enqueued.Before(b.Enqueued)
+	}
+	return a.NextAttempt.Before(b.NextAttempt)
+}
+
+// dueHeap holds the pending messages which are not being sent, with the
+// first one due on top. It implements heap.Interface.
+type dueHeap []*Message
+
+func (h dueHeap) Len() int           { return len(h) }
+func (h dueHeap) Less(i, j int) bool { return dueBefore(h[i], h[j]) }
+
+func (h dueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *dueHeap) Push(x interface{}) {
+	m := x.(*Message)
+	m.index = len(*h)
+	*h = append(*h, m)
+}
+
+func (h *dueHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	old[len(old)-1] = nil
+	m.index = -1
+	*h = old[:len(old)-1]
+	return m
+}
+
+// Enqueue durably stores m and returns its message ID. The ID of m is used
+// if it has one, otherwise a new one is assigned.
+func (q *Queue) Enqueue(m emailprovider.Email) (string, error) {
+	return q.EnqueueAt(m, time.Time{}, "")
+}
+
+// EnqueueAt is like Enqueue, but holds the message until sendAt. A zero or
+// past sendAt sends the message right away. keyID is the API key sending the
+// message, if any.
+func (q *Queue) EnqueueAt(m emailprovider.Email, sendAt time.Time, keyID string) (string, error) {
+	ids, err := q.EnqueueGroup([]emailprovider.Email{m}, sendAt, keyID)
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// EnqueueGroup is like EnqueueAt for several emails, which are stored either
+// all or none, and handed to the strategy together as a batch.
+func (q *Queue) EnqueueGroup(emails []emailprovider.Email, sendAt time.Time, keyID string) ([]string, error) {
+	now := time.Now()
+	messages := make([]*Message, len(emails))
+	records := make([]interface{}, len(emails))
+	group := ""
+	for i, m := range emails {
+		if m.ID == "" {
+			m.ID = status.NewID()
+		}
+		if i == 0 && len(emails) > 1 {
+			group = m.ID
+		}
+		message := &Message{ID: m.ID, Email: m, NextAttempt: now, Enqueued: now, KeyID: keyID, Group: group}
+		if sendAt.After(now) {
+			message.NextAttempt = sendAt
+			message.SendAt = sendAt
+		}
+		messages[i] = message
+		records[i] = record{Op: opEnqueue, ID: message.ID, Message: message}
+	}
+	event := status.Event{State: status.Queued}
+	if sendAt.After(now) {
+		event = status.Event{State: status.Scheduled, Detail: fmt.Sprintf("due at %s", sendAt.Format(time.RFC3339))}
+	}
+	q.mu.Lock()
+	if err := q.journal.AppendAll(records); err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		q.add(message)
+		ids[i] = message.ID
+	}
+	q.mu.Unlock()
+	for _, id := range ids {
+		q.record(id, event)
+	}
+	q.signal()
+	return ids, nil
+}
+
+// scheduled reports whether m is still held for its scheduled time, or at
+// least has not been handed to the strategy yet.
+func (q *Queue) scheduled(m *Message) bool {
+	return !m.SendAt.IsZero() && m.Attempts == 0 && !q.inFlight[m.ID]
+}
+
+// Scheduled returns the scheduled message with the given id, unless it has
+// been sent.
+func (q *Queue) Scheduled(id string) (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, ok := q.pending[id]
+	if !ok || !q.scheduled(m) {
+		return Message{}, false
+	}
+	return *m, true
+}
+
+// ListScheduled returns the scheduled messages which have not been sent,
+// ordered by when they are due.
+func (q *Queue) ListScheduled() []Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var messages []Message
+	for _, m := range q.sorted() {
+		if q.scheduled(m) {
+			messages = append(messages, *m)
+		}
+	}
+	return messages
+}
+
+// Owner returns the API key the pending message with the given id was sent
+// with.
+func (q *Queue) Owner(id string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, ok := q.pending[id]
+	if !ok {
+		return "", false
+	}
+	return m.KeyID, true
+}
+
+// Cancel removes a scheduled message before it is sent. Messages which are
+// being sent or have been attempted can no longer be cancelled.
+func (q *Queue) Cancel(id string) error {
+	q.mu.Lock()
+	m, ok := q.pending[id]
+	if !ok || m.SendAt.IsZero() {
+		q.mu.Unlock()
+		return ErrUnknownMessage
+	}
+	if !q.scheduled(m) {
+		q.mu.Unlock()
+		return ErrDispatched
+	}
+	if err := q.journal.Append(record{Op: opDone, ID: id, Error: "cancelled"}); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	heap.Remove(&q.due, m.index)
+	q.remove(id)
+	q.mu.Unlock()
+	q.record(id, status.Event{State: status.Cancelled})
+	return nil
+}
+
+func (q *Queue) record(id string, e status.Event) {
+	if q.Tracker != nil {
+		q.Tracker.Record(id, e)
+	}
+}
+
+// Len returns the number of messages waiting to be sent, including the ones
+// currently being sent.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts a dispatcher and the given number of workers sending queued
+// messages through strategy.
+func (q *Queue) Start(strategy emailsender.Strategy, workers int) error {
+	if workers < 1 {
+		return errors.New("Queue needs at least one worker")
+	}
+	q.mu.Lock()
+	if q.stop != nil {
+		q.mu.Unlock()
+		return errors.New("Queue has already been started")
+	}
+	q.stop = make(chan struct{})
+	q.mu.Unlock()
+	work := make(chan []*Message)
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.work(strategy, work)
+	}
+	q.workers.Add(1)
+	go q.dispatch(work)
+	return nil
+}
+
+// Stop stops the dispatcher and waits for the workers to finish the messages
+// they are sending. Messages left in the queue are sent on the next start.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	stop := q.stop
+	q.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		q.workers.Wait()
+	}
+	q.journal.Close()
+}
+
+// dispatch hands due messages to the workers, sleeping until the next
+// message is due or a new one is enqueued.
+func (q *Queue) dispatch(work chan<- []*Message) {
+	defer q.workers.Done()
+	defer close(work)
+	for {
+		messages, wait := q.next()
+		if messages != nil {
+			select {
+			case work <- messages:
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		case <-q.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// next returns the first due message, along with the other due messages of
+// its group, and marks them in flight, or how long to wait for the next one.
+func (q *Queue) next() ([]*Message, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	wait := time.Minute
+	if len(q.due) == 0 {
+		return nil, wait
+	}
+	if d := time.Until(q.due[0].NextAttempt); d > 0 {
+		if d < wait {
+			wait = d
+		}
+		return nil, wait
+	}
+	m := heap.Pop(&q.due).(*Message)
+	q.inFlight[m.ID] = true
+	messages := []*Message{m}
+	now := time.Now()
+	for _, member := range q.groups[m.Group] {
+		if member.index >= 0 && !member.NextAttempt.After(now) {
+			heap.Remove(&q.due, member.index)
+			q.inFlight[member.ID] = true
+			messages = append(messages, member)
+		}
+	}
+	return messages, 0
+}
+
+func (q *Queue) work(strategy emailsender.Strategy, work <-chan []*Message) {
+	defer q.workers.Done()
+	for messages := range work {
+		var sending []*Message
+		var emails []emailprovider.Email
+		for _, m := range messages {
+			email, err := q.suppress(m)
+			if err != nil {
+				q.finish(m, err)
+				continue
+			}
+			sending = append(sending, m)
+			emails = append(emails, email)
+		}
+		// Messages in flight are finished on stop, so the send is only
+		// bounded by the timeouts of the providers.
+		for i, err := range emailsender.SendBatch(context.Background(), strategy, emails) {
+			q.finish(sending[i], err)
+		}
+	}
+}
+
+// errAllSuppressed fails a message whose to-recipients were all suppressed
+// while it waited in the queue.
+var errAllSuppressed = emailprovider.Fail("", emailprovider.FailureInvalidRecipient, errors.New("All to-recipients are suppressed"))
+
+// suppress returns the email of m without the recipients on the suppression
+// list, and records the ones it dropped.
+func (q *Queue) suppress(m *Message) (emailprovider.Email, error) {
+	email := m.Email
+	if q.Suppressions == nil {
+		return email, nil
+	}
+	var to, cc, bcc []string
+	email.To, to = q.Suppressions.Filter(email.To)
+	email.Cc, cc = q.Suppressions.Filter(email.Cc)
+	email.Bcc, bcc = q.Suppressions.Filter(email.Bcc)
+	suppressed := append(append(to, cc...), bcc...)
+	if len(suppressed) > 0 {
+		q.record(m.ID, status.Event{State: status.Suppressed, Detail: strings.Join(suppressed, ", ")})
+	}
+	if len(email.To) == 0 {
+		return email, errAllSuppressed
+	}
+	return email, nil
+}
+
+// finish records the outcome of an attempt, scheduling a retry with backoff
+// if it failed and attempts remain. The queue is updated first, and the
+// journal and tracker after releasing the lock, since a compaction in between
+// only rewrites what the journal records would say.
+func (q *Queue) finish(m *Message, err error) {
+	defer q.signal()
+	if err == nil {
+		q.done(m, "")
+		return
+	}
+	attempts := m.Attempts + 1
+	if emailprovider.IsPermanent(err) {
+		// Retrying cannot help when the email is refused by the providers.
+		log.Printf("Giving up on message %s, which was refused: %s\n", m.ID, err)
+		q.done(m, err.Error())
+		q.record(m.ID, status.Event{State: status.Failed, Detail: err.Error()})
+		return
+	}
+	if attempts >= q.MaxAttempts {
+		log.Printf("Giving up on message %s after %d attempts: %s\n", m.ID, attempts, err)
+		q.done(m, err.Error())
+		q.record(m.ID, status.Event{State: status.Failed, Detail: err.Error()})
+		return
+	}
+	// Throttled providers are not retried before they asked to be.
+	delay := q.Backoff(attempts)
+	if wait := emailprovider.RetryAfter(err); wait > delay {
+		delay = wait
+	}
+	next := time.Now().Add(delay)
+	log.Printf("Attempt %d of message %s failed, retrying at %s: %s\n", attempts, m.ID, next.Format(time.RFC3339), err)
+	q.mu.Lock()
+	delete(q.inFlight, m.ID)
+	m.Attempts = attempts
+	m.NextAttempt = next
+	heap.Push(&q.due, m)
+	q.mu.Unlock()
+	if err := q.journal.Append(record{Op: opRetry, ID: m.ID, Attempts: attempts, NextAttempt: next}); err != nil {
+		log.Printf("Could not record retry of message %s: %s\n", m.ID, err)
+	}
+	q.record(m.ID, status.Event{State: status.Queued, Detail: fmt.Sprintf("retrying at %s", next.Format(time.RFC3339))})
+}
+
+// done removes a message which was sent or given up, and then records why.
+func (q *Queue) done(m *Message, reason string) {
+	q.mu.Lock()
+	delete(q.inFlight, m.ID)
+	q.remove(m.ID)
+	q.mu.Unlock()
+	if err := q.journal.Append(record{Op: opDone, ID: m.ID, Error: reason}); err != nil {
+		log.Printf("Could not record completion of message %s: %s\n", m.ID, err)
+	}
+}
@@ -0,0 +1,245 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// Usage is the number of messages a client sent in the current day and
+// month, in UTC, along with what remains of its quotas. A remaining count of
+// -1 means the quota is unlimited.
+type Usage struct {
+	Day              int
+	Month            int
+	DailyRemaining   int
+	MonthlyRemaining int
+}
+
+type usage struct {
+	day        string
+	dayCount   int
+	month      string
+	monthCount int
+}
+
+func (u *usage) add(now time.Time, n int) {
+	day, month := now.Format(dayFormat), now.Format(monthFormat)
+	if u.day != day {
+		u.day, u.dayCount = day, 0
+	}
+	if u.month != month {
+		u.month, u.monthCount = month, 0
+	}
+	u.dayCount += n
+	u.monthCount += n
+	// Released messages may have been counted before the day or month
+	// changed.
+	if u.dayCount < 0 {
+		u.dayCount = 0
+	}
+	if u.monthCount < 0 {
+		u.monthCount = 0
+	}
+}
+
+type journalRecord struct {
+	Client string    `json:"client"`
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+}
+
+// Quotas counts the messages sent by every client, backed by a journal on
+// disk, so usage survives restarts. The journal is compacted to the usage of
+// the current month once a day.
+type Quotas struct {
+	// Now returns the current time, and can be replaced in tests.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]*usage
+	// unwritten holds the records counted in usage, which are not yet in
+	// the journal.
+	unwritten []interface{}
+	// compacted is the day the journal was last compacted.
+	compacted string
+
+	// writeMu serializes the writes to the journal, which are made without
+	// holding mu.
+	writeMu sync.Mutex
+	journal *journal.Journal
+}
+
+// OpenQuotas opens the usage stored at path, compacting its journal to the
+// usage of the current month.
+func OpenQuotas(path string) (*Quotas, error) {
+	q := &Quotas{usage: map[string]*usage{}}
+	j, err := journal.Open(path, func(raw json.RawMessage) error {
+		var r journalRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		q.get(r.Client).add(r.Time.UTC(), r.Count)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.journal = j
+	if err := j.Rewrite(q.snapshot(time.Now().UTC())); err != nil {
+		j.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// snapshot drops the usage of earlier months, and returns the records which
+// rebuild the usage left, marking the journal as compacted today.
+func (q *Quotas) snapshot(now time.Time) []interface{} {
+	q.compacted = now.Format(dayFormat)
+	month := now.Format(monthFormat)
+	clients := make([]string, 0, len(q.usage))
+	for client := range q.usage {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	// Keep the usage of today and the rest of the month as two records per
+	// client, dated such that replaying them rebuilds both counters.
+	records := []interface{}{}
+	for _, client := range clients {
+		u := q.usage[client]
+		if u.month != month {
+			delete(q.usage, client)
+			continue
+		}
+		earlier := u.monthCount
+		if u.day == now.Format(dayFormat) {
+			earlier -= u.dayCount
+			if earlier > 0 {
+				records = append(records, journalRecord{Client: client, Time: startOfMonth(now), Count: earlier})
+			}
+			records = append(records, journalRecord{Client: client, Time: now, Count: u.dayCount})
+		} else {
+			records = append(records, journalRecord{Client: client, Time: startOfMonth(now), Count: earlier})
+		}
+	}
+	return records
+}
+
+// flush writes the unwritten records to the journal, or compacts it instead
+// on the first write of a day. Records counted concurrently are written
+// together, and every record counted before flush was called is on disk when
+// it returns.
+func (q *Quotas) flush() {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	q.mu.Lock()
+	now := q.now()
+	compact := now.Format(dayFormat) != q.compacted
+	records := q.unwritten
+	if compact {
+		records = q.snapshot(now)
+	}
+	q.unwritten = nil
+	q.mu.Unlock()
+	var err error
+	switch {
+	case compact:
+		err = q.journal.Rewrite(records)
+	case len(records) > 0:
+		err = q.journal.AppendAll(records)
+	}
+	if err != nil {
+		log.Printf("Could not record usage: %s\n", err)
+	}
+}
+
+func (q *Quotas) now() time.Time {
+	if q.Now != nil {
+		return q.Now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+func (q *Quotas) get(client string) *usage {
+	u, ok := q.usage[client]
+	if !ok {
+		u = &usage{}
+		q.usage[client] = u
+	}
+	return u
+}
+
+// Reserve counts n messages against the daily and monthly quotas of client,
+// where a quota of zero is unlimited. If the messages would exceed a quota
+// nothing is counted, and Reserve returns false along with the time until
+// the quota resets.
+func (q *Quotas) Reserve(client string, n int, daily int, monthly int) (Usage, bool, time.Duration) {
+	q.mu.Lock()
+	usage, ok, wait := q.reserve(client, n, daily, monthly)
+	q.mu.Unlock()
+	if ok {
+		q.flush()
+	}
+	return usage, ok, wait
+}
+
+func (q *Quotas) reserve(client string, n int, daily int, monthly int) (Usage, bool, time.Duration) {
+	now := q.now()
+	u := q.get(client)
+	u.add(now, 0)
+	if daily > 0 && u.dayCount+n > daily {
+		return makeUsage(u, daily, monthly), false, startOfDay(now).AddDate(0, 0, 1).Sub(now)
+	}
+	if monthly > 0 && u.monthCount+n > monthly {
+		return makeUsage(u, daily, monthly), false, startOfMonth(now).AddDate(0, 1, 0).Sub(now)
+	}
+	u.add(now, n)
+	q.unwritten = append(q.unwritten, journalRecord{Client: client, Time: now, Count: n})
+	return makeUsage(u, daily, monthly), true, 0
+}
+
+// Release gives back n messages reserved by client which were not sent, and
+// returns the usage along with the remaining quotas.
+func (q *Quotas) Release(client string, n int, daily int, monthly int) Usage {
+	q.mu.Lock()
+	now := q.now()
+	u := q.get(client)
+	u.add(now, -n)
+	q.unwritten = append(q.unwritten, journalRecord{Client: client, Time: now, Count: -n})
+	usage := makeUsage(u, daily, monthly)
+	q.mu.Unlock()
+	q.flush()
+	return usage
+}
+
+func makeUsage(u *usage, daily int, monthly int) Usage {
+	usage := Usage{Day: u.dayCount, Month: u.monthCount, DailyRemaining: -1, MonthlyRemaining: -1}
+	if daily > 0 {
+		usage.DailyRemaining = daily - u.dayCount
+	}
+	if monthly > 0 {
+		usage.MonthlyRemaining = monthly - u.monthCount
+	}
+	return usage
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (q *Quotas) Close() error {
+	return q.journal.Close()
+}
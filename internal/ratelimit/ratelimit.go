@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of buckets kept before full buckets, which
+// behave like new ones, are dropped.
+const maxIdleBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket per key, such as an API key or an IP address.
+// Every key may do Burst requests at once, refilled at Rate per second.
+type Limiter struct {
+	Rate  float64
+	Burst int
+	// Now returns the current time, and can be replaced in tests.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Allow takes a token from the bucket of key. If the bucket is empty it
+// returns false, along with the time until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.Rate <= 0 {
+		return false, time.Hour
+	}
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops the buckets which have refilled completely.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
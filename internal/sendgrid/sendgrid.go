@@ -1,32 +1,66 @@
 package sendgrid
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/sendgrid/rest"
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type SendGridProvider struct{}
+// SendGridProvider sends through the Send Grid API. Host defaults to the
+// public API.
+type SendGridProvider struct {
+	Host string
+}
 
 func (s SendGridProvider) Init() error {
 	// Send Grid needs no initialization
 	return nil
 }
 
-func (s SendGridProvider) Send(m emailprovider.Email) error {
+func (s SendGridProvider) Name() string {
+	return "sendgrid"
+}
+
+func (s SendGridProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
 	log.Printf("Sending through Send Grid: %s\n", m)
 	message := mail.NewV3Mail()
 	message.SetFrom(mail.NewEmail(m.From.Name(), m.From.Address()))
 	message.Subject = m.Subject.String()
+	if m.ReplyTo != nil {
+		message.SetReplyTo(mail.NewEmail(m.ReplyTo.Name(), m.ReplyTo.Address()))
+	}
+	if len(m.Tags) > 0 {
+		message.AddCategories(m.Tags...)
+	}
 	if len(m.Body) > 0 {
 		message.AddContent(mail.NewContent("text/plain", m.Body))
 	}
 	if m.HtmlBody != nil {
 		message.AddContent(mail.NewContent("text/html", m.HtmlBody.String()))
 	}
+	for _, a := range m.Attachments {
+		attachment := mail.NewAttachment().
+			SetContent(base64.StdEncoding.EncodeToString(a.Data())).
+			SetType(a.ContentType()).
+			SetFilename(a.Filename()).
+			SetDisposition(a.Disposition())
+		if a.ContentID() != "" {
+			attachment.SetContentID(a.ContentID())
+		}
+		message.AddAttachment(attachment)
+	}
 	p := mail.NewPersonalization()
 	for _, to := range m.To {
 		p.AddTos(mail.NewEmail(to.Name(), to.Address()))
@@ -37,16 +71,94 @@ func (s SendGridProvider) Send(m emailprovider.Email) error {
 	for _, bcc := range m.Bcc {
 		p.AddBCCs(mail.NewEmail(bcc.Name(), bcc.Address()))
 	}
+	for name, value := range m.Headers {
+		p.SetHeader(name, value)
+	}
+	for key, value := range m.Metadata {
+		p.SetCustomArg(key, value)
+	}
+	// The message id is returned in the webhook events.
+	if m.ID != "" {
+		p.SetCustomArg(emailprovider.MessageIDMetadataKey, m.ID)
+	}
 	message.AddPersonalizations(p)
-	client := sendgrid.NewSendClient(os.Getenv("SENDGRID_API_KEY"))
-	response, err := client.Send(message)
+	request := s.request(rest.Post, "/v3/mail/send")
+	request.Body = mail.GetRequestBody(message)
+	response, err := api(ctx, request)
 	if err != nil {
 		log.Printf("Error sending through Send Grid: %s\n", err)
-		return err
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
 	}
 	if response.StatusCode != 200 && response.StatusCode != 202 {
 		log.Printf("Error sending through Send Grid: %d %s\n", response.StatusCode, response.Body)
-		return errors.New("Could not deliver email.")
+		return "", sendFailure(response)
 	}
-	return nil
+	// Send Grid reports the id of the message in a header
+	for key, values := range response.Headers {
+		if strings.EqualFold(key, "X-Message-Id") && len(values) > 0 {
+			return values[0], nil
+		}
+	}
+	return "", nil
+}
+
+// sendFailure classifies a failed response to a send. Send Grid reports the
+// fields it refused, so refused recipient addresses are told apart from other
+// refusals of the payload.
+func sendFailure(response *rest.Response) *emailprovider.SendError {
+	kind := emailprovider.FailureOfStatus(response.StatusCode)
+	var body struct {
+		Errors []struct {
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"errors"`
+	}
+	json.Unmarshal([]byte(response.Body), &body)
+	message := fmt.Sprintf("Send Grid responded with status %d", response.StatusCode)
+	for _, e := range body.Errors {
+		if kind == emailprovider.FailureRejected && strings.HasPrefix(e.Field, "personalizations") && strings.HasSuffix(e.Field, ".email") {
+			kind = emailprovider.FailureInvalidRecipient
+		}
+		if e.Message != "" {
+			message += ": " + e.Message
+			break
+		}
+	}
+	failure := emailprovider.Fail("sendgrid", kind, errors.New(message))
+	if kind == emailprovider.FailureRateLimited {
+		failure.RetryAfter = retryAfter(http.Header(response.Headers), time.Now())
+	}
+	return failure
+}
+
+// retryAfter is how long Send Grid asks to wait after throttling, given by
+// Retry-After or otherwise by the Unix time the rate limit resets at.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		return emailprovider.ParseRetryAfter(value, now)
+	}
+	reset, err := strconv.ParseInt(header.Get("X-Ratelimit-Reset"), 10, 64)
+	if err != nil || time.Unix(reset, 0).Before(now) {
+		return 0
+	}
+	return time.Unix(reset, 0).Sub(now)
+}
+
+func (s SendGridProvider) request(method rest.Method, endpoint string) rest.Request {
+	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), endpoint, s.Host)
+	request.Method = method
+	return request
+}
+
+// api makes the request like sendgrid.API, but gives up once ctx is done.
+func api(ctx context.Context, request rest.Request) (*rest.Response, error) {
+	req, err := rest.BuildRequestObject(request)
+	if err != nil {
+		return nil, err
+	}
+	res, err := sendgrid.DefaultClient.MakeRequest(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return rest.BuildResponse(res)
 }
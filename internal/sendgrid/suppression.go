@@ -0,0 +1,108 @@
+package sendgrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"github.com/sendgrid/rest"
+	"strconv"
+	"time"
+)
+
+// pageSize is the number of suppressions requested per page.
+const pageSize = 500
+
+// suppressBatchSize is the number of addresses added per request.
+const suppressBatchSize = 1000
+
+// suppressionTimeout bounds every request to the suppression endpoints.
+const suppressionTimeout = 30 * time.Second
+
+// suppressionLists are the Send Grid suppression endpoints, along with the
+// reason of their entries.
+var suppressionLists = []struct {
+	endpoint string
+	reason   string
+}{
+	{"/v3/suppression/bounces", suppression.ReasonBounce},
+	{"/v3/suppression/spam_reports", suppression.ReasonComplaint},
+	{"/v3/suppression/unsubscribes", suppression.ReasonManual},
+}
+
+// Suppressions returns the bounces, spam reports and global unsubscribes of
+// the account.
+func (s SendGridProvider) Suppressions() ([]suppression.Entry, error) {
+	entries := []suppression.Entry{}
+	for _, list := range suppressionLists {
+		for offset := 0; ; offset += pageSize {
+			request := s.request(rest.Get, list.endpoint)
+			request.QueryParams = map[string]string{
+				"limit":  strconv.Itoa(pageSize),
+				"offset": strconv.Itoa(offset),
+			}
+			response, err := suppressionAPI(request)
+			if err != nil {
+				return nil, err
+			}
+			if response.StatusCode != 200 {
+				return nil, fmt.Errorf("Listing %s failed: %d %s", list.endpoint, response.StatusCode, response.Body)
+			}
+			var page []struct {
+				Email   string `json:"email"`
+				Created int64  `json:"created"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &page); err != nil {
+				return nil, err
+			}
+			for _, e := range page {
+				entry := suppression.Entry{Address: e.Email, Reason: list.reason, Source: s.Name()}
+				if e.Created > 0 {
+					entry.Time = time.Unix(e.Created, 0).UTC()
+				}
+				entries = append(entries, entry)
+			}
+			if len(page) < pageSize {
+				break
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Suppress adds the entries to the global unsubscribes of the account, since
+// bounces and spam reports cannot be created through the API.
+func (s SendGridProvider) Suppress(entries []suppression.Entry) error {
+	for start := 0; start < len(entries); start += suppressBatchSize {
+		end := start + suppressBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		addresses := make([]string, 0, end-start)
+		for _, e := range entries[start:end] {
+			addresses = append(addresses, e.Address)
+		}
+		body, err := json.Marshal(map[string][]string{"recipient_emails": addresses})
+		if err != nil {
+			return err
+		}
+		request := s.request(rest.Post, "/v3/asm/suppressions/global")
+		request.Body = body
+		response, err := suppressionAPI(request)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != 201 && response.StatusCode != 200 {
+			return fmt.Errorf("Adding global unsubscribes failed: %d %s", response.StatusCode, response.Body)
+		}
+	}
+	return nil
+}
+
+// suppressionAPI makes the request through api, giving up after
+// suppressionTimeout.
+func suppressionAPI(request rest.Request) (*rest.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), suppressionTimeout)
+	defer cancel()
+	return api(ctx, request)
+}
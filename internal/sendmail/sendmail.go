@@ -0,0 +1,163 @@
+package sendmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultCommand is the sendmail-compatible binary of most MTAs, such as
+// postfix and exim. -i keeps a line of a single dot from ending the message.
+const DefaultCommand = "/usr/sbin/sendmail -i"
+
+// waitDelay is how long to wait for the output of a command which was killed
+// when the send was cancelled, as children it forked may keep it open.
+const waitDelay = time.Second
+
+// maxStderr is the amount of the error output of the command which is kept.
+const maxStderr = 4 * 1024
+
+// Exit codes of sendmail, as defined by sysexits.h.
+const (
+	exitUsage   = 64
+	exitDataErr = 65
+	exitNoUser  = 67
+	exitNoHost  = 68
+	exitNoPerm  = 77
+	exitConfig  = 78
+)
+
+// ExitError is the error of a command which did not exit successfully, along
+// with what it wrote to stderr.
+type ExitError struct {
+	Command string
+	Code    int
+	Stderr  string
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s exited with status %d", e.Command, e.Code)
+	}
+	return fmt.Sprintf("%s exited with status %d: %s", e.Command, e.Code, e.Stderr)
+}
+
+// SendmailProvider hands emails to a local MTA by piping them to a
+// sendmail-compatible command. The envelope sender is given by -f and the
+// recipients as arguments, including Bcc recipients, which are not part of the
+// message. The command must therefore not be given -t.
+type SendmailProvider struct {
+	// Path and Args are the command, which is read from SENDMAIL_COMMAND by
+	// Init if Path is empty, falling back to DefaultCommand.
+	Path string
+	Args []string
+}
+
+func (s *SendmailProvider) Init() error {
+	if s.Path == "" {
+		command := os.Getenv("SENDMAIL_COMMAND")
+		if command == "" {
+			command = DefaultCommand
+		}
+		fields := strings.Fields(command)
+		s.Path, s.Args = fields[0], fields[1:]
+	}
+	for _, arg := range s.Args {
+		if arg == "-t" {
+			return errors.New("Sendmail command must not read recipients from the headers with -t")
+		}
+	}
+	path, err := exec.LookPath(s.Path)
+	if err != nil {
+		log.Println("Could not initialize sendmail provider.")
+		return fmt.Errorf("Sendmail command not found: %s", err)
+	}
+	s.Path = path
+	return nil
+}
+
+func (s *SendmailProvider) Name() string {
+	return "sendmail"
+}
+
+// Send returns the Message-ID header of tracked emails as transmission id, as
+// the MTA reports its queue id in its logs only.
+func (s *SendmailProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	if s.Path == "" {
+		return "", errors.New("Sendmail provider not initialized correctly")
+	}
+	log.Printf("Sending through %s: %s\n", s.Path, m)
+	message, err := mimemessage.Build(m)
+	if err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	// The recipients follow --, so that no address is taken for an option.
+	args := append(append([]string{}, s.Args...), "-f", m.From.Address(), "--")
+	args = append(args, mimemessage.Recipients(m)...)
+	cmd := exec.CommandContext(ctx, s.Path, args...)
+	cmd.Stdin = bytes.NewReader(message)
+	cmd.WaitDelay = waitDelay
+	var stderr bytes.Buffer
+	cmd.Stderr = &limitedWriter{w: &stderr, n: maxStderr}
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error sending through %s: %s %s\n", s.Path, err, stderr.String())
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", s.failure(err, strings.TrimSpace(stderr.String()))
+	}
+	if m.ID == "" {
+		return "", nil
+	}
+	return mimemessage.MessageID(m), nil
+}
+
+// failure classifies the error of the command by its exit code. Unknown users
+// and hosts are invalid recipients, and malformed messages are rejected.
+// Permission and configuration problems, as well as arguments the command
+// does not accept, only affect the local MTA, like a rejected login would.
+// Other codes, such as EX_TEMPFAIL, are transient.
+func (s *SendmailProvider) failure(err error, stderr string) *emailprovider.SendError {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		// The command could not be started at all
+		return emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+	}
+	code := exit.ExitCode()
+	kind := emailprovider.FailureTransient
+	switch code {
+	case exitNoUser, exitNoHost:
+		kind = emailprovider.FailureInvalidRecipient
+	case exitDataErr:
+		kind = emailprovider.FailureRejected
+	case exitUsage, exitNoPerm, exitConfig:
+		kind = emailprovider.FailureAuth
+	}
+	return emailprovider.Fail(s.Name(), kind, &ExitError{Command: s.Path, Code: code, Stderr: stderr})
+}
+
+// limitedWriter keeps the first n bytes written to it, and discards the rest
+// without failing the command.
+type limitedWriter struct {
+	w *bytes.Buffer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if remaining := l.n - l.w.Len(); remaining > 0 {
+		if len(p) > remaining {
+			l.w.Write(p[:remaining])
+		} else {
+			l.w.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Limits on batches. A batch may carry attachments, but not the largest ones
+// on every message.
+const (
+	MaxBatchSize        = 1000
+	maxBatchRequestSize = 2 * maxRequestSize
+)
+
+// DefaultBatchConcurrency is the number of messages of a batch sent at once,
+// unless set by ServerApp.BatchConcurrency.
+const DefaultBatchConcurrency = 10
+
+// batchResult is the outcome of a single message of a batch, which either
+// holds the response /send would have given, or the problem of the message.
+type batchResult struct {
+	Index int `json:"index"`
+	sendResponse
+	Error *problem `json:"error,omitempty"`
+	// Recipients holds the outcome per recipient of a templated message of
+	// which only some were sent.
+	Recipients []batchResult `json:"recipients,omitempty"`
+}
+
+// batchResponse is the response of /send/batch, with a result per message in
+// the order they were posted.
+type batchResponse struct {
+	Accepted int           `json:"accepted"`
+	Failed   int           `json:"failed"`
+	Results  []batchResult `json:"results"`
+}
+
+// batchHandler accepts an array of messages, which are validated and sent
+// independently of each other. The batch succeeds with the same status as
+// /send if every message was accepted, and otherwise responds with status 207
+// and the problem of each failed message.
+func batchHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeSend, idempotentHandler(a, maxBatchRequestSize, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchRequestSize))
+		defer r.Body.Close()
+		if err != nil {
+			writeProblem(w, http.StatusRequestEntityTooLarge, problemRequestTooLarge, "request too large or unreadable")
+			return
+		}
+		var dtos []Email
+		if json.Unmarshal(body, &dtos) != nil {
+			writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure, expected an array of messages")
+			return
+		}
+		if len(dtos) == 0 || len(dtos) > MaxBatchSize {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, fmt.Sprintf("a batch must have between 1 and %d messages", MaxBatchSize))
+			return
+		}
+		response := batchResponse{Results: make([]batchResult, len(dtos))}
+		prepared := make([]*outgoing, len(dtos))
+		total := 0
+		for i, dto := range dtos {
+			response.Results[i].Index = i
+			m, failure := a.prepare(dto)
+			if failure != nil {
+				response.Results[i].Error = failure
+				continue
+			}
+			prepared[i] = &m
+			total += len(m.emails)
+		}
+		// The quota is reserved for the whole batch, which is rejected if it
+		// does not fit.
+		if total > 0 && !a.reserveQuota(w, r, total) {
+			for _, result := range response.Results {
+				if result.Error != nil {
+					a.rejected(result.Error.Code, 1)
+				} else {
+					a.rejected(problemQuotaExceeded, 1)
+				}
+			}
+			return
+		}
+		a.releaseQuota(w, r, a.deliverBatch(r, prepared, response.Results))
+		response = a.tally(response.Results)
+		code := http.StatusOK
+		if a.Queue != nil {
+			code = http.StatusAccepted
+		}
+		if response.Failed > 0 {
+			code = http.StatusMultiStatus
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+// tally counts the accepted and failed results, and records the failed ones as
+// rejected.
+func (a ServerApp) tally(results []batchResult) batchResponse {
+	response := batchResponse{Results: results}
+	for _, result := range results {
+		if result.Error != nil {
+			a.rejected(result.Error.Code, 1)
+			response.Failed++
+		} else {
+			response.Accepted++
+		}
+	}
+	return response
+}
+
+// deliverBatch delivers the prepared messages, skipping those that are nil,
+// with at most BatchConcurrency messages in flight, and stores the outcome of
+// each in results. It returns the number of emails which were not sent.
+func (a ServerApp) deliverBatch(r *http.Request, prepared []*outgoing, results []batchResult) int {
+	concurrency := a.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	unsent := 0
+	for i, m := range prepared {
+		if m == nil {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, m outgoing) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			response, failed := a.deliver(r.Context(), requestKey(r).ID, m)
+			if failed != nil {
+				results[i].Error = &failed.problem
+				results[i].Recipients = failed.results
+				mu.Lock()
+				unsent += failed.unsent
+				mu.Unlock()
+				return
+			}
+			results[i].sendResponse = response
+		}(i, *m)
+	}
+	wg.Wait()
+	return unsent
+}
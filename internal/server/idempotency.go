@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"github.com/mkj-gram/go_email_service/internal/idempotency"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// responseRecorder passes a response through, while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotentHandler is a higher-order handler for POST requests carrying an
+// Idempotency-Key header. The response to the first request with a key is
+// stored, and replayed to retries with the same body, while reusing the key
+// for another body is rejected. Keys are scoped to the API key of the
+// request, which must have been authenticated. Responses telling the client
+// to retry, such as a rate limit or a failed send, are not stored.
+func idempotentHandler(a ServerApp, limit int64, subHandler handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Idempotency-Key")
+		if a.Idempotency == nil || header == "" || r.Method != "POST" {
+			subHandler(w, r)
+			return
+		}
+		if len(header) > maxIdempotencyKeyLength {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "idempotency key is too long")
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		r.Body.Close()
+		if err != nil {
+			writeProblem(w, http.StatusRequestEntityTooLarge, problemRequestTooLarge, "request too large or unreadable")
+			return
+		}
+		key := requestKey(r).ID + "/" + header
+		stored, err := a.Idempotency.Begin(key, idempotency.Fingerprint(r.Method, r.URL.Path, body))
+		switch err {
+		case idempotency.ErrMismatch:
+			writeProblem(w, http.StatusConflict, problemIdempotencyMismatch, "the idempotency key was used for a different request")
+			return
+		case idempotency.ErrInProgress:
+			writeProblem(w, http.StatusConflict, problemIdempotencyInProgress, "a request with the idempotency key is in progress")
+			return
+		}
+		if stored != nil {
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+		// Abort leaves a finished request alone, and frees the key if the
+		// request is not finished because the handler panicked or failed.
+		defer a.Idempotency.Abort(key)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		subHandler(recorder, r)
+		if recorder.status >= 500 || recorder.status == http.StatusTooManyRequests {
+			return
+		}
+		response := idempotency.Response{
+			Status:      recorder.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}
+		if err := a.Idempotency.Finish(key, response); err != nil {
+			log.Printf("Could not store response of idempotency key %s: %s\n", header, err)
+		}
+	}
+}
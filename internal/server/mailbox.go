@@ -0,0 +1,115 @@
+package server
+
+import (
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"github.com/mkj-gram/go_email_service/internal/maildir"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var mailboxTemplates = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Mailbox</title>
+<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse;width:100%}td,th{border-bottom:1px solid #ddd;padding:.4em;text-align:left}</style>
+</head>
+<body>
+<h1>Mailbox</h1>
+{{if .}}<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .}}<tr><td>{{.Received.Format "2006-01-02 15:04:05"}}</td><td>{{.From}}</td><td>{{.To}}</td><td><a href="/mailbox/{{.ID}}">{{or .Subject "(no subject)"}}</a></td><td>{{.Size}}</td></tr>
+{{end}}</table>{{else}}<p>No messages have been captured.</p>{{end}}
+</body>
+</html>
+`))
+
+// The html of a message is shown in a sandboxed frame, which keeps its scripts
+// and styles away from the page.
+var _ = template.Must(mailboxTemplates.New("message").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Parsed.Get "Subject"}}</title>
+<style>body{font-family:sans-serif;margin:2em}th{text-align:left;padding-right:1em;vertical-align:top}pre{white-space:pre-wrap;background:#f6f6f6;padding:1em}iframe{width:100%;height:30em;border:1px solid #ddd}</style>
+</head>
+<body>
+<p><a href="/mailbox">Mailbox</a> · <a href="/mailbox/{{.ID}}/raw">Raw message</a></p>
+<h1>{{.Parsed.Get "Subject"}}</h1>
+<table>
+{{range .Parsed.Headers}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{if .Parsed.Html}}<h2>Html</h2>
+<iframe sandbox srcdoc="{{.Parsed.Html}}"></iframe>{{end}}
+{{if .Parsed.Text}}<h2>Text</h2>
+<pre>{{.Parsed.Text}}</pre>{{end}}
+{{if .Parsed.Parts}}<h2>Attachments</h2>
+<ul>{{range .Parsed.Parts}}<li>{{or .Filename .ContentID}} ({{.ContentType}}, {{.Size}} bytes)</li>{{end}}</ul>{{end}}
+</body>
+</html>
+`))
+
+// mailboxHandler serves a page for inspecting the emails captured by the
+// Maildir provider. GET /mailbox lists them, GET /mailbox/{id} renders a
+// single message, and GET /mailbox/{id}/raw returns it as written. Browsers
+// are asked for the id and secret of an API key with the read-logs scope.
+func mailboxHandler(a ServerApp) handler {
+	secured := securityHandler(a, apikeys.ScopeReadLogs, func(w http.ResponseWriter, r *http.Request) {
+		if a.Mailbox == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "the mailbox is not enabled")
+			return
+		}
+		if r.Method != "GET" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
+		}
+		path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/mailbox"), "/")
+		if path == "" {
+			messages, err := a.Mailbox.List()
+			if err != nil {
+				log.Printf("Could not list mailbox: %s\n", err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not list the mailbox")
+				return
+			}
+			writeMailboxPage(w, "list", messages)
+			return
+		}
+		id := strings.TrimSuffix(path, "/raw")
+		raw, err := a.Mailbox.Read(id)
+		if err == maildir.ErrNotFound {
+			writeProblem(w, http.StatusNotFound, problemNotFound, "unknown message "+id)
+			return
+		} else if err != nil {
+			log.Printf("Could not read message %s: %s\n", id, err)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "could not read the message")
+			return
+		}
+		if id != path {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Write(raw)
+			return
+		}
+		parsed, err := maildir.Parse(raw)
+		if err != nil {
+			writeProblem(w, http.StatusUnprocessableEntity, problemInvalidRequest, "the message cannot be parsed: "+err.Error())
+			return
+		}
+		writeMailboxPage(w, "message", struct {
+			ID     string
+			Parsed *maildir.Parsed
+		}{id, parsed})
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mailbox"`)
+		}
+		secured(w, r)
+	}
+}
+
+func writeMailboxPage(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := mailboxTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Could not render mailbox page %s: %s\n", name, err)
+	}
+}
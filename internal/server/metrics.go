@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"log"
+	"net/http"
+	"time"
+)
+
+// instrumentHandler is a higher-order handler observing the duration of the
+// requests to the endpoint registered at pattern.
+func instrumentHandler(a ServerApp, pattern string, subHandler handler) handler {
+	if a.Metrics == nil {
+		return subHandler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		subHandler(w, r)
+		a.Metrics.RequestLatency.Observe(time.Since(start).Seconds(), pattern, metricMethod(r.Method))
+	}
+}
+
+// metricMethod returns the method of a request as a label, which is recorded
+// before authentication, so that clients cannot create a series for every
+// method they make up.
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// rejected counts n messages rejected with the problem code, once they were
+// validated or handed on for delivery.
+func (a ServerApp) rejected(code string, n int) {
+	if a.Metrics != nil && n > 0 {
+		a.Metrics.MessagesRejected.Add(float64(n), code)
+	}
+}
+
+// metricsHandler serves the metrics in the text exposition format of
+// Prometheus, which is configured to scrape with a read-logs API key as
+// bearer token.
+func metricsHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeReadLogs, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
+		}
+		if a.Metrics == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "metrics are not enabled")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := a.Metrics.Registry.Write(w); err != nil {
+			log.Printf("Could not write metrics: %s\n", err)
+		}
+	})
+}
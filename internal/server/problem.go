@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"net/http"
+)
+
+// Codes of the problems reported by the API, which clients can rely on.
+const (
+	problemInvalidJSON           = "invalid_json"
+	problemInvalidRequest        = "invalid_request"
+	problemValidation            = "validation_failed"
+	problemRequestTooLarge       = "request_too_large"
+	problemMethodNotAllowed      = "method_not_allowed"
+	problemUnauthorized          = "unauthorized"
+	problemForbidden             = "forbidden"
+	problemNotFound              = "not_found"
+	problemNotEnabled            = "not_enabled"
+	problemRateLimited           = "rate_limited"
+	problemQuotaExceeded         = "quota_exceeded"
+	problemAllSuppressed         = "all_recipients_suppressed"
+	problemSendFailed            = "send_failed"
+	problemRejected              = "rejected_by_provider"
+	problemProvidersThrottled    = "providers_throttled"
+	problemAlreadyDispatched     = "already_dispatched"
+	problemIdempotencyMismatch   = "idempotency_key_reused"
+	problemIdempotencyInProgress = "idempotency_key_in_progress"
+	problemInternal              = "internal_error"
+)
+
+// problem is a problem details body (RFC 7807), which every failure of the
+// API is reported as. Code identifies the problem, and Errors lists every
+// invalid field of a request which failed validation.
+type problem struct {
+	Type   string                           `json:"type"`
+	Title  string                           `json:"title"`
+	Status int                              `json:"status"`
+	Code   string                           `json:"code"`
+	Detail string                           `json:"detail,omitempty"`
+	Errors []*emailprovider.ValidationError `json:"errors,omitempty"`
+}
+
+func makeProblem(status int, code string, detail string) problem {
+	return problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// validationProblem reports the validation errors of a request.
+func validationProblem(errs []*emailprovider.ValidationError) problem {
+	detail := errs[0].Error()
+	if len(errs) > 1 {
+		detail = "The request has invalid fields"
+	}
+	p := makeProblem(http.StatusBadRequest, problemValidation, detail)
+	p.Errors = errs
+	return p
+}
+
+func writeProblemBody(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem responds with a problem of the given status and code.
+func writeProblem(w http.ResponseWriter, status int, code string, detail string) {
+	writeProblemBody(w, makeProblem(status, code, detail))
+}
+
+// writeValidationProblem responds with the validation errors of a request.
+func writeValidationProblem(w http.ResponseWriter, errs []*emailprovider.ValidationError) {
+	writeProblemBody(w, validationProblem(errs))
+}
+
+// notFoundHandler reports requests to unknown paths as a problem.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusNotFound, problemNotFound, "unknown path "+r.URL.Path)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"github.com/mkj-gram/go_email_service/internal/queue"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// scheduledMessage summarizes a scheduled message, leaving out its content.
+type scheduledMessage struct {
+	ID       string    `json:"id"`
+	SendAt   time.Time `json:"send_at"`
+	Enqueued time.Time `json:"enqueued"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+}
+
+func summarizeScheduled(m queue.Message) scheduledMessage {
+	s := scheduledMessage{ID: m.ID, SendAt: m.SendAt, Enqueued: m.Enqueued}
+	if m.Email.From != nil {
+		s.From = m.Email.From.Address()
+	}
+	for _, to := range m.Email.To {
+		s.To = append(s.To, to.Address())
+	}
+	if m.Email.Subject != nil {
+		s.Subject = m.Email.Subject.String()
+	}
+	return s
+}
+
+// scheduledHandler serves the messages waiting for their send_at. GET
+// /scheduled lists them, while GET and DELETE on /scheduled/{id} read and
+// cancel a single message, until it is sent. Keys only see the messages sent
+// with them, except admin keys, which see all messages.
+func scheduledHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeSend, func(w http.ResponseWriter, r *http.Request) {
+		if a.Queue == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "scheduling is not enabled")
+			return
+		}
+		key := requestKey(r)
+		owns := func(keyID string) bool {
+			return keyID == key.ID || key.Has(apikeys.ScopeAdmin)
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/scheduled"), "/")
+		if id == "" {
+			if r.Method != "GET" {
+				writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+				return
+			}
+			list := []scheduledMessage{}
+			for _, m := range a.Queue.ListScheduled() {
+				if owns(m.KeyID) {
+					list = append(list, summarizeScheduled(m))
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		// Messages of other keys are reported as unknown, not to reveal them.
+		owner, ok := a.Queue.Owner(id)
+		if ok && !owns(owner) {
+			writeProblem(w, http.StatusNotFound, problemNotFound, "unknown or already sent message")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			m, ok := a.Queue.Scheduled(id)
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "unknown or already sent message")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(summarizeScheduled(m))
+		case "DELETE":
+			switch err := a.Queue.Cancel(id); err {
+			case nil:
+				a.releaseCancelled(w, r, owner)
+				w.WriteHeader(http.StatusNoContent)
+			case queue.ErrUnknownMessage:
+				writeProblem(w, http.StatusNotFound, problemNotFound, "unknown or already sent message")
+			case queue.ErrDispatched:
+				writeProblem(w, http.StatusConflict, problemAlreadyDispatched, "the message is already being sent")
+			default:
+				log.Printf("Could not cancel message %s: %s\n", id, err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not cancel message")
+			}
+		default:
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+		}
+	})
+}
+
+// releaseCancelled gives back the quota of a cancelled message to the API key
+// it was sent with, whose remaining quotas are reported if it made the
+// request.
+func (a ServerApp) releaseCancelled(w http.ResponseWriter, r *http.Request, keyID string) {
+	if a.Quotas == nil || a.Keys == nil {
+		return
+	}
+	key, ok := a.Keys.Get(keyID)
+	if !ok {
+		return
+	}
+	usage := a.Quotas.Release(key.ID, 1, key.DailyQuota, key.MonthlyQuota)
+	if key.ID == requestKey(r).ID {
+		setQuotaHeaders(w, usage)
+	}
+}
@@ -1,25 +1,85 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
 	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/idempotency"
+	"github.com/mkj-gram/go_email_service/internal/maildir"
+	"github.com/mkj-gram/go_email_service/internal/metrics"
+	"github.com/mkj-gram/go_email_service/internal/queue"
+	"github.com/mkj-gram/go_email_service/internal/ratelimit"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"github.com/mkj-gram/go_email_service/internal/templates"
+	"github.com/mkj-gram/go_email_service/internal/webhooks"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// These should not be constants, but put into a database somewhere.
-const basicAuthenticationCode = "Basic c3RhcmxvcmQ6dWJlcmNoYWxsZW5nZQ=="
-const debugAuthenticationCode = "Basic ZWdvOnViZXJjaGFsbGVuZ2U="
-
 type ServerApp struct {
+	// Keys are the API keys allowed to use the endpoints. Without a key store
+	// every request is rejected.
+	Keys     *apikeys.Store
 	Strategy emailsender.Strategy
 	LogFile  string
+	// Queue is optional. When set, /send stores the email in the queue and
+	// returns immediately, leaving delivery to the queue workers.
+	Queue *queue.Queue
+	// Tracker is optional, and records the lifecycle of every accepted
+	// message, which is served by /messages/{id}.
+	Tracker *status.Tracker
+	// Templates is optional, and stores the templates which can be referenced
+	// by /send and managed through /templates.
+	Templates *templates.Store
+	// KeyLimiter and IPLimiter are optional, and limit the request rate of
+	// every API key and source IP.
+	KeyLimiter *ratelimit.Limiter
+	IPLimiter  *ratelimit.Limiter
+	// TrustProxy takes the source IP from the X-Forwarded-For header, which
+	// must only be done behind a proxy setting it.
+	TrustProxy bool
+	// Quotas is optional, and enforces the daily and monthly quotas of the API
+	// keys.
+	Quotas *ratelimit.Quotas
+	// SparkPostWebhookUser and SparkPostWebhookPassword are the Basic
+	// authentication credentials configured on the Spark Post webhook.
+	SparkPostWebhookUser     string
+	SparkPostWebhookPassword string
+	// SendGridWebhookKey verifies the signatures of the Send Grid signed event
+	// webhook.
+	SendGridWebhookKey *ecdsa.PublicKey
+	// Suppressions is optional. When set, suppressed recipients are removed
+	// from every email, and hard bounces and complaints reported by the
+	// webhooks are suppressed.
+	Suppressions *suppression.Store
+	// Idempotency is optional, and stores the responses of requests to /send
+	// and /send/batch with an Idempotency-Key header, which are replayed to
+	// retries.
+	Idempotency *idempotency.Store
+	// Metrics is optional, and counts the messages and attempts, which are
+	// served by /metrics.
+	Metrics *metrics.Metrics
+	// Mailbox is optional, and serves the emails captured by the Maildir
+	// provider at /mailbox.
+	Mailbox *maildir.MaildirProvider
+	// BatchConcurrency bounds the number of messages of a batch which are
+	// delivered at once, and defaults to DefaultBatchConcurrency.
+	BatchConcurrency int
 }
 
 type handler func(w http.ResponseWriter, r *http.Request)
@@ -28,39 +88,91 @@ type EmailAddress struct {
 	Name    string `json:"name"`
 	Address string `json:"address"`
 }
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id"`
+}
 type Email struct {
-	From    EmailAddress   `json:"from"`
-	To      []EmailAddress `json:"to"`
-	Cc      []EmailAddress `json:"cc"`
-	Bcc     []EmailAddress `json:"bcc"`
-	Subject string         `json:"subject"`
-	Body    string         `json:"body"`
-	Html    string         `json:"html"`
+	From        EmailAddress      `json:"from"`
+	To          []EmailAddress    `json:"to"`
+	Cc          []EmailAddress    `json:"cc"`
+	Bcc         []EmailAddress    `json:"bcc"`
+	Subject     string            `json:"subject"`
+	Body        string            `json:"body"`
+	Html        string            `json:"html"`
+	Attachments []Attachment      `json:"attachments"`
+	ReplyTo     *EmailAddress     `json:"reply_to"`
+	Headers     map[string]string `json:"headers"`
+	Tags        []string          `json:"tags"`
+	Metadata    map[string]string `json:"metadata"`
+	// Stream is the message stream, transactional by default.
+	Stream string `json:"stream"`
+	// Template is the id of a stored template, used instead of the subject,
+	// body and html. The template is rendered with Data, overridden by the
+	// RecipientData of each to-address, and one message is sent per
+	// recipient.
+	Template      string                            `json:"template"`
+	Data          map[string]interface{}            `json:"data"`
+	RecipientData map[string]map[string]interface{} `json:"recipient_data"`
+	// SendAt schedules the email for a later time, which requires the queue.
+	SendAt *time.Time `json:"send_at"`
+}
+
+// MaxScheduleAhead is how far into the future emails can be scheduled.
+const MaxScheduleAhead = 90 * 24 * time.Hour
+
+// maxRequestSize bounds the size of posted emails, leaving room for the base64
+// encoding of the largest allowed attachments.
+const maxRequestSize = emailprovider.MaxTotalAttachmentSize*4/3 + 1024*1024
+
+// validation collects the validation errors of a request.
+type validation []*emailprovider.ValidationError
+
+// add records err, if any, as an error of the field at path.
+func (v *validation) add(path string, err error) {
+	if err != nil {
+		*v = append(*v, emailprovider.AsValidationError(err, emailprovider.CodeInvalidValue).At(path))
+	}
 }
 
 // parseEmails is a utility function for converting posted json emails to
-// emailprovider.Email.
-func parseEmails(emailStrings []EmailAddress, errors []error) []emailprovider.EmailAddress {
+// emailprovider.Email, reporting invalid addresses at field[i].
+func parseEmails(field string, emailStrings []EmailAddress, v *validation) []emailprovider.EmailAddress {
 	emails := make([]emailprovider.EmailAddress, 0, len(emailStrings))
-	for _, e := range emailStrings {
+	for i, e := range emailStrings {
 		email, err := emailprovider.MakeEmailAddress(e.Name, e.Address)
-		if err == nil {
-			emails = append(emails, email)
-		} else {
-			errors = append(errors, err)
+		if err != nil {
+			v.add(fmt.Sprintf("%s[%d]", field, i), err)
+			continue
 		}
+		emails = append(emails, email)
 	}
 	return emails
 }
 
-// joinErrors is a utility function for combining errors into a single string.
-func joinErrors(errors []error) string {
-	var buffer bytes.Buffer
-	for _, e := range errors {
-		buffer.WriteString(e.Error())
-		buffer.WriteString("\n")
+// parseAttachments is a utility function for decoding and validating posted
+// attachments.
+func parseAttachments(attachments []Attachment, v *validation) []emailprovider.Attachment {
+	parsed := make([]emailprovider.Attachment, 0, len(attachments))
+	for i, a := range attachments {
+		path := fmt.Sprintf("attachments[%d]", i)
+		data, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			v.add(path, emailprovider.Invalid("content", emailprovider.CodeInvalidEncoding, "Attachment %s is not valid base64", a.Filename))
+			continue
+		}
+		attachment, err := emailprovider.MakeAttachment(a.Filename, a.ContentType, data, a.Disposition, a.ContentID)
+		if err != nil {
+			v.add(path, err)
+			continue
+		}
+		parsed = append(parsed, attachment)
 	}
-	return fmt.Sprint(buffer)
+	v.add("attachments", emailprovider.CheckAttachmentsSize(parsed))
+	return parsed
 }
 
 // logRequestHandler is a higher-order handler for logging requests.
@@ -71,31 +183,139 @@ func logRequestHandler(subHandler handler) handler {
 	}
 }
 
-// securityHandler is a higher-order handler for rejecting unauthorized
-// requests.
-func securityHandler(code string, subHandler handler) handler {
+// securityHandler is a higher-order handler for rejecting requests without an
+// API key granting scope. The key is sent either as a Bearer token, or as the
+// user and password of Basic authentication.
+func securityHandler(a ServerApp, scope apikeys.Scope, subHandler handler) handler {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Authorization") != code {
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
+		if a.IPLimiter != nil {
+			if ok, wait := a.IPLimiter.Allow(a.sourceIP(r)); !ok {
+				tooManyRequests(w, wait, problemRateLimited, "rate limit exceeded")
+				return
+			}
+		}
+		key, ok := a.authenticate(r)
+		if !ok {
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "authorization failed")
 			return
 		}
-		subHandler(w, r)
+		if !key.Has(scope) {
+			writeProblem(w, http.StatusForbidden, problemForbidden, "api key lacks the "+string(scope)+" scope")
+			return
+		}
+		if a.KeyLimiter != nil {
+			if ok, wait := a.KeyLimiter.Allow(key.ID); !ok {
+				tooManyRequests(w, wait, problemRateLimited, "rate limit exceeded")
+				return
+			}
+		}
+		subHandler(w, r.WithContext(context.WithValue(r.Context(), keyContext{}, key)))
+	}
+}
+
+type keyContext struct{}
+
+// requestKey returns the API key the request was authenticated with.
+func requestKey(r *http.Request) apikeys.Key {
+	key, _ := r.Context().Value(keyContext{}).(apikeys.Key)
+	return key
+}
+
+// sourceIP returns the IP address the request came from.
+func (a ServerApp) sourceIP(r *http.Request) string {
+	if a.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The proxy appends the address it saw to the end of the list.
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests rejects a request with a Retry-After header, in whole
+// seconds rounded up.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, code string, message string) {
+	setRetryAfter(w, wait)
+	writeProblem(w, http.StatusTooManyRequests, code, message)
+}
+
+// setRetryAfter tells the client to wait at least a second before retrying.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// sendFailure is the problem of a failed send, along with how long the
+// client should wait before retrying, if known.
+type sendFailure struct {
+	problem    problem
+	retryAfter time.Duration
+	// unsent is the number of emails which were neither accepted by a
+	// provider nor queued, and whose quota is given back.
+	unsent int
+	// results holds the outcome of every message of a templated email of
+	// which only some were sent.
+	results []batchResult
+}
+
+// sendProblem reports a failed send. Emails refused by the providers must be
+// changed before they are sent again, while throttled providers tell how long
+// to wait.
+func sendProblem(err error) *sendFailure {
+	switch {
+	case emailprovider.IsPermanent(err):
+		return &sendFailure{problem: makeProblem(http.StatusUnprocessableEntity, problemRejected, err.Error())}
+	case emailprovider.KindOf(err) == emailprovider.FailureRateLimited:
+		return &sendFailure{
+			problem:    makeProblem(http.StatusServiceUnavailable, problemProvidersThrottled, err.Error()),
+			retryAfter: emailprovider.RetryAfter(err),
+		}
+	}
+	return &sendFailure{problem: makeProblem(http.StatusServiceUnavailable, problemSendFailed, err.Error())}
+}
+
+func writeSendProblem(w http.ResponseWriter, f sendFailure) {
+	if f.problem.Code == problemProvidersThrottled {
+		setRetryAfter(w, f.retryAfter)
+	}
+	writeProblemBody(w, f.problem)
+}
+
+func (a ServerApp) authenticate(r *http.Request) (apikeys.Key, bool) {
+	if a.Keys == nil {
+		return apikeys.Key{}, false
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		return a.Keys.AuthenticateBasic(id, secret)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return apikeys.Key{}, false
 	}
+	return a.Keys.Authenticate(strings.TrimPrefix(auth, "Bearer "))
 }
 
 // logHandler is the
 func logHandler(a ServerApp) handler {
-	return securityHandler(debugAuthenticationCode, func(w http.ResponseWriter, r *http.Request) {
+	return securityHandler(a, apikeys.ScopeReadLogs, func(w http.ResponseWriter, r *http.Request) {
 		file, err := os.Open("log")
 		if err != nil {
-			http.Error(w, "could not open log", http.StatusInternalServerError)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "could not open log")
 			return
 		}
 		defer file.Close()
 		file.Seek(-1000, 2)
 		logData, err := ioutil.ReadAll(file)
 		if err != nil {
-			http.Error(w, "could not read log", http.StatusInternalServerError)
+			writeProblem(w, http.StatusInternalServerError, problemInternal, "could not read log")
 			return
 		}
 		w.Write(logData)
@@ -107,60 +327,753 @@ func logHandler(a ServerApp) handler {
 // emails. It then decodes the posted JSON, validates it, and calls the strategy
 // for delivery.
 func sendHandler(a ServerApp) handler {
-	return securityHandler(basicAuthenticationCode, func(w http.ResponseWriter, r *http.Request) {
+	return securityHandler(a, apikeys.ScopeSend, idempotentHandler(a, maxRequestSize, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "invalid request method",
-				http.StatusMethodNotAllowed)
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
 			return
 		}
-		body, err := ioutil.ReadAll(r.Body)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
 		defer r.Body.Close()
 		if err != nil {
-			http.Error(w, "whoops", http.StatusInternalServerError)
+			writeProblem(w, http.StatusRequestEntityTooLarge, problemRequestTooLarge, "request too large or unreadable")
 			return
 		}
 		var dto Email
 		if json.Unmarshal(body, &dto) != nil {
-			http.Error(w, "invalid json structure", http.StatusBadRequest)
+			writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+			return
+		}
+		m, failure := a.prepare(dto)
+		if failure != nil {
+			a.rejected(failure.Code, 1)
+			writeProblemBody(w, *failure)
+			return
+		}
+		if !a.reserveQuota(w, r, len(m.emails)) {
+			a.rejected(problemQuotaExceeded, 1)
+			return
+		}
+		response, failed := a.deliver(r.Context(), requestKey(r).ID, m)
+		if failed != nil && failed.results != nil {
+			// Some of the messages were sent, so the client learns which
+			// recipients to retry.
+			a.releaseQuota(w, r, failed.unsent)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMultiStatus)
+			json.NewEncoder(w).Encode(a.tally(failed.results))
+			return
+		}
+		if failed != nil {
+			a.rejected(failed.problem.Code, 1)
+			a.releaseQuota(w, r, failed.unsent)
+			writeSendProblem(w, *failed)
+			return
+		}
+		code := http.StatusOK
+		if a.Queue != nil {
+			code = http.StatusAccepted
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+// outgoing is a validated email of a request, which sends one message per
+// recipient if it is templated.
+type outgoing struct {
+	emails     []emailprovider.Email
+	templated  bool
+	suppressed []string
+	sendAt     time.Time
+}
+
+// prepare validates dto and builds the messages it sends, or returns the
+// problem which prevents sending it.
+func (a ServerApp) prepare(dto Email) (outgoing, *problem) {
+	// Validate all email addresses and subjects
+	var v validation
+	from, err := emailprovider.MakeEmailAddress(dto.From.Name, dto.From.Address)
+	v.add("from", err)
+	var subject emailprovider.Subject
+	if dto.Template == "" {
+		subject, err = emailprovider.MakeSubject(dto.Subject)
+		v.add("subject", err)
+	}
+	to := parseEmails("to", dto.To, &v)
+	if len(dto.To) == 0 {
+		v.add("to", emailprovider.Invalid("", emailprovider.CodeRequired, "Provide at least one recipient in the to-field"))
+	}
+	cc := parseEmails("cc", dto.Cc, &v)
+	bcc := parseEmails("bcc", dto.Bcc, &v)
+	attachments := parseAttachments(dto.Attachments, &v)
+	var replyTo emailprovider.EmailAddress
+	if dto.ReplyTo != nil {
+		replyTo, err = emailprovider.MakeEmailAddress(dto.ReplyTo.Name, dto.ReplyTo.Address)
+		v.add("reply_to", err)
+	}
+	headers, err := emailprovider.MakeHeaders(dto.Headers)
+	v.add("headers", err)
+	tags, err := emailprovider.MakeTags(dto.Tags)
+	v.add("tags", err)
+	metadata, err := emailprovider.MakeMetadata(dto.Metadata)
+	v.add("metadata", err)
+	stream, err := emailprovider.MakeStream(dto.Stream)
+	v.add("stream", err)
+	if dto.Template != "" {
+		v = append(v, a.checkTemplate(dto)...)
+	}
+	var sendAt time.Time
+	if dto.SendAt != nil {
+		sendAt = *dto.SendAt
+		if a.Queue == nil {
+			v.add("send_at", emailprovider.Invalid("", emailprovider.CodeInvalidValue, "Scheduling is not enabled"))
+		} else if time.Until(sendAt) > MaxScheduleAhead {
+			v.add("send_at", emailprovider.Invalid("", emailprovider.CodeInvalidValue, "Emails can be scheduled at most %d days ahead", MaxScheduleAhead/(24*time.Hour)))
+		}
+	}
+	if len(v) > 0 {
+		p := validationProblem(v)
+		return outgoing{}, &p
+	}
+	email := emailprovider.Email{
+		ID:          status.NewID(),
+		From:        from,
+		To:          to,
+		Cc:          cc,
+		Bcc:         bcc,
+		Subject:     subject,
+		Body:        dto.Body,
+		HtmlBody:    emailprovider.MakeHtmlBody(dto.Html),
+		Attachments: attachments,
+		ReplyTo:     replyTo,
+		Headers:     headers,
+		Tags:        tags,
+		Metadata:    metadata,
+		Stream:      stream,
+	}
+	suppressed := a.suppress(&email)
+	if len(email.To) == 0 {
+		p := makeProblem(http.StatusUnprocessableEntity, problemAllSuppressed, "all to-recipients are suppressed: "+strings.Join(suppressed, ", "))
+		return outgoing{}, &p
+	}
+	if dto.Template == "" {
+		return outgoing{emails: []emailprovider.Email{email}, suppressed: suppressed, sendAt: sendAt}, nil
+	}
+	emails, errs := a.renderTemplate(dto, email)
+	if len(errs) > 0 {
+		p := validationProblem(errs)
+		return outgoing{}, &p
+	}
+	return outgoing{emails: emails, templated: true, suppressed: suppressed, sendAt: sendAt}, nil
+}
+
+// checkTemplate validates the use of the template referenced by dto.
+func (a ServerApp) checkTemplate(dto Email) validation {
+	var v validation
+	if a.Templates == nil {
+		v.add("template", emailprovider.Invalid("", emailprovider.CodeUnknownTemplate, "Templates are not enabled"))
+	} else if _, ok := a.Templates.Get(dto.Template); !ok {
+		v.add("template", emailprovider.Invalid("", emailprovider.CodeUnknownTemplate, "Unknown template %s", dto.Template))
+	}
+	for field, value := range map[string]string{"subject": dto.Subject, "body": dto.Body, "html": dto.Html} {
+		if value != "" {
+			v.add(field, emailprovider.Invalid("", emailprovider.CodeConflict, "%s cannot be combined with a template", field))
+		}
+	}
+	if len(dto.Cc) > 0 || len(dto.Bcc) > 0 {
+		v.add("cc", emailprovider.Invalid("", emailprovider.CodeConflict, "Cc and bcc cannot be combined with a template, since one message is sent per recipient"))
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i].Field < v[j].Field })
+	return v
+}
+
+// renderTemplate renders the template referenced by dto once per
+// to-address, returning a copy of email for each recipient. The use of the
+// template must have been checked by checkTemplate.
+func (a ServerApp) renderTemplate(dto Email, email emailprovider.Email) ([]emailprovider.Email, validation) {
+	t, ok := a.Templates.Get(dto.Template)
+	if !ok {
+		// The template was deleted since it was checked.
+		return nil, validation{emailprovider.Invalid("template", emailprovider.CodeUnknownTemplate, "Unknown template %s", dto.Template)}
+	}
+	var v validation
+	emails := make([]emailprovider.Email, 0, len(email.To))
+	for _, to := range email.To {
+		data := make(map[string]interface{}, len(dto.Data))
+		for k, v := range dto.Data {
+			data[k] = v
+		}
+		for k, v := range dto.RecipientData[to.Address()] {
+			data[k] = v
+		}
+		// Recipients are reported by address, since suppressed ones have
+		// been removed from the list.
+		path := "recipient_data." + to.Address()
+		rendered, err := t.Render(data)
+		if err != nil {
+			v.add(path, emailprovider.Invalid("", emailprovider.CodeTemplateRendering, "%s", err))
+			continue
+		}
+		subject, err := emailprovider.MakeSubject(rendered.Subject)
+		if err != nil {
+			v.add(path+".subject", err)
+			continue
+		}
+		m := email
+		if len(emails) > 0 {
+			m.ID = status.NewID()
+		}
+		m.To = []emailprovider.EmailAddress{to}
+		m.Subject = subject
+		m.Body = rendered.Text
+		m.HtmlBody = emailprovider.MakeHtmlBody(rendered.Html)
+		emails = append(emails, m)
+	}
+	return emails, v
+}
+
+// sendResponse is the response of /send. Templated sends respond with the
+// ids of all messages, since there is one per recipient.
+type sendResponse struct {
+	ID         string     `json:"id,omitempty"`
+	IDs        []string   `json:"ids,omitempty"`
+	Suppressed []string   `json:"suppressed,omitempty"`
+	SendAt     *time.Time `json:"send_at,omitempty"`
+}
+
+// deliver enqueues or sends the emails of a validated message, whose quota
+// must have been reserved by the API key with id keyID. The response lists
+// the recipients dropped by the suppression list.
+func (a ServerApp) deliver(ctx context.Context, keyID string, m outgoing) (sendResponse, *sendFailure) {
+	ids := make([]string, 0, len(m.emails))
+	for _, email := range m.emails {
+		a.record(email.ID, status.Event{State: status.Accepted})
+	}
+	if a.Queue != nil {
+		// The messages of a templated email are queued as a group, which the
+		// queue hands to the strategy at once, so that providers with a batch
+		// api send them in one request.
+		queued, err := a.Queue.EnqueueGroup(m.emails, m.sendAt, keyID)
+		if err != nil {
+			log.Printf("Could not enqueue email: %s\n", err)
+			return sendResponse{}, &sendFailure{
+				problem: makeProblem(http.StatusInternalServerError, problemInternal, "could not accept email"),
+				unsent:  len(m.emails),
+			}
+		}
+		ids = queued
+	} else {
+		// The messages of a templated email are handed to the strategy at
+		// once, as well.
+		var failed error
+		results := make([]batchResult, len(m.emails))
+		for i, err := range emailsender.SendBatch(ctx, a.Strategy, m.emails) {
+			results[i] = batchResult{Index: i, sendResponse: sendResponse{ID: m.emails[i].ID}}
+			if err != nil {
+				a.record(m.emails[i].ID, status.Event{State: status.Failed, Detail: err.Error()})
+				results[i].Error = &sendProblem(err).problem
+				if failed == nil {
+					failed = err
+				}
+				continue
+			}
+			ids = append(ids, m.emails[i].ID)
+		}
+		if failed != nil {
+			failure := sendProblem(failed)
+			failure.unsent = len(m.emails) - len(ids)
+			if len(ids) > 0 {
+				failure.results = results
+				if a.Metrics != nil {
+					a.Metrics.MessagesAccepted.Add(float64(len(ids)))
+				}
+			}
+			return sendResponse{}, failure
+		}
+	}
+	if a.Metrics != nil {
+		a.Metrics.MessagesAccepted.Add(float64(len(m.emails)))
+	}
+	response := sendResponse{Suppressed: m.suppressed}
+	if m.sendAt.After(time.Now()) {
+		response.SendAt = &m.sendAt
+	}
+	if m.templated {
+		response.IDs = ids
+	} else {
+		response.ID = ids[0]
+	}
+	return response, nil
+}
+
+// suppress removes the suppressed addresses from the recipients of email,
+// and returns them.
+func (a ServerApp) suppress(email *emailprovider.Email) []string {
+	if a.Suppressions == nil {
+		return nil
+	}
+	var to, cc, bcc []string
+	email.To, to = a.Suppressions.Filter(email.To)
+	email.Cc, cc = a.Suppressions.Filter(email.Cc)
+	email.Bcc, bcc = a.Suppressions.Filter(email.Bcc)
+	suppressed := append(append(to, cc...), bcc...)
+	if len(suppressed) == 0 {
+		return nil
+	}
+	return suppressed
+}
+
+// reserveQuota counts n messages against the quotas of the API key of the
+// request, and reports the remaining quotas in the response headers. If the
+// quota is exhausted, the request is rejected.
+func (a ServerApp) reserveQuota(w http.ResponseWriter, r *http.Request, n int) bool {
+	if a.Quotas == nil {
+		return true
+	}
+	key := requestKey(r)
+	usage, ok, wait := a.Quotas.Reserve(key.ID, n, key.DailyQuota, key.MonthlyQuota)
+	setQuotaHeaders(w, usage)
+	if !ok {
+		tooManyRequests(w, wait, problemQuotaExceeded, "sending quota exceeded")
+	}
+	return ok
+}
+
+// releaseQuota gives back the quota of n messages which were not sent, and
+// updates the remaining quotas in the response headers.
+func (a ServerApp) releaseQuota(w http.ResponseWriter, r *http.Request, n int) {
+	if a.Quotas == nil || n == 0 {
+		return
+	}
+	key := requestKey(r)
+	setQuotaHeaders(w, a.Quotas.Release(key.ID, n, key.DailyQuota, key.MonthlyQuota))
+}
+
+func setQuotaHeaders(w http.ResponseWriter, usage ratelimit.Usage) {
+	if usage.DailyRemaining >= 0 {
+		w.Header().Set("X-Quota-Daily-Remaining", strconv.Itoa(usage.DailyRemaining))
+	}
+	if usage.MonthlyRemaining >= 0 {
+		w.Header().Set("X-Quota-Monthly-Remaining", strconv.Itoa(usage.MonthlyRemaining))
+	}
+}
+
+// templatesHandler manages the stored templates. GET /templates lists them,
+// while GET, PUT and DELETE on /templates/{id} read, store and remove a
+// single template.
+func templatesHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeSend, func(w http.ResponseWriter, r *http.Request) {
+		if a.Templates == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "templates are not enabled")
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/templates"), "/")
+		if id == "" {
+			if r.Method != "GET" {
+				writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a.Templates.List())
+			return
+		}
+		switch r.Method {
+		case "GET":
+			t, ok := a.Templates.Get(id)
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "unknown template")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(t)
+		case "PUT":
+			var t templates.Template
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+			defer r.Body.Close()
+			if err != nil {
+				writeProblem(w, http.StatusRequestEntityTooLarge, problemRequestTooLarge, "request too large or unreadable")
+				return
+			}
+			if json.Unmarshal(body, &t) != nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+				return
+			}
+			t.ID = id
+			if err := t.Validate(); err != nil {
+				writeValidationProblem(w, validation{emailprovider.AsValidationError(err, emailprovider.CodeInvalidValue)})
+				return
+			}
+			if err := a.Templates.Put(t); err != nil {
+				log.Printf("Could not store template %s: %s\n", id, err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not store template")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			ok, err := a.Templates.Delete(id)
+			if err != nil {
+				log.Printf("Could not delete template %s: %s\n", id, err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not delete template")
+				return
+			}
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "unknown template")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+		}
+	})
+}
+
+// messageHandler serves the lifecycle of a single message at
+// /messages/{id}. It is meant for support staff, and therefore requires the
+// same scope as /log.
+func messageHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeReadLogs, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
+		}
+		if a.Tracker == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "message tracking is not enabled")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/messages/")
+		record, ok := a.Tracker.Get(id)
+		if id == "" || !ok {
+			writeProblem(w, http.StatusNotFound, problemNotFound, "unknown message")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(record)
+	})
+}
+
+// providersHandler serves the state of the circuit breakers of the providers,
+// if the strategy has any.
+func providersHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeReadLogs, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
+		}
+		reporter, ok := a.Strategy.(emailsender.BreakerReporter)
+		if !ok {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "strategy does not report provider state")
 			return
 		}
-		// Validate all email addresses and subjects
-		errs := make([]error, 0, len(dto.To)+len(dto.Cc)+len(dto.Bcc)+3)
-		from, err := emailprovider.MakeEmailAddress(dto.From.Name, dto.From.Address)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reporter.Breakers())
+	})
+}
+
+// keysHandler manages the API keys. GET /keys lists them, POST /keys creates
+// a key and returns its token, PATCH /keys/{id} changes the quotas of a key
+// and DELETE /keys/{id} revokes it.
+func keysHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/keys"), "/")
+		switch {
+		case id == "" && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a.Keys.List())
+		case id == "" && r.Method == "POST":
+			var dto struct {
+				Name         string          `json:"name"`
+				Scopes       []apikeys.Scope `json:"scopes"`
+				DailyQuota   int             `json:"daily_quota"`
+				MonthlyQuota int             `json:"monthly_quota"`
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+			defer r.Body.Close()
+			if err != nil || json.Unmarshal(body, &dto) != nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+				return
+			}
+			if dto.DailyQuota < 0 || dto.MonthlyQuota < 0 {
+				writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "Quotas must not be negative")
+				return
+			}
+			key, token, err := a.Keys.Create(dto.Name, dto.Scopes)
+			if err != nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
+				return
+			}
+			if dto.DailyQuota != 0 || dto.MonthlyQuota != 0 {
+				key, _, err = a.Keys.SetQuotas(key.ID, dto.DailyQuota, dto.MonthlyQuota)
+				if err != nil {
+					log.Printf("Could not set quotas of API key %s: %s\n", key.ID, err)
+					writeProblem(w, http.StatusInternalServerError, problemInternal, "could not set quotas")
+					return
+				}
+			}
+			log.Printf("Created API key %s (%s)\n", key.ID, key.Name)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(struct {
+				apikeys.Key
+				Token string `json:"token"`
+			}{key, token})
+		case id != "" && r.Method == "PATCH":
+			// Quotas left out of the body keep their current value.
+			var dto struct {
+				DailyQuota   *int `json:"daily_quota"`
+				MonthlyQuota *int `json:"monthly_quota"`
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+			defer r.Body.Close()
+			if err != nil || json.Unmarshal(body, &dto) != nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+				return
+			}
+			if dto.DailyQuota == nil && dto.MonthlyQuota == nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "provide daily_quota or monthly_quota")
+				return
+			}
+			key, ok, err := a.Keys.UpdateQuotas(id, dto.DailyQuota, dto.MonthlyQuota)
+			if err != nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidRequest, err.Error())
+				return
+			}
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "unknown key")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(key)
+		case id != "" && r.Method == "DELETE":
+			ok, err := a.Keys.Revoke(id)
+			if err != nil {
+				log.Printf("Could not revoke API key %s: %s\n", id, err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not revoke key")
+				return
+			}
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "unknown key")
+				return
+			}
+			log.Printf("Revoked API key %s\n", id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+		}
+	})
+}
+
+// sparkPostWebhookHandler receives the events of the Spark Post webhook,
+// which authenticates with Basic authentication.
+func sparkPostWebhookHandler(a ServerApp) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.SparkPostWebhookUser == "" {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "webhook is not configured")
+			return
+		}
+		if r.Method != "POST" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(a.SparkPostWebhookUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(a.SparkPostWebhookPassword)) != 1 {
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "authorization failed")
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		defer r.Body.Close()
 		if err != nil {
-			errs = append(errs, err)
+			writeProblem(w, http.StatusRequestEntityTooLarge, problemRequestTooLarge, "request too large or unreadable")
+			return
 		}
-		subject, err := emailprovider.MakeSubject(dto.Subject)
+		events, err := webhooks.ParseSparkPost(body)
 		if err != nil {
-			errs = append(errs, err)
+			writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+			return
 		}
-		// If there are no errors, check if at least one to-address has been specified
-		to := parseEmails(dto.To, errs)
-		if len(errs)+len(to) == 0 {
-			errs = append(errs, errors.New("provide at one correct recipient in the to-field"))
+		a.ingest(events)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// sendGridWebhookHandler receives the events of the Send Grid signed event
+// webhook, whose signature is verified against SendGridWebhookKey.
+func sendGridWebhookHandler(a ServerApp) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.SendGridWebhookKey == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "webhook is not configured")
+			return
 		}
-		email := emailprovider.Email{
-			From:     from,
-			To:       to,
-			Cc:       parseEmails(dto.Cc, errs),
-			Bcc:      parseEmails(dto.Bcc, errs),
-			Subject:  subject,
-			Body:     dto.Body,
-			HtmlBody: emailprovider.MakeHtmlBody(dto.Html),
+		if r.Method != "POST" {
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+			return
 		}
-		if len(errs) > 0 {
-			http.Error(w, joinErrors(errs), http.StatusBadRequest)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		defer r.Body.Close()
+		if err != nil {
+			writeProblem(w, http.StatusRequestEntityTooLarge, problemRequestTooLarge, "request too large or unreadable")
 			return
 		}
-		if err := a.Strategy.Send(email); err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		err = webhooks.VerifySendGrid(a.SendGridWebhookKey,
+			r.Header.Get("X-Twilio-Email-Event-Webhook-Signature"),
+			r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp"), body, time.Now())
+		if err != nil {
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, err.Error())
 			return
 		}
+		events, err := webhooks.ParseSendGrid(body)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+			return
+		}
+		a.ingest(events)
 		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ingest attaches provider events to the records of their messages, and
+// suppresses the recipients of permanent failures. Events of unknown
+// messages, such as those sent before tracking was enabled, are skipped.
+func (a ServerApp) ingest(events []webhooks.Event) {
+	for _, e := range events {
+		if e.Permanent && e.Recipient != "" && a.Suppressions != nil {
+			reason := suppression.ReasonBounce
+			if e.State == status.Complained {
+				reason = suppression.ReasonComplaint
+			}
+			err := a.Suppressions.Add(suppression.Entry{Address: e.Recipient, Reason: reason, Source: e.Provider, Time: e.Time})
+			if err != nil {
+				log.Printf("Could not suppress %s: %s\n", e.Recipient, err)
+			}
+		}
+		if a.Tracker == nil {
+			continue
+		}
+		id := e.MessageID
+		if id == "" {
+			id, _ = a.Tracker.LookupTransmission(e.Provider, e.TransmissionID)
+		}
+		if _, ok := a.Tracker.Get(id); id == "" || !ok {
+			log.Printf("Skipping %s event of unknown message from %s\n", e.State, e.Provider)
+			continue
+		}
+		a.Tracker.Record(id, status.Event{
+			State:          e.State,
+			Time:           e.Time,
+			Provider:       e.Provider,
+			TransmissionID: e.TransmissionID,
+			Recipient:      e.Recipient,
+			Detail:         e.Detail,
+		})
+	}
+}
+
+// suppressionsHandler manages the suppression list. GET /suppressions lists
+// all suppressed addresses, while GET, PUT and DELETE on
+// /suppressions/{address} read, add and lift a single suppression.
+func suppressionsHandler(a ServerApp) handler {
+	return securityHandler(a, apikeys.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if a.Suppressions == nil {
+			writeProblem(w, http.StatusNotFound, problemNotEnabled, "suppressions are not enabled")
+			return
+		}
+		address := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/suppressions"), "/")
+		switch {
+		case address == "" && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a.Suppressions.List())
+		case address != "" && r.Method == "GET":
+			entry, ok := a.Suppressions.Get(address)
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "address is not suppressed")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(entry)
+		case address != "" && r.Method == "PUT":
+			var dto struct {
+				Reason string `json:"reason"`
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+			defer r.Body.Close()
+			if err != nil || (len(body) > 0 && json.Unmarshal(body, &dto) != nil) {
+				writeProblem(w, http.StatusBadRequest, problemInvalidJSON, "invalid json structure")
+				return
+			}
+			if _, err := emailprovider.MakeEmailAddress("", address); err != nil {
+				writeValidationProblem(w, validation{emailprovider.AsValidationError(err, emailprovider.CodeInvalidAddress)})
+				return
+			}
+			if dto.Reason == "" {
+				dto.Reason = suppression.ReasonManual
+			}
+			entry := suppression.Entry{Address: address, Reason: dto.Reason, Source: "api:" + requestKey(r).Name}
+			if err := a.Suppressions.Add(entry); err != nil {
+				log.Printf("Could not suppress %s: %s\n", address, err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not suppress address")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case address != "" && r.Method == "DELETE":
+			ok, err := a.Suppressions.Remove(address)
+			if err != nil {
+				log.Printf("Could not lift suppression of %s: %s\n", address, err)
+				writeProblem(w, http.StatusInternalServerError, problemInternal, "could not lift suppression")
+				return
+			}
+			if !ok {
+				writeProblem(w, http.StatusNotFound, problemNotFound, "address is not suppressed")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeProblem(w, http.StatusMethodNotAllowed, problemMethodNotAllowed, "invalid request method")
+		}
 	})
 }
 
+// record adds e to the lifecycle of the message, if tracking is enabled.
+func (a ServerApp) record(id string, e status.Event) {
+	if a.Tracker != nil {
+		a.Tracker.Record(id, e)
+	}
+}
+
+// routes registers all endpoints of the app on mux.
+func (a ServerApp) routes(mux *http.ServeMux) {
+	handle := func(pattern string, h handler) {
+		mux.HandleFunc(pattern, logRequestHandler(instrumentHandler(a, pattern, h)))
+	}
+	mux.HandleFunc("/", logRequestHandler(notFoundHandler))
+	handle("/send", sendHandler(a))
+	handle("/send/batch", batchHandler(a))
+	handle("/scheduled", scheduledHandler(a))
+	handle("/scheduled/", scheduledHandler(a))
+	mux.HandleFunc("/log", logHandler(a))
+	handle("/messages/", messageHandler(a))
+	handle("/providers", providersHandler(a))
+	handle("/metrics", metricsHandler(a))
+	handle("/templates", templatesHandler(a))
+	handle("/templates/", templatesHandler(a))
+	handle("/keys", keysHandler(a))
+	handle("/keys/", keysHandler(a))
+	handle("/suppressions", suppressionsHandler(a))
+	handle("/suppressions/", suppressionsHandler(a))
+	handle("/mailbox", mailboxHandler(a))
+	handle("/mailbox/", mailboxHandler(a))
+	handle("/webhooks/sparkpost", sparkPostWebhookHandler(a))
+	handle("/webhooks/sendgrid", sendGridWebhookHandler(a))
+}
+
+// Handler returns a handler serving the app, independent of the default mux.
+func (a ServerApp) Handler() http.Handler {
+	mux := http.NewServeMux()
+	a.routes(mux)
+	return mux
+}
+
 func (a ServerApp) Serve() {
-	http.HandleFunc("/send", logRequestHandler(sendHandler(a)))
-	http.HandleFunc("/log", logHandler(a))
+	a.routes(http.DefaultServeMux)
 }
@@ -0,0 +1,324 @@
+package ses
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SESProvider sends through the SendEmail action of the Amazon SES v2 API.
+// Fields left empty are read from the environment by Init, and Endpoint
+// defaults to the API of the region.
+type SESProvider struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// ConfigurationSet is the configuration set every email is sent with,
+	// which decides where the events of the email are published.
+	ConfigurationSet string
+	Endpoint         string
+	HTTPClient       *http.Client
+	// Now returns the time requests are signed at, and defaults to time.Now.
+	Now func() time.Time
+}
+
+func (s *SESProvider) Init() error {
+	if s.Region == "" {
+		s.Region = os.Getenv("SES_REGION")
+	}
+	if s.AccessKeyID == "" {
+		s.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s.SecretAccessKey == "" {
+		s.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if s.SessionToken == "" {
+		s.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if s.ConfigurationSet == "" {
+		s.ConfigurationSet = os.Getenv("SES_CONFIGURATION_SET")
+	}
+	if s.Region == "" || s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		log.Println("Could not initialize SES provider.")
+		return errors.New("SES provider requires a region and AWS credentials")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://email." + s.Region + ".amazonaws.com"
+	}
+	return nil
+}
+
+func (s *SESProvider) Name() string {
+	return "ses"
+}
+
+// Send returns the MessageId assigned by SES as transmission id.
+func (s *SESProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	if s.Region == "" || s.Endpoint == "" {
+		return "", errors.New("SES provider not initialized correctly")
+	}
+	log.Printf("Sending through SES: %s\n", m)
+	request, err := s.sendEmailRequest(m)
+	if err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	url := strings.TrimSuffix(s.Endpoint, "/") + "/v2/email/outbound-emails"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.signer().Sign(req, body, s.now())
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending through SES: %s\n", err)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+	}
+	defer res.Body.Close()
+	raw, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Error sending through SES: %d %s\n", res.StatusCode, raw)
+		return "", s.failure(res, raw)
+	}
+	var response struct {
+		MessageId string
+	}
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, fmt.Errorf("Invalid response from SES: %s", err))
+	}
+	return response.MessageId, nil
+}
+
+func (s *SESProvider) signer() Signer {
+	return Signer{
+		AccessKeyID:     s.AccessKeyID,
+		SecretAccessKey: s.SecretAccessKey,
+		SessionToken:    s.SessionToken,
+		Region:          s.Region,
+		Service:         "ses",
+	}
+}
+
+func (s *SESProvider) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// failure classifies a failed response by the error type SES reports in the
+// X-Amzn-ErrorType header, or the body for older responses. Identities that
+// are not verified, and a suspended or paused account, only affect SES and
+// are reported as auth failures.
+func (s *SESProvider) failure(res *http.Response, raw []byte) *emailprovider.SendError {
+	var body struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(raw, &body)
+	errorType := res.Header.Get("X-Amzn-ErrorType")
+	if errorType == "" {
+		errorType = body.Type
+	}
+	// The type may be qualified by a namespace and followed by a url
+	errorType = strings.SplitN(errorType, ":", 2)[0]
+	if i := strings.LastIndex(errorType, "#"); i >= 0 {
+		errorType = errorType[i+1:]
+	}
+	message := strings.ToLower(body.Message)
+	kind := emailprovider.FailureOfStatus(res.StatusCode)
+	switch errorType {
+	case "TooManyRequestsException", "LimitExceededException":
+		kind = emailprovider.FailureRateLimited
+	case "AccountSuspendedException", "SendingPausedException", "MailFromDomainNotVerifiedException", "NotFoundException":
+		kind = emailprovider.FailureAuth
+	case "MessageRejected", "BadRequestException":
+		kind = emailprovider.FailureRejected
+		if strings.Contains(message, "not verified") {
+			kind = emailprovider.FailureAuth
+		} else if strings.Contains(message, "address") || strings.Contains(message, "recipient") {
+			kind = emailprovider.FailureInvalidRecipient
+		}
+	}
+	detail := body.Message
+	if detail == "" {
+		detail = http.StatusText(res.StatusCode)
+	}
+	if errorType != "" {
+		detail = errorType + ": " + detail
+	}
+	failure := emailprovider.Fail(s.Name(), kind, fmt.Errorf("SES responded with status %d: %s", res.StatusCode, detail))
+	if kind == emailprovider.FailureRateLimited {
+		failure.RetryAfter = emailprovider.ParseRetryAfter(res.Header.Get("Retry-After"), s.now())
+	}
+	return failure
+}
+
+type content struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset,omitempty"`
+}
+
+type body struct {
+	Text *content `json:"Text,omitempty"`
+	Html *content `json:"Html,omitempty"`
+}
+
+type simpleMessage struct {
+	Subject content `json:"Subject"`
+	Body    body    `json:"Body"`
+}
+
+type rawMessage struct {
+	// Data is encoded as base64 by encoding/json, as the API expects.
+	Data []byte `json:"Data"`
+}
+
+type emailContent struct {
+	Simple *simpleMessage `json:"Simple,omitempty"`
+	Raw    *rawMessage    `json:"Raw,omitempty"`
+}
+
+type destination struct {
+	ToAddresses  []string `json:"ToAddresses,omitempty"`
+	CcAddresses  []string `json:"CcAddresses,omitempty"`
+	BccAddresses []string `json:"BccAddresses,omitempty"`
+}
+
+type messageTag struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type sendEmailRequest struct {
+	FromEmailAddress     string       `json:"FromEmailAddress"`
+	Destination          destination  `json:"Destination"`
+	ReplyToAddresses     []string     `json:"ReplyToAddresses,omitempty"`
+	Content              emailContent `json:"Content"`
+	EmailTags            []messageTag `json:"EmailTags,omitempty"`
+	ConfigurationSetName string       `json:"ConfigurationSetName,omitempty"`
+}
+
+// sendEmailRequest converts m to the body of SendEmail. Emails with
+// attachments or custom headers are sent as raw MIME, which the simple
+// content cannot carry. The destination is given for raw emails as well, as
+// Bcc recipients are not part of the message.
+func (s *SESProvider) sendEmailRequest(m emailprovider.Email) (sendEmailRequest, error) {
+	request := sendEmailRequest{
+		FromEmailAddress: mimemessage.FormatAddress(m.From),
+		Destination: destination{
+			ToAddresses:  formatAll(m.To),
+			CcAddresses:  formatAll(m.Cc),
+			BccAddresses: formatAll(m.Bcc),
+		},
+		EmailTags:            tags(m),
+		ConfigurationSetName: s.ConfigurationSet,
+	}
+	if m.ReplyTo != nil {
+		request.ReplyToAddresses = []string{mimemessage.FormatAddress(m.ReplyTo)}
+	}
+	if len(m.Attachments) > 0 || len(m.Headers) > 0 {
+		message, err := mimemessage.Build(m)
+		if err != nil {
+			return request, err
+		}
+		request.Content.Raw = &rawMessage{Data: message}
+		return request, nil
+	}
+	simple := &simpleMessage{Subject: content{Data: m.Subject.String(), Charset: "UTF-8"}}
+	if m.Body != "" {
+		simple.Body.Text = &content{Data: m.Body, Charset: "UTF-8"}
+	}
+	if m.HtmlBody != nil && m.HtmlBody.String() != "" {
+		simple.Body.Html = &content{Data: m.HtmlBody.String(), Charset: "UTF-8"}
+	}
+	request.Content.Simple = simple
+	return request, nil
+}
+
+// MaxTagLength is the length SES allows for the names and values of message
+// tags. Longer values are truncated.
+const MaxTagLength = 256
+
+// tags converts the tags and metadata of m to message tags, which are
+// published with the events of the email. SES only allows letters, digits,
+// underscores and dashes in tags, so other characters are replaced. Tags of
+// the email become tags with the value "true". Names must be unique, so a
+// name which is taken once cleaned, such as "a.b" after "a_b", is left out,
+// preferring the message id, then the tags and then the metadata by key.
+func tags(m emailprovider.Email) []messageTag {
+	var result []messageTag
+	seen := map[string]bool{}
+	add := func(name, value string) {
+		name = tagValue(name)
+		if seen[name] {
+			log.Printf("Leaving out SES tag %s, which is already set\n", name)
+			return
+		}
+		seen[name] = true
+		result = append(result, messageTag{Name: name, Value: tagValue(value)})
+	}
+	if m.ID != "" {
+		add(emailprovider.MessageIDMetadataKey, m.ID)
+	}
+	for _, tag := range m.Tags {
+		add(tag, "true")
+	}
+	keys := make([]string, 0, len(m.Metadata))
+	for key := range m.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(key, m.Metadata[key])
+	}
+	return result
+}
+
+// tagValue cleans a tag name or value to the characters and length SES
+// allows.
+func tagValue(s string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+	// Only ASCII is left, so the bytes are characters.
+	if len(cleaned) > MaxTagLength {
+		cleaned = cleaned[:MaxTagLength]
+	}
+	return cleaned
+}
+
+func formatAll(list []emailprovider.EmailAddress) []string {
+	var result []string
+	for _, a := range list {
+		result = append(result, mimemessage.FormatAddress(a))
+	}
+	return result
+}
@@ -0,0 +1,313 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security describes how the connection to the relay is protected.
+type Security string
+
+const (
+	// SecurityNone sends everything in plain text. Only meant for local relays.
+	SecurityNone Security = "none"
+	// SecurityStartTLS connects in plain text and upgrades with STARTTLS,
+	// which is the usual setup on the submission port 587.
+	SecurityStartTLS Security = "starttls"
+	// SecurityTLS uses implicit TLS from the first byte, usually on port 465.
+	SecurityTLS Security = "tls"
+)
+
+// Supported values for SMTPProvider.Auth. The empty string picks the first
+// mechanism advertised by the server in the order plain, login, cram-md5.
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+)
+
+// SMTPProvider delivers emails to a configurable SMTP relay. Fields left empty
+// are read from the environment by Init.
+type SMTPProvider struct {
+	Host      string
+	Port      int
+	Username  string
+	Password  string
+	Security  Security
+	Auth      string
+	LocalName string
+	TLSConfig *tls.Config
+}
+
+func (s *SMTPProvider) Init() error {
+	if s.Host == "" {
+		s.Host = os.Getenv("SMTP_HOST")
+	}
+	if s.Port == 0 {
+		port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			port = 587
+		}
+		s.Port = port
+	}
+	if s.Username == "" {
+		s.Username = os.Getenv("SMTP_USERNAME")
+	}
+	if s.Password == "" {
+		s.Password = os.Getenv("SMTP_PASSWORD")
+	}
+	if s.Security == "" {
+		s.Security = Security(strings.ToLower(os.Getenv("SMTP_SECURITY")))
+	}
+	if s.Security == "" {
+		s.Security = SecurityStartTLS
+	}
+	if s.Auth == "" {
+		s.Auth = strings.ToLower(os.Getenv("SMTP_AUTH"))
+	}
+	if s.Host == "" {
+		log.Println("Could not initialize SMTP provider.")
+		return errors.New("SMTP provider requires a host")
+	}
+	switch s.Security {
+	case SecurityNone, SecurityStartTLS, SecurityTLS:
+	default:
+		return fmt.Errorf("Unknown SMTP security setting: %s", s.Security)
+	}
+	return nil
+}
+
+func (s *SMTPProvider) Name() string {
+	return "smtp"
+}
+
+// Send returns the Message-ID header of tracked emails as transmission id,
+// since SMTP has no standard way of reporting the id assigned by the relay.
+func (s *SMTPProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	if s.Host == "" {
+		return "", errors.New("SMTP provider not initialized correctly")
+	}
+	log.Printf("Sending through SMTP %s: %s\n", s.Host, m)
+	message, err := mimemessage.Build(m)
+	if err != nil {
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureRejected, err)
+	}
+	c, stop, err := s.dial(ctx)
+	if err != nil {
+		log.Printf("Error connecting to SMTP relay: %s\n", err)
+		return "", s.sendError(ctx, err)
+	}
+	defer func() {
+		c.Close()
+		stop()
+	}()
+	if err := s.deliver(c, m.From.Address(), mimemessage.Recipients(m), message); err != nil {
+		log.Printf("Error sending through SMTP: %s\n", err)
+		return "", s.sendError(ctx, err)
+	}
+	// The relay accepted the message at the end of DATA, so failing to say
+	// goodbye must not send it again.
+	if err := c.Quit(); err != nil {
+		log.Printf("Error closing SMTP session after sending: %s\n", err)
+	}
+	if m.ID == "" {
+		return "", nil
+	}
+	return mimemessage.MessageID(m), nil
+}
+
+// dial connects to the relay, secures the connection and authenticates. The
+// connection is bounded by the deadline of ctx, and closed if ctx is
+// cancelled before the deadline. stop releases the watch on ctx once the
+// client is closed.
+func (s *SMTPProvider) dial(ctx context.Context) (c *smtp.Client, stop func() bool, err error) {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	var conn net.Conn
+	if s.Security == SecurityTLS {
+		dialer := &tls.Dialer{Config: s.tlsConfig()}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop = context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	c, err = smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		stop()
+		return nil, nil, err
+	}
+	if err := s.handshake(c); err != nil {
+		c.Close()
+		stop()
+		return nil, nil, err
+	}
+	return c, stop, nil
+}
+
+func (s *SMTPProvider) handshake(c *smtp.Client) error {
+	if s.LocalName != "" {
+		if err := c.Hello(s.LocalName); err != nil {
+			return err
+		}
+	}
+	if s.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP relay does not support STARTTLS")
+		}
+		if err := c.StartTLS(s.tlsConfig()); err != nil {
+			return err
+		}
+	}
+	if s.Username == "" {
+		return nil
+	}
+	auth, err := s.auth(c)
+	if err != nil {
+		return err
+	}
+	if err := c.Auth(auth); err != nil {
+		return s.failure(emailprovider.FailureAuth, err)
+	}
+	return nil
+}
+
+// auth picks the configured authentication mechanism, or the first one
+// supported by the relay if none is configured.
+func (s *SMTPProvider) auth(c *smtp.Client) (smtp.Auth, error) {
+	mechanism := s.Auth
+	if mechanism == "" {
+		ok, advertised := c.Extension("AUTH")
+		if !ok {
+			return nil, errors.New("SMTP relay does not support authentication")
+		}
+		advertised = strings.ToLower(advertised)
+		for _, m := range []string{AuthPlain, AuthLogin, AuthCRAMMD5} {
+			if strings.Contains(" "+advertised+" ", " "+m+" ") {
+				mechanism = m
+				break
+			}
+		}
+	}
+	switch mechanism {
+	case AuthPlain:
+		return smtp.PlainAuth("", s.Username, s.Password, s.Host), nil
+	case AuthLogin:
+		return &loginAuth{username: s.Username, password: s.Password, host: s.Host}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(s.Username, s.Password), nil
+	}
+	return nil, fmt.Errorf("Unsupported SMTP authentication mechanism: %q", mechanism)
+}
+
+func (s *SMTPProvider) deliver(c *smtp.Client, from string, recipients []string, message []byte) error {
+	if err := c.Mail(from); err != nil {
+		return s.failure(emailprovider.FailureRejected, err)
+	}
+	for _, r := range recipients {
+		if err := c.Rcpt(r); err != nil {
+			return s.failure(emailprovider.FailureInvalidRecipient, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return s.failure(emailprovider.FailureRejected, err)
+	}
+	if _, err := w.Write(message); err != nil {
+		w.Close()
+		return s.failure(emailprovider.FailureTransient, err)
+	}
+	if err := w.Close(); err != nil {
+		return s.failure(emailprovider.FailureRejected, err)
+	}
+	return nil
+}
+
+// failure classifies an error of the relay. Permanent replies (5xx) are of
+// the given kind, while temporary replies and network errors are transient.
+func (s *SMTPProvider) failure(kind emailprovider.FailureKind, err error) error {
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || reply.Code < 500 {
+		kind = emailprovider.FailureTransient
+	}
+	return emailprovider.Fail(s.Name(), kind, err)
+}
+
+// sendError returns the error of ctx if it is done, since that is what made
+// the connection fail, and otherwise err as a send error. The connection
+// deadline is the deadline of ctx, and may pass just before ctx reports it.
+func (s *SMTPProvider) sendError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if _, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	var failure *emailprovider.SendError
+	if errors.As(err, &failure) {
+		return err
+	}
+	return emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
+}
+
+func (s *SMTPProvider) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig
+	}
+	return &tls.Config{ServerName: s.Host}
+}
+
+// loginAuth implements the non-standard, but widely deployed, LOGIN
+// mechanism, which net/smtp does not provide.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PLAIN, LOGIN sends the password in the clear, so refuse to do it
+	// over an unencrypted connection to anything but localhost.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
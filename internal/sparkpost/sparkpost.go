@@ -1,25 +1,38 @@
 package sparkpost
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	sp "github.com/SparkPost/gosparkpost"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
 	"log"
+	"net/http"
+	"net/mail"
 	"os"
 	"strings"
+	"time"
 )
 
-type SparkPostProvider struct{}
+// SparkPostProvider sends through the Spark Post API. BaseURL and HTTPClient
+// default to the public API and http.DefaultClient.
+type SparkPostProvider struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
 
 var client *sp.Client
 
 func (s SparkPostProvider) Init() error {
 	cfg := &sp.Config{
-		BaseUrl:    "https://api.sparkpost.com",
+		BaseUrl:    s.BaseURL,
 		ApiKey:     os.Getenv("SPARKPOST_API_KEY"),
 		ApiVersion: 1,
 	}
-	var c sp.Client
+	if cfg.BaseUrl == "" {
+		cfg.BaseUrl = "https://api.sparkpost.com"
+	}
+	c := sp.Client{Client: s.HTTPClient}
 	err := c.Init(cfg)
 	if err == nil {
 		client = &c
@@ -29,9 +42,13 @@ func (s SparkPostProvider) Init() error {
 	return err
 }
 
-func (s SparkPostProvider) Send(m emailprovider.Email) error {
+func (s SparkPostProvider) Name() string {
+	return "sparkpost"
+}
+
+func (s SparkPostProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
 	if client == nil {
-		return errors.New("SparkPost provider not initialized correctly")
+		return "", errors.New("SparkPost provider not initialized correctly")
 	}
 	log.Printf("Sending through Spark Post: %s\n", m)
 	content := sp.Content{
@@ -39,25 +56,43 @@ func (s SparkPostProvider) Send(m emailprovider.Email) error {
 		Subject: m.Subject.String(),
 		Text:    m.Body,
 		HTML:    m.HtmlBody.String(),
+		Headers: map[string]string{},
+	}
+	if m.ReplyTo != nil {
+		replyTo := mail.Address{Name: m.ReplyTo.Name(), Address: m.ReplyTo.Address()}
+		content.ReplyTo = replyTo.String()
+	}
+	for name, value := range m.Headers {
+		content.Headers[name] = value
+	}
+	for _, a := range m.Attachments {
+		data := base64.StdEncoding.EncodeToString(a.Data())
+		if a.Disposition() == emailprovider.DispositionInline {
+			// Spark Post references inline images by their name
+			content.InlineImages = append(content.InlineImages, sp.InlineImage{
+				MIMEType: a.ContentType(), Filename: a.ContentID(), B64Data: data,
+			})
+		} else {
+			content.Attachments = append(content.Attachments, sp.Attachment{
+				MIMEType: a.ContentType(), Filename: a.Filename(), B64Data: data,
+			})
+		}
 	}
 	headerTo := make([]string, 0, len(m.To))
 	for _, e := range m.To {
 		headerTo = append(headerTo, e.Address())
 	}
 	headerToValue := strings.Join(headerTo, ",")
-	tx := &sp.Transmission{
-		Content:    content,
-		Recipients: []sp.Recipient{},
-	}
+	recipients := []sp.Recipient{}
 	for _, e := range m.To {
-		tx.Recipients = append(tx.Recipients.([]sp.Recipient), sp.Recipient{
+		recipients = append(recipients, sp.Recipient{
 			Address: sp.Address{Name: e.Name(), Email: e.Address(), HeaderTo: headerToValue},
 		})
 	}
 	if len(m.Cc) > 0 {
 		ccTo := make([]string, 0, len(m.Cc))
 		for _, e := range m.Cc {
-			tx.Recipients = append(tx.Recipients.([]sp.Recipient), sp.Recipient{
+			recipients = append(recipients, sp.Recipient{
 				Address: sp.Address{Name: e.Name(), Email: e.Address(), HeaderTo: headerToValue},
 			})
 			ccTo = append(ccTo, e.Address())
@@ -65,13 +100,57 @@ func (s SparkPostProvider) Send(m emailprovider.Email) error {
 		content.Headers["cc"] = strings.Join(ccTo, ",")
 	}
 	for _, e := range m.Bcc {
-		tx.Recipients = append(tx.Recipients.([]sp.Recipient), sp.Recipient{
+		recipients = append(recipients, sp.Recipient{
 			Address: sp.Address{Name: e.Name(), Email: e.Address(), HeaderTo: headerToValue},
 		})
 	}
-	_, response, err := client.Send(tx)
-	if err != nil {
+	tx := &sp.Transmission{
+		Content:    content,
+		Recipients: recipients,
+	}
+	// Spark Post has a single campaign per transmission, so the first tag is
+	// used as campaign, while all tags are kept in the metadata. Metadata
+	// values are kept as strings, since some events only accept strings.
+	metadata := map[string]interface{}{}
+	for key, value := range m.Metadata {
+		metadata[key] = value
+	}
+	if len(m.Tags) > 0 {
+		tx.CampaignID = m.Tags[0]
+		metadata["tags"] = strings.Join(m.Tags, ",")
+	}
+	// The message id is returned in the webhook events.
+	if m.ID != "" {
+		metadata[emailprovider.MessageIDMetadataKey] = m.ID
+	}
+	if len(metadata) > 0 {
+		tx.Metadata = metadata
+	}
+	id, response, err := client.SendContext(ctx, tx)
+	if err != nil && response != nil && response.HTTP != nil {
 		log.Printf("Error sending through Spark Post: %d %s %s\n", response.HTTP.StatusCode, string(response.Body), response.Errors)
+		return "", sendFailure(response, err)
+	} else if err != nil {
+		log.Printf("Error sending through Spark Post: %s\n", err)
+		return "", emailprovider.Fail(s.Name(), emailprovider.FailureTransient, err)
 	}
-	return err
+	return id, nil
+}
+
+// sendFailure classifies a failed response to a transmission. Spark Post
+// reports refused recipients in the descriptions of its errors, which tells
+// them apart from other refusals of the payload.
+func sendFailure(response *sp.Response, err error) *emailprovider.SendError {
+	kind := emailprovider.FailureOfStatus(response.HTTP.StatusCode)
+	for _, e := range response.Errors {
+		text := strings.ToLower(e.Message + " " + e.Description)
+		if kind == emailprovider.FailureRejected && strings.Contains(text, "recipient") {
+			kind = emailprovider.FailureInvalidRecipient
+		}
+	}
+	failure := emailprovider.Fail("sparkpost", kind, err)
+	if kind == emailprovider.FailureRateLimited {
+		failure.RetryAfter = emailprovider.ParseRetryAfter(response.HTTP.Header.Get("Retry-After"), time.Now())
+	}
+	return failure
 }
@@ -0,0 +1,84 @@
+package sparkpost
+
+import (
+	"errors"
+	sp "github.com/SparkPost/gosparkpost"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"time"
+)
+
+// upsertBatchSize is the number of entries sent per upsert request.
+const upsertBatchSize = 1000
+
+// sparkPostReason maps the source of a Spark Post suppression to a reason.
+func sparkPostReason(source string) string {
+	switch source {
+	case "Spam Complaint":
+		return suppression.ReasonComplaint
+	case "Bounce Rule", "Compliance":
+		return suppression.ReasonBounce
+	}
+	return suppression.ReasonManual
+}
+
+// Suppressions returns the suppression list of the account, following its
+// pages.
+func (s SparkPostProvider) Suppressions() ([]suppression.Entry, error) {
+	if client == nil {
+		return nil, errors.New("SparkPost provider not initialized correctly")
+	}
+	page := &sp.SuppressionPage{}
+	res, err := client.SuppressionList(page)
+	entries := []suppression.Entry{}
+	for page != nil {
+		if err == nil {
+			err = res.HTTPError()
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page.Results {
+			created, _ := time.Parse(time.RFC3339, e.Created)
+			entries = append(entries, suppression.Entry{
+				Address: e.Recipient,
+				Reason:  sparkPostReason(e.Source),
+				Source:  s.Name(),
+				Time:    created,
+			})
+		}
+		page, res, err = page.Next()
+	}
+	return entries, nil
+}
+
+// Suppress adds the entries to the suppression list of the account. Both
+// transactional and non-transactional email is suppressed.
+func (s SparkPostProvider) Suppress(entries []suppression.Entry) error {
+	if client == nil {
+		return errors.New("SparkPost provider not initialized correctly")
+	}
+	for start := 0; start < len(entries); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := make([]sp.WritableSuppressionEntry, 0, 2*(end-start))
+		for _, e := range entries[start:end] {
+			description := e.Reason + " from " + e.Source
+			for _, kind := range []string{"transactional", "non_transactional"} {
+				batch = append(batch, sp.WritableSuppressionEntry{Recipient: e.Address, Type: kind, Description: description})
+			}
+		}
+		res, err := client.SuppressionUpsert(batch)
+		if err != nil {
+			return err
+		}
+		if err := res.ParseResponse(); err != nil {
+			return err
+		}
+		if err := res.HTTPError(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package status
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is a step in the lifecycle of a message.
+type State string
+
+const (
+	// Accepted means the message was validated by the api.
+	Accepted State = "accepted"
+	// Queued means the message is waiting in the queue to be sent.
+	Queued State = "queued"
+	// Scheduled means the message is held in the queue until it is due.
+	Scheduled State = "scheduled"
+	// Suppressed means recipients on the suppression list were removed from
+	// the message before it was sent.
+	Suppressed State = "suppressed"
+	// Cancelled means the message was cancelled before it was sent.
+	Cancelled State = "cancelled"
+	// Attempted means the message was handed to a provider.
+	Attempted State = "attempted"
+	// ProviderAccepted means a provider accepted the message for delivery.
+	ProviderAccepted State = "accepted-by-provider"
+	// Failed means the message could not be sent through any provider.
+	Failed State = "failed"
+	// Bounced means the receiving server rejected the message.
+	Bounced State = "bounced"
+	// Delivered means the receiving server accepted the message.
+	Delivered State = "delivered"
+	// Deferred means the receiving server temporarily refused the message,
+	// and the provider will retry.
+	Deferred State = "deferred"
+	// Opened means a recipient opened the message.
+	Opened State = "opened"
+	// Clicked means a recipient clicked a link in the message.
+	Clicked State = "clicked"
+	// Unsubscribed means a recipient unsubscribed through the message.
+	Unsubscribed State = "unsubscribed"
+	// Complained means a recipient reported the message as spam.
+	Complained State = "complained"
+)
+
+// precedence orders the states by how far along the lifecycle they are, so
+// that events reported out of order, such as an open before the delivery, do
+// not move the state of a message backwards. States of equal precedence follow
+// each other by time, as when a message is queued again after an attempt.
+var precedence = map[State]int{
+	Accepted:         0,
+	Queued:           1,
+	Scheduled:        1,
+	Suppressed:       1,
+	Attempted:        1,
+	ProviderAccepted: 2,
+	Deferred:         3,
+	Delivered:        4,
+	Bounced:          4,
+	Failed:           4,
+	Cancelled:        4,
+	Opened:           5,
+	Clicked:          6,
+	Unsubscribed:     7,
+	Complained:       7,
+}
+
+// DefaultRetention is how long the lifecycle of a message is kept after its
+// last event, unless set by Tracker.Retention.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Event is a single entry in the lifecycle of a message.
+type Event struct {
+	State          State     `json:"state"`
+	Time           time.Time `json:"time"`
+	Provider       string    `json:"provider,omitempty"`
+	TransmissionID string    `json:"transmission_id,omitempty"`
+	Recipient      string    `json:"recipient,omitempty"`
+	Detail         string    `json:"detail,omitempty"`
+}
+
+// Record is the lifecycle of a single message.
+type Record struct {
+	ID     string  `json:"id"`
+	State  State   `json:"state"`
+	Events []Event `json:"events"`
+
+	stateTime time.Time
+	updated   time.Time
+}
+
+type journalRecord struct {
+	ID    string `json:"id"`
+	Event Event  `json:"event"`
+}
+
+// NewID returns a random message ID.
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Tracker records the lifecycle of messages, as reported by the server, the
+// queue and the send strategies. It implements emailsender.Observer.
+type Tracker struct {
+	// Retention is how long the lifecycle of a message is kept after its last
+	// event, and defaults to DefaultRetention.
+	Retention time.Duration
+	// CompactAfter is the number of events recorded before the journal is
+	// compacted again.
+	CompactAfter int
+	// Now returns the current time, and can be replaced in tests.
+	Now func() time.Time
+
+	mu            sync.Mutex
+	journal       *journal.Journal
+	records       map[string]*Record
+	transmissions map[string]string
+	recorded      int
+}
+
+// Open opens the tracker stored at path. Its journal is compacted by Compact,
+// and after every CompactAfter events.
+func Open(path string) (*Tracker, error) {
+	t := &Tracker{
+		CompactAfter:  10000,
+		records:       map[string]*Record{},
+		transmissions: map[string]string{},
+	}
+	j, err := journal.Open(path, func(raw json.RawMessage) error {
+		var r journalRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		t.add(r.ID, r.Event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.journal = j
+	return t, nil
+}
+
+func (t *Tracker) add(id string, e Event) {
+	r, ok := t.records[id]
+	if !ok {
+		r = &Record{ID: id}
+		t.records[id] = r
+	}
+	r.Events = append(r.Events, e)
+	if len(r.Events) == 1 || precedence[e.State] > precedence[r.State] ||
+		(precedence[e.State] == precedence[r.State] && !e.Time.Before(r.stateTime)) {
+		r.State = e.State
+		r.stateTime = e.Time
+	}
+	if e.Time.After(r.updated) {
+		r.updated = e.Time
+	}
+	if e.TransmissionID != "" {
+		t.transmissions[e.Provider+"/"+e.TransmissionID] = id
+	}
+}
+
+func (t *Tracker) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+func (t *Tracker) retention() time.Duration {
+	if t.Retention > 0 {
+		return t.Retention
+	}
+	return DefaultRetention
+}
+
+// Record appends e to the lifecycle of the message with the given id. Events
+// without a time are stamped with the current time.
+func (t *Tracker) Record(id string, e Event) {
+	if id == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = t.now()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.journal.Append(journalRecord{ID: id, Event: e}); err != nil {
+		log.Printf("Could not record %s of message %s: %s\n", e.State, id, err)
+	}
+	t.add(id, e)
+	t.recorded++
+	if t.CompactAfter > 0 && t.recorded >= t.CompactAfter {
+		if err := t.compact(); err != nil {
+			log.Printf("Could not compact the status journal: %s\n", err)
+		}
+	}
+}
+
+// Compact drops the lifecycles of the messages without events for Retention,
+// and rewrites the journal to the events of the rest.
+func (t *Tracker) Compact() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.compact()
+}
+
+func (t *Tracker) compact() error {
+	cutoff := t.now().Add(-t.retention())
+	for id, r := range t.records {
+		if r.updated.Before(cutoff) {
+			delete(t.records, id)
+		}
+	}
+	for key, id := range t.transmissions {
+		if _, ok := t.records[id]; !ok {
+			delete(t.transmissions, key)
+		}
+	}
+	var records []interface{}
+	for id, r := range t.records {
+		for _, e := range r.Events {
+			records = append(records, journalRecord{ID: id, Event: e})
+		}
+	}
+	if err := t.journal.Rewrite(records); err != nil {
+		return err
+	}
+	t.recorded = 0
+	return nil
+}
+
+// Get returns the lifecycle of the message with the given id.
+func (t *Tracker) Get(id string) (Record, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	events := append([]Event(nil), r.Events...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return Record{ID: r.ID, State: r.State, Events: events}, true
+}
+
+// LookupTransmission returns the id of the message the provider sent with
+// the given transmission id.
+func (t *Tracker) LookupTransmission(provider, transmissionID string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, ok := t.transmissions[provider+"/"+transmissionID]
+	return id, ok
+}
+
+func (t *Tracker) Close() error {
+	return t.journal.Close()
+}
+
+// Attempted records the outcome of a strategy handing a message to a
+// provider.
+func (t *Tracker) Attempted(a emailsender.Attempt) {
+	if a.Err != nil {
+		t.Record(a.Email.ID, Event{State: Attempted, Provider: a.Provider, Detail: a.Err.Error()})
+		return
+	}
+	t.Record(a.Email.ID, Event{State: ProviderAccepted, Provider: a.Provider, TransmissionID: a.TransmissionID})
+}
@@ -0,0 +1,156 @@
+package suppression
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons for suppressing an address.
+const (
+	ReasonBounce    = "bounce"
+	ReasonComplaint = "complaint"
+	ReasonManual    = "manual"
+)
+
+// Entry is a suppressed address, along with why and by whom it was
+// suppressed.
+type Entry struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Source  string    `json:"source"`
+	Time    time.Time `json:"time"`
+}
+
+type journalRecord struct {
+	Address string `json:"address"`
+	Entry   *Entry `json:"entry,omitempty"`
+}
+
+// Store keeps the suppressed addresses in memory, backed by a journal on
+// disk. Addresses are compared case-insensitively.
+type Store struct {
+	mu      sync.Mutex
+	journal *journal.Journal
+	entries map[string]Entry
+}
+
+func normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// Open opens the store at path, compacting its journal to the addresses that
+// are still suppressed.
+func Open(path string) (*Store, error) {
+	s := &Store{entries: map[string]Entry{}}
+	j, err := journal.Open(path, func(raw json.RawMessage) error {
+		var r journalRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		if r.Entry == nil {
+			delete(s.entries, r.Address)
+		} else {
+			s.entries[r.Address] = *r.Entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	records := make([]interface{}, 0, len(s.entries))
+	for _, e := range s.List() {
+		e := e
+		records = append(records, journalRecord{Address: e.Address, Entry: &e})
+	}
+	if err := j.Rewrite(records); err != nil {
+		j.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add suppresses the address of e, replacing any earlier entry. Entries
+// without a time are stamped with the current time.
+func (s *Store) Add(e Entry) error {
+	e.Address = normalize(e.Address)
+	if e.Address == "" {
+		return errors.New("Suppressed address must not be empty")
+	}
+	if e.Reason == "" {
+		return errors.New("Suppression reason must not be empty")
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.Append(journalRecord{Address: e.Address, Entry: &e}); err != nil {
+		return err
+	}
+	s.entries[e.Address] = e
+	return nil
+}
+
+// Get returns the entry of the address, if it is suppressed.
+func (s *Store) Get(address string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[normalize(address)]
+	return e, ok
+}
+
+// Remove lifts the suppression of the address, and reports whether it was
+// suppressed.
+func (s *Store) Remove(address string) (bool, error) {
+	address = normalize(address)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[address]; !ok {
+		return false, nil
+	}
+	if err := s.journal.Append(journalRecord{Address: address}); err != nil {
+		return false, err
+	}
+	delete(s.entries, address)
+	return true, nil
+}
+
+// List returns all suppressed addresses, sorted by address.
+func (s *Store) List() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+// Filter splits the addresses into those that may be emailed, and the
+// suppressed ones.
+func (s *Store) Filter(addresses []emailprovider.EmailAddress) ([]emailprovider.EmailAddress, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make([]emailprovider.EmailAddress, 0, len(addresses))
+	dropped := []string{}
+	for _, a := range addresses {
+		if _, ok := s.entries[normalize(a.Address())]; ok {
+			dropped = append(dropped, a.Address())
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept, dropped
+}
+
+func (s *Store) Close() error {
+	return s.journal.Close()
+}
@@ -0,0 +1,133 @@
+package suppression
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// List is the suppression list kept by a provider. Suppressions returns the
+// entries with the provider as their source, and Suppress adds the entries to
+// the list.
+type List interface {
+	Name() string
+	Suppressions() ([]Entry, error)
+	Suppress(entries []Entry) error
+}
+
+// Syncer reconciles the suppression lists of the providers with the local
+// store. Every sync pulls the list of each provider, adds the union to the
+// store, and pushes the addresses a provider is missing back to it, so that
+// failing over to another provider does not email a suppressed address.
+// Suppressions are only ever added, so lifting one must be done both locally
+// and at the providers.
+type Syncer struct {
+	Store    *Store
+	Lists    []List
+	Interval time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// Sync reconciles the lists once. A provider whose list cannot be pulled is
+// left out of the sync, and the failures are reported in the error.
+func (s *Syncer) Sync() error {
+	failures := []string{}
+	pulled := map[string]map[string]bool{}
+	for _, l := range s.Lists {
+		entries, err := l.Suppressions()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("pulling from %s: %s", l.Name(), err))
+			continue
+		}
+		addresses := map[string]bool{}
+		for _, e := range entries {
+			address := normalize(e.Address)
+			addresses[address] = true
+			if _, ok := s.Store.Get(address); ok {
+				continue
+			}
+			if e.Source == "" {
+				e.Source = l.Name()
+			}
+			if err := s.Store.Add(e); err != nil {
+				failures = append(failures, fmt.Sprintf("storing %s: %s", address, err))
+			}
+		}
+		pulled[l.Name()] = addresses
+	}
+	union := s.Store.List()
+	for _, l := range s.Lists {
+		addresses, ok := pulled[l.Name()]
+		if !ok {
+			continue
+		}
+		missing := []Entry{}
+		for _, e := range union {
+			if !addresses[e.Address] {
+				missing = append(missing, e)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if err := l.Suppress(missing); err != nil {
+			failures = append(failures, fmt.Sprintf("pushing to %s: %s", l.Name(), err))
+			continue
+		}
+		log.Printf("Pushed %d suppressions to %s\n", len(missing), l.Name())
+	}
+	if len(failures) > 0 {
+		return errors.New("Suppression sync failed: " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Start syncs the lists every interval, starting right away.
+func (s *Syncer) Start() error {
+	if s.Interval <= 0 {
+		return errors.New("Suppression sync needs a positive interval")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return errors.New("Suppression sync has already been started")
+	}
+	s.stop = make(chan struct{})
+	s.done.Add(1)
+	go s.run(s.stop)
+	return nil
+}
+
+// Stop stops syncing and waits for a running sync to finish.
+func (s *Syncer) Stop() {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		s.done.Wait()
+	}
+}
+
+func (s *Syncer) run(stop <-chan struct{}) {
+	defer s.done.Done()
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sync(); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/journal"
+	htmltemplate "html/template"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// Template is a named email, whose subject, text and html are rendered with
+// Go templates. The subject and text use text/template, while the html uses
+// html/template, which escapes the substituted data.
+type Template struct {
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	Html    string `json:"html"`
+}
+
+// Rendered is the result of rendering a template with a set of data.
+type Rendered struct {
+	Subject string
+	Text    string
+	Html    string
+}
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Validate checks that the template has a valid id, a subject, at least one
+// body, and that all parts parse.
+func (t Template) Validate() error {
+	if !validID.MatchString(t.ID) {
+		return errors.New("Template id must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if t.Subject == "" {
+		return errors.New("Template subject must not be empty")
+	}
+	if t.Text == "" && t.Html == "" {
+		return errors.New("Template must have a text or an html body")
+	}
+	_, err := t.parse()
+	return err
+}
+
+type parsed struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+func (t Template) parse() (parsed, error) {
+	var p parsed
+	var err error
+	if p.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(t.Subject); err != nil {
+		return p, fmt.Errorf("Invalid template subject: %s", err)
+	}
+	if p.text, err = texttemplate.New("text").Option("missingkey=error").Parse(t.Text); err != nil {
+		return p, fmt.Errorf("Invalid template text: %s", err)
+	}
+	if p.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(t.Html); err != nil {
+		return p, fmt.Errorf("Invalid template html: %s", err)
+	}
+	return p, nil
+}
+
+// Render renders the template with data. Referencing a key missing from data
+// is an error rather than rendering "<no value>" into an email.
+func (t Template) Render(data map[string]interface{}) (Rendered, error) {
+	p, err := t.parse()
+	if err != nil {
+		return Rendered{}, err
+	}
+	var subject, text, html bytes.Buffer
+	if err := p.subject.Execute(&subject, data); err != nil {
+		return Rendered{}, fmt.Errorf("Could not render template subject: %s", err)
+	}
+	if err := p.text.Execute(&text, data); err != nil {
+		return Rendered{}, fmt.Errorf("Could not render template text: %s", err)
+	}
+	if err := p.html.Execute(&html, data); err != nil {
+		return Rendered{}, fmt.Errorf("Could not render template html: %s", err)
+	}
+	// A subject spanning several lines would break the header.
+	return Rendered{
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    text.String(),
+		Html:    html.String(),
+	}, nil
+}
+
+type journalRecord struct {
+	ID       string    `json:"id"`
+	Template *Template `json:"template,omitempty"`
+}
+
+// Store keeps the templates in memory, backed by a journal on disk.
+type Store struct {
+	mu        sync.Mutex
+	journal   *journal.Journal
+	templates map[string]Template
+}
+
+// Open opens the store at path, compacting its journal to only the templates
+// that still exist.
+func Open(path string) (*Store, error) {
+	s := &Store{templates: map[string]Template{}}
+	j, err := journal.Open(path, func(raw json.RawMessage) error {
+		var r journalRecord
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		if r.Template == nil {
+			delete(s.templates, r.ID)
+		} else {
+			s.templates[r.ID] = *r.Template
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	records := make([]interface{}, 0, len(s.templates))
+	for _, t := range s.List() {
+		t := t
+		records = append(records, journalRecord{ID: t.ID, Template: &t})
+	}
+	if err := j.Rewrite(records); err != nil {
+		j.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put validates and stores t, replacing any template with the same id.
+func (s *Store) Put(t Template) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.Append(journalRecord{ID: t.ID, Template: &t}); err != nil {
+		return err
+	}
+	s.templates[t.ID] = t
+	return nil
+}
+
+// Get returns the template with the given id.
+func (s *Store) Get(id string) (Template, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[id]
+	return t, ok
+}
+
+// Delete removes the template with the given id, and reports whether it
+// existed.
+func (s *Store) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[id]; !ok {
+		return false, nil
+	}
+	if err := s.journal.Append(journalRecord{ID: id}); err != nil {
+		return false, err
+	}
+	delete(s.templates, id)
+	return true, nil
+}
+
+// List returns all templates, sorted by id.
+func (s *Store) List() []Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (s *Store) Close() error {
+	return s.journal.Close()
+}
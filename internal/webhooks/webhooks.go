@@ -0,0 +1,223 @@
+package webhooks
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SparkPost/gosparkpost/events"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a provider event normalized to the states of the message
+// lifecycle. MessageID is empty if the provider did not return it, in which
+// case the message is found by its transmission id. Permanent is set for hard
+// bounces and spam complaints, after which the recipient should no longer be
+// emailed.
+type Event struct {
+	Provider       string
+	State          status.State
+	MessageID      string
+	TransmissionID string
+	Recipient      string
+	Time           time.Time
+	Detail         string
+	Permanent      bool
+}
+
+// hardBounceClasses are the Spark Post bounce classes of permanent failures.
+var hardBounceClasses = map[string]bool{
+	"10": true, // Invalid recipient
+	"30": true, // Generic bounce without a recipient
+	"90": true, // Unsubscribed
+}
+
+// messageID returns the message id from the metadata of an event.
+func messageID(metadata interface{}) string {
+	switch m := metadata.(type) {
+	case map[string]interface{}:
+		id, _ := m[emailprovider.MessageIDMetadataKey].(string)
+		return id
+	case map[string]string:
+		return m[emailprovider.MessageIDMetadataKey]
+	}
+	return ""
+}
+
+// ParseSparkPost parses a batch of Spark Post webhook events. Events which
+// do not affect the lifecycle, such as injections, are skipped, as are
+// out-of-band bounces, which carry neither metadata nor a transmission id.
+func ParseSparkPost(body []byte) ([]Event, error) {
+	var batch events.Events
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+	parsed := make([]Event, 0, len(batch))
+	for _, e := range batch {
+		event, ok := normalizeSparkPost(e)
+		if ok {
+			event.Provider = "sparkpost"
+			parsed = append(parsed, event)
+		}
+	}
+	return parsed, nil
+}
+
+func normalizeSparkPost(e events.Event) (Event, bool) {
+	switch e := e.(type) {
+	case *events.Delivery:
+		return Event{State: status.Delivered, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp)}, true
+	case *events.Bounce:
+		return Event{State: status.Bounced, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp), Detail: e.Reason,
+			Permanent: hardBounceClasses[e.BounceClass]}, true
+	case *events.PolicyRejection:
+		return Event{State: status.Bounced, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp), Detail: e.Reason}, true
+	case *events.GenerationFailure:
+		return Event{State: status.Failed, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp), Detail: e.Reason}, true
+	case *events.Delay:
+		return Event{State: status.Deferred, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp), Detail: e.Reason}, true
+	case *events.Open:
+		return Event{State: status.Opened, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp)}, true
+	case *events.Click:
+		return Event{State: status.Clicked, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp), Detail: e.TargetLinkURL}, true
+	case *events.ListUnsubscribe:
+		return Event{State: status.Unsubscribed, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp)}, true
+	case *events.LinkUnsubscribe:
+		return Event{State: status.Unsubscribed, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp)}, true
+	case *events.SpamComplaint:
+		return Event{State: status.Complained, MessageID: messageID(e.Metadata), TransmissionID: e.TransmissionID,
+			Recipient: e.Recipient, Time: time.Time(e.Timestamp), Detail: e.FeedbackType, Permanent: true}, true
+	}
+	return Event{}, false
+}
+
+// sendGridEvent holds the fields of a Send Grid event used by the service.
+// Custom arguments, such as the message id, are top-level fields.
+type sendGridEvent struct {
+	Event     string `json:"event"`
+	Email     string `json:"email"`
+	Timestamp int64  `json:"timestamp"`
+	SGMessage string `json:"sg_message_id"`
+	MessageID string `json:"message_id"`
+	Reason    string `json:"reason"`
+	Response  string `json:"response"`
+	URL       string `json:"url"`
+	Type      string `json:"type"`
+}
+
+var sendGridStates = map[string]status.State{
+	"delivered":         status.Delivered,
+	"bounce":            status.Bounced,
+	"dropped":           status.Bounced,
+	"deferred":          status.Deferred,
+	"open":              status.Opened,
+	"click":             status.Clicked,
+	"unsubscribe":       status.Unsubscribed,
+	"group_unsubscribe": status.Unsubscribed,
+	"spamreport":        status.Complained,
+}
+
+// ParseSendGrid parses a batch of Send Grid webhook events. Events which do
+// not affect the lifecycle, such as processed, are skipped.
+func ParseSendGrid(body []byte) ([]Event, error) {
+	var batch []sendGridEvent
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+	parsed := make([]Event, 0, len(batch))
+	for _, e := range batch {
+		state, ok := sendGridStates[e.Event]
+		if !ok {
+			continue
+		}
+		detail := e.Reason
+		if detail == "" {
+			detail = e.Response
+		}
+		if e.Event == "click" {
+			detail = e.URL
+		}
+		// The event id is the X-Message-Id returned on send, followed by
+		// the id of the internal filter.
+		transmissionID := e.SGMessage
+		if i := strings.IndexByte(transmissionID, '.'); i >= 0 {
+			transmissionID = transmissionID[:i]
+		}
+		parsed = append(parsed, Event{
+			Provider:       "sendgrid",
+			State:          state,
+			MessageID:      e.MessageID,
+			TransmissionID: transmissionID,
+			Recipient:      e.Email,
+			Time:           time.Unix(e.Timestamp, 0).UTC(),
+			Detail:         detail,
+			// Bounces are either permanent, or blocked by the receiver.
+			Permanent: (e.Event == "bounce" && e.Type != "blocked") || e.Event == "spamreport",
+		})
+	}
+	return parsed, nil
+}
+
+// ParsePublicKey parses the base64 encoded verification key of the Send Grid
+// signed event webhook.
+func ParsePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid webhook verification key: %s", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid webhook verification key: %s", err)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Webhook verification key is not an ECDSA key")
+	}
+	return ecdsaKey, nil
+}
+
+// SendGridTolerance is how far the signed timestamp of a Send Grid webhook
+// request may be from the current time, which stops old requests from being
+// replayed.
+const SendGridTolerance = 5 * time.Minute
+
+// VerifySendGrid checks the signature of a Send Grid webhook request, which
+// signs the timestamp header followed by the body, and that the timestamp is
+// within SendGridTolerance of now.
+func VerifySendGrid(key *ecdsa.PublicKey, signature string, timestamp string, body []byte, now time.Time) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || timestamp == "" {
+		return errors.New("Missing or malformed webhook signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Malformed webhook timestamp")
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > SendGridTolerance || age < -SendGridTolerance {
+		return errors.New("Webhook timestamp is outside the tolerance window")
+	}
+	hash := sha256.New()
+	hash.Write([]byte(timestamp))
+	hash.Write(body)
+	if !ecdsa.VerifyASN1(key, hash.Sum(nil), sig) {
+		return errors.New("Invalid webhook signature")
+	}
+	return nil
+}
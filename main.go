@@ -1,17 +1,122 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
 	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/idempotency"
+	"github.com/mkj-gram/go_email_service/internal/maildir"
+	"github.com/mkj-gram/go_email_service/internal/mailgun"
+	"github.com/mkj-gram/go_email_service/internal/metrics"
+	"github.com/mkj-gram/go_email_service/internal/postmark"
+	"github.com/mkj-gram/go_email_service/internal/queue"
+	"github.com/mkj-gram/go_email_service/internal/ratelimit"
 	"github.com/mkj-gram/go_email_service/internal/sendgrid"
+	"github.com/mkj-gram/go_email_service/internal/sendmail"
 	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/ses"
+	"github.com/mkj-gram/go_email_service/internal/smtp"
 	"github.com/mkj-gram/go_email_service/internal/sparkpost"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"github.com/mkj-gram/go_email_service/internal/templates"
+	"github.com/mkj-gram/go_email_service/internal/webhooks"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const LOG_FILE = "log"
+const QUEUE_FILE = "queue"
+const STATUS_FILE = "status"
+const TEMPLATES_FILE = "templates"
+const KEYS_FILE = "keys"
+const QUOTAS_FILE = "quotas"
+const SUPPRESSIONS_FILE = "suppressions"
+const IDEMPOTENCY_FILE = "idempotency"
+const QUEUE_WORKERS = 4
+
+// makeStrategy creates the strategy with the given name. The weighted
+// strategy reads the weights from PROVIDER_WEIGHTS, such as
+// "sparkpost=80,sendgrid=20", and the priority strategy returns to the primary
+// provider after PRIORITY_RECOVERY_WINDOW, which defaults to 5 minutes.
+func makeStrategy(name string, providers []emailprovider.Provider, observer emailsender.Observer) (emailsender.Strategy, error) {
+	switch name {
+	case "", "circuitbreaker":
+		return &emailsender.CircuitBreakerSender{Providers: providers, Observer: observer}, nil
+	case "roundrobin":
+		return &emailsender.RoundRobinSender{Providers: providers, Observer: observer}, nil
+	case "priority":
+		window := 5 * time.Minute
+		if value := os.Getenv("PRIORITY_RECOVERY_WINDOW"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			window = d
+		}
+		return &emailsender.PrioritySender{Providers: providers, Observer: observer, RecoveryWindow: window}, nil
+	case "weighted":
+		weighted, err := emailsender.ParseWeights(os.Getenv("PROVIDER_WEIGHTS"), providers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROVIDER_WEIGHTS: %v", err)
+		}
+		return &emailsender.WeightedSender{Providers: weighted, Observer: observer}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy: %s", name)
+}
+
+// withTimeouts bounds the sends of every provider by the duration in
+// <NAME>_TIMEOUT, such as SPARKPOST_TIMEOUT, falling back to PROVIDER_TIMEOUT
+// and then 30 seconds.
+func withTimeouts(providers []emailprovider.Provider) ([]emailprovider.Provider, error) {
+	fallback := 30 * time.Second
+	if value := os.Getenv("PROVIDER_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROVIDER_TIMEOUT: %s", value)
+		}
+		fallback = d
+	}
+	bounded := make([]emailprovider.Provider, 0, len(providers))
+	for _, p := range providers {
+		timeout := fallback
+		env := strings.ToUpper(p.Name()) + "_TIMEOUT"
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %s: %s", env, value)
+			}
+			timeout = d
+		}
+		bounded = append(bounded, emailprovider.WithTimeout(p, timeout))
+	}
+	return bounded, nil
+}
+
+// makeLimiter creates a limiter allowing the number of requests per second
+// given by the environment variable, or fallback if it is unset. Bursts of
+// twice the rate are allowed.
+func makeLimiter(env string, fallback float64) (*ratelimit.Limiter, error) {
+	rate := fallback
+	if value := os.Getenv(env); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", env, value)
+		}
+		rate = parsed
+	}
+	burst := int(2 * rate)
+	if burst < 1 {
+		burst = 1
+	}
+	return &ratelimit.Limiter{Rate: rate, Burst: burst}, nil
+}
 
 func main() {
 	// Set up log to print to a file
@@ -26,17 +131,192 @@ func main() {
 		sparkpost.SparkPostProvider{},
 		sendgrid.SendGridProvider{},
 	}
+	if os.Getenv("SMTP_HOST") != "" {
+		providers = append(providers, &smtp.SMTPProvider{})
+	}
+	if os.Getenv("MAILGUN_DOMAIN") != "" {
+		providers = append(providers, &mailgun.MailgunProvider{})
+	}
+	if os.Getenv("SES_REGION") != "" {
+		providers = append(providers, &ses.SESProvider{})
+	}
+	if os.Getenv("POSTMARK_SERVER_TOKEN") != "" {
+		providers = append(providers, &postmark.PostmarkProvider{})
+	}
+	if os.Getenv("SENDMAIL_COMMAND") != "" {
+		providers = append(providers, &sendmail.SendmailProvider{})
+	}
+	// Capture every email in a Maildir instead, such that no mail leaves in
+	// development and staging
+	var mailbox *maildir.MaildirProvider
+	if os.Getenv("MAILDIR_PATH") != "" {
+		mailbox = &maildir.MaildirProvider{}
+		providers = []emailprovider.Provider{mailbox}
+	}
 	for _, p := range providers {
 		if err := p.Init(); err != nil {
 			log.Println(err)
 		}
 	}
+	// Track the lifecycle of messages, keeping it for STATUS_RETENTION after
+	// the last event, which defaults to 30 days
+	tracker, err := status.Open(STATUS_FILE)
+	if err != nil {
+		log.Fatalf("error opening status file: %v", err)
+	}
+	defer tracker.Close()
+	if value := os.Getenv("STATUS_RETENTION"); value != "" {
+		tracker.Retention, err = time.ParseDuration(value)
+		if err != nil || tracker.Retention <= 0 {
+			log.Fatalf("invalid STATUS_RETENTION: %s", value)
+		}
+	}
+	if err := tracker.Compact(); err != nil {
+		log.Fatalf("error compacting status file: %v", err)
+	}
 	// Set the strategy to be used
-	strategy := emailsender.RoundRobinSender{Providers: providers}
+	bounded, err := withTimeouts(providers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Count the attempts of the strategy along with tracking them
+	serviceMetrics := metrics.New()
+	observers := emailsender.Observers{tracker, serviceMetrics}
+	strategy, err := makeStrategy(os.Getenv("SEND_STRATEGY"), bounded, observers)
+	if err != nil {
+		log.Fatalf("error creating strategy: %v", err)
+	}
+	// Open the suppression list
+	suppressions, err := suppression.Open(SUPPRESSIONS_FILE)
+	if err != nil {
+		log.Fatalf("error opening suppressions: %v", err)
+	}
+	defer suppressions.Close()
+	// Open the queue and start draining it through the strategy, dropping
+	// the recipients suppressed since the messages were queued
+	q, err := queue.Open(QUEUE_FILE)
+	if err != nil {
+		log.Fatalf("error opening queue: %v", err)
+	}
+	q.Tracker = tracker
+	q.Suppressions = suppressions
+	if err := q.Start(strategy, QUEUE_WORKERS); err != nil {
+		log.Fatalf("error starting queue: %v", err)
+	}
+	defer q.Stop()
+	serviceMetrics.Registry.NewGauge("email_queue_depth", "Messages waiting in the queue, including scheduled ones.", func() float64 {
+		return float64(q.Len())
+	})
+	serviceMetrics.Registry.NewGauge("email_queue_scheduled", "Scheduled messages waiting until they are due.", func() float64 {
+		return float64(len(q.ListScheduled()))
+	})
+	// Open the stored templates
+	store, err := templates.Open(TEMPLATES_FILE)
+	if err != nil {
+		log.Fatalf("error opening templates: %v", err)
+	}
+	defer store.Close()
+	// Open the API keys, creating an admin key on the first start. Its token
+	// is printed to stdout rather than the log, which is served by /log.
+	keys, err := apikeys.Open(KEYS_FILE)
+	if err != nil {
+		log.Fatalf("error opening api keys: %v", err)
+	}
+	defer keys.Close()
+	if keys.Len() == 0 {
+		_, token, err := keys.Create("bootstrap", []apikeys.Scope{apikeys.ScopeAdmin})
+		if err != nil {
+			log.Fatalf("error creating admin key: %v", err)
+		}
+		fmt.Printf("Created admin API key: %s\n", token)
+	}
+	// Limit the request rate and enforce the sending quotas
+	keyLimiter, err := makeLimiter("KEY_RATE_LIMIT", 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ipLimiter, err := makeLimiter("IP_RATE_LIMIT", 20)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotas, err := ratelimit.OpenQuotas(QUOTAS_FILE)
+	if err != nil {
+		log.Fatalf("error opening quotas: %v", err)
+	}
+	defer quotas.Close()
+	// Keep the suppression lists of the providers in sync, every
+	// SUPPRESSION_SYNC_INTERVAL, which defaults to an hour and is disabled by 0
+	interval := time.Hour
+	if value := os.Getenv("SUPPRESSION_SYNC_INTERVAL"); value != "" {
+		interval, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("invalid SUPPRESSION_SYNC_INTERVAL: %v", err)
+		}
+	}
+	if interval > 0 {
+		syncer := &suppression.Syncer{Store: suppressions, Interval: interval}
+		for _, p := range providers {
+			if list, ok := p.(suppression.List); ok {
+				syncer.Lists = append(syncer.Lists, list)
+			}
+		}
+		if err := syncer.Start(); err != nil {
+			log.Fatalf("error starting suppression sync: %v", err)
+		}
+		defer syncer.Stop()
+	}
+	// Verify the Send Grid webhook, if it is configured
+	var sendGridWebhookKey *ecdsa.PublicKey
+	if key := os.Getenv("SENDGRID_WEBHOOK_PUBLIC_KEY"); key != "" {
+		sendGridWebhookKey, err = webhooks.ParsePublicKey(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Replay the responses of requests with an Idempotency-Key for
+	// IDEMPOTENCY_TTL, which defaults to a day
+	idempotencyStore, err := idempotency.Open(IDEMPOTENCY_FILE)
+	if err != nil {
+		log.Fatalf("error opening idempotency keys: %v", err)
+	}
+	defer idempotencyStore.Close()
+	if value := os.Getenv("IDEMPOTENCY_TTL"); value != "" {
+		idempotencyStore.TTL, err = time.ParseDuration(value)
+		if err != nil || idempotencyStore.TTL <= 0 {
+			log.Fatalf("invalid IDEMPOTENCY_TTL: %s", value)
+		}
+	}
+	if err := idempotencyStore.Start(); err != nil {
+		log.Fatalf("error starting idempotency store: %v", err)
+	}
+	// Deliver the messages of a batch BATCH_CONCURRENCY at a time
+	batchConcurrency := server.DefaultBatchConcurrency
+	if value := os.Getenv("BATCH_CONCURRENCY"); value != "" {
+		batchConcurrency, err = strconv.Atoi(value)
+		if err != nil || batchConcurrency < 1 {
+			log.Fatalf("invalid BATCH_CONCURRENCY: %s", value)
+		}
+	}
 	// Start the web server
 	app := server.ServerApp{
-		Strategy: &strategy,
-		LogFile:  LOG_FILE,
+		Keys:                     keys,
+		Strategy:                 strategy,
+		LogFile:                  LOG_FILE,
+		Queue:                    q,
+		Tracker:                  tracker,
+		Templates:                store,
+		KeyLimiter:               keyLimiter,
+		IPLimiter:                ipLimiter,
+		TrustProxy:               os.Getenv("TRUST_PROXY") == "true",
+		Quotas:                   quotas,
+		SparkPostWebhookUser:     os.Getenv("SPARKPOST_WEBHOOK_USER"),
+		SparkPostWebhookPassword: os.Getenv("SPARKPOST_WEBHOOK_PASSWORD"),
+		SendGridWebhookKey:       sendGridWebhookKey,
+		Suppressions:             suppressions,
+		Idempotency:              idempotencyStore,
+		Metrics:                  serviceMetrics,
+		BatchConcurrency:         batchConcurrency,
+		Mailbox:                  mailbox,
 	}
 	app.Serve()
 	port := os.Getenv("PORT")
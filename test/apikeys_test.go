@@ -0,0 +1,148 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	key, token, err := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	assert.Nil(t, err)
+	authenticated, ok := keys.Authenticate(token)
+	assert.True(t, ok)
+	assert.Equal(t, key.ID, authenticated.ID)
+	assert.True(t, authenticated.Has(apikeys.ScopeSend))
+	assert.False(t, authenticated.Has(apikeys.ScopeAdmin))
+	_, ok = keys.Authenticate(key.ID + ".wrong")
+	assert.False(t, ok)
+	_, ok = keys.Authenticate("garbage")
+	assert.False(t, ok)
+}
+
+func TestAPIKeyValidation(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	_, _, err := keys.Create("", []apikeys.Scope{apikeys.ScopeSend})
+	assert.NotNil(t, err)
+	_, _, err = keys.Create("webshop", nil)
+	assert.NotNil(t, err)
+	_, _, err = keys.Create("webshop", []apikeys.Scope{"superuser"})
+	assert.NotNil(t, err)
+}
+
+func TestAPIKeyRevocationPersists(t *testing.T) {
+	keys, path := openTestStore(t, apikeys.Open)
+	key, token, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	_, otherToken, _ := keys.Create("newsletter", []apikeys.Scope{apikeys.ScopeSend})
+	ok, err := keys.Revoke(key.ID)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, ok = keys.Authenticate(token)
+	assert.False(t, ok)
+	keys.Close()
+
+	reopened, err := apikeys.Open(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	_, ok = reopened.Authenticate(token)
+	assert.False(t, ok)
+	_, ok = reopened.Authenticate(otherToken)
+	assert.True(t, ok)
+	list := reopened.List()
+	if assert.Len(t, list, 2) {
+		assert.NotNil(t, list[0].Revoked)
+	}
+}
+
+func TestBasicAuthenticationWithAPIKey(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	key, token, _ := keys.Create("support", []apikeys.Scope{apikeys.ScopeReadLogs})
+	app := server.ServerApp{Keys: keys, Strategy: testStrategy}
+	req, _ := http.NewRequest("GET", "/providers", nil)
+	req.SetBasicAuth(key.ID, strings.TrimPrefix(token, key.ID+"."))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	// Authenticated, but the test strategy has no circuit breakers.
+	assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+}
+
+func TestKeysEndpoint(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	_, admin, _ := keys.Create("admin", []apikeys.Scope{apikeys.ScopeAdmin})
+	app := server.ServerApp{Keys: keys, Strategy: testStrategy}
+
+	req := makeTokenRequest(t, admin, "POST", "/keys", strings.NewReader(`{"name": "webshop", "scopes": ["send"]}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Result().StatusCode)
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&created))
+	_, ok := keys.Authenticate(created.Token)
+	assert.True(t, ok)
+
+	req = makeTokenRequest(t, created.Token, "GET", "/keys", nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	req = makeTokenRequest(t, admin, "GET", "/keys", nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.NotContains(t, rr.Body.String(), "hash")
+
+	req = makeTokenRequest(t, admin, "DELETE", "/keys/"+created.ID, nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	_, ok = keys.Authenticate(created.Token)
+	assert.False(t, ok)
+}
+
+func TestKeysPatchKeepsOmittedQuotas(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	_, admin, _ := keys.Create("admin", []apikeys.Scope{apikeys.ScopeAdmin})
+	key, _, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	keys.SetQuotas(key.ID, 10, 0)
+	app := server.ServerApp{Keys: keys, Strategy: testStrategy}
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := makeTokenRequest(t, admin, "PATCH", "/keys/"+key.ID, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := patch(`{"monthly_quota": 100}`)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	var updated apikeys.Key
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&updated))
+	assert.Equal(t, 10, updated.DailyQuota)
+	assert.Equal(t, 100, updated.MonthlyQuota)
+
+	rr = patch(`{"daily_quota": 0}`)
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&updated))
+	assert.Equal(t, 0, updated.DailyQuota)
+	assert.Equal(t, 100, updated.MonthlyQuota)
+
+	assert.Equal(t, http.StatusBadRequest, patch(`{}`).Result().StatusCode)
+}
+
+func TestRevokedKeyIsRejected(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	key, token, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	keys.Revoke(key.ID)
+	app := server.ServerApp{Keys: keys, Strategy: testStrategy}
+	req := makeTokenRequest(t, token, "POST", "/send", strings.NewReader(`{}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
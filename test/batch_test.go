@@ -0,0 +1,136 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchResponseBody struct {
+	Accepted int `json:"accepted"`
+	Failed   int `json:"failed"`
+	Results  []struct {
+		Index int          `json:"index"`
+		ID    string       `json:"id"`
+		Error *problemBody `json:"error"`
+	} `json:"results"`
+}
+
+func postBatch(t *testing.T, app server.ServerApp, body string) (*httptest.ResponseRecorder, batchResponseBody) {
+	req := makeAuthorizedRequest(t, "POST", "/send/batch", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	var response batchResponseBody
+	if rr.Result().Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, response
+}
+
+func TestBatchSendsEveryMessage(t *testing.T) {
+	var mu sync.Mutex
+	var subjects []string
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		mu.Lock()
+		defer mu.Unlock()
+		subjects = append(subjects, m.Subject.String())
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy}
+	rr, response := postBatch(t, app, `[
+{"from": {"address": "test@test.com"}, "to": [{"address": "a@test.dk"}], "subject": "first", "body": "hi"},
+{"from": {"address": "test@test.com"}, "to": [{"address": "b@test.dk"}], "subject": "second", "body": "hi"}
+]`)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Equal(t, 2, response.Accepted)
+	assert.Equal(t, 0, response.Failed)
+	assert.Len(t, response.Results, 2)
+	for i, result := range response.Results {
+		assert.Equal(t, i, result.Index)
+		assert.NotEmpty(t, result.ID)
+		assert.Nil(t, result.Error)
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, subjects)
+}
+
+func TestBatchReportsFailuresPerMessage(t *testing.T) {
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		if m.Subject.String() == "refused" {
+			return emailprovider.Fail("test", emailprovider.FailureRejected, errors.New("Too large"))
+		}
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy}
+	rr, response := postBatch(t, app, `[
+{"from": {"address": "test@test.com"}, "to": [{"address": "a@test.dk"}], "subject": "fine", "body": "hi"},
+{"from": {"address": "test@test.com"}, "to": [{"address": "peter"}], "subject": "invalid", "body": "hi"},
+{"from": {"address": "test@test.com"}, "to": [{"address": "c@test.dk"}], "subject": "refused", "body": "hi"}
+]`)
+	assert.Equal(t, http.StatusMultiStatus, rr.Result().StatusCode)
+	assert.Equal(t, 1, response.Accepted)
+	assert.Equal(t, 2, response.Failed)
+	assert.NotEmpty(t, response.Results[0].ID)
+	assert.Equal(t, "validation_failed", response.Results[1].Error.Code)
+	assert.Equal(t, "to[0].address", response.Results[1].Error.Errors[0].Field)
+	assert.Equal(t, "rejected_by_provider", response.Results[2].Error.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Results[2].Error.Status)
+}
+
+func TestBatchBoundsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, BatchConcurrency: 3}
+	messages := make([]string, 12)
+	for i := range messages {
+		messages[i] = `{"from": {"address": "test@test.com"}, "to": [{"address": "a@test.dk"}], "subject": "hello", "body": "hi"}`
+	}
+	rr, response := postBatch(t, app, "["+strings.Join(messages, ",")+"]")
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Equal(t, 12, response.Accepted)
+	assert.True(t, most > 1, "Did not send concurrently")
+	assert.True(t, most <= 3, "Sent %d messages at once", most)
+}
+
+func TestBatchRejectsInvalidBatches(t *testing.T) {
+	app := server.ServerApp{Keys: testKeys, Strategy: testStrategy}
+	rr, _ := postBatch(t, app, `{"from": {"address": "test@test.com"}}`)
+	assert.Equal(t, "invalid_json", decodeProblem(t, rr).Code)
+	rr, _ = postBatch(t, app, `[]`)
+	assert.Equal(t, "invalid_request", decodeProblem(t, rr).Code)
+}
+
+func TestBatchQueuesMessages(t *testing.T) {
+	q, _ := openTestQueue(t)
+	defer q.Stop()
+	app := server.ServerApp{Keys: testKeys, Strategy: testStrategy, Queue: q}
+	rr, response := postBatch(t, app, `[
+{"from": {"address": "test@test.com"}, "to": [{"address": "a@test.dk"}], "subject": "first", "body": "hi"},
+{"from": {"address": "test@test.com"}, "to": [{"address": "b@test.dk"}], "subject": "second", "body": "hi"}
+]`)
+	assert.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	assert.Equal(t, 2, response.Accepted)
+	assert.Equal(t, 2, q.Len())
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SwitchProvider fails while Down is set, and counts its calls.
+type SwitchProvider struct {
+	Down   bool
+	Called int
+}
+
+func (s *SwitchProvider) Init() error {
+	return nil
+}
+
+func (s *SwitchProvider) Name() string {
+	return "switch"
+}
+
+func (s *SwitchProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	s.Called++
+	if s.Down {
+		return "", errors.New("Provider down")
+	}
+	return "", nil
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func makeBreakerSender(providers ...emailprovider.Provider) (*emailsender.CircuitBreakerSender, *testClock) {
+	clock := &testClock{now: time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)}
+	return &emailsender.CircuitBreakerSender{
+		Providers:        providers,
+		FailureThreshold: 3,
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		CoolDown:         time.Minute,
+		Now:              clock.Now,
+	}, clock
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	primary := &SwitchProvider{Down: true}
+	secondary := &SwitchProvider{}
+	sender, _ := makeBreakerSender(primary, secondary)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	}
+	assert.Equal(t, 3, primary.Called, "Kept calling provider with open breaker")
+	assert.Equal(t, 5, secondary.Called)
+	assert.Equal(t, emailsender.BreakerOpen, sender.Breakers()[0].State)
+	assert.Equal(t, emailsender.BreakerClosed, sender.Breakers()[1].State)
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	flaky := &SwitchProvider{}
+	sender, _ := makeBreakerSender(flaky, SuccessProvider{})
+	for i := 0; i < 6; i++ {
+		flaky.Down = i%3 != 0
+		sender.Send(context.Background(), makeSimpleEmail())
+	}
+	status := sender.Breakers()[0]
+	assert.Equal(t, emailsender.BreakerOpen, status.State)
+	assert.True(t, status.ErrorRate > 0.5)
+}
+
+func TestBreakerHalfOpensAndCloses(t *testing.T) {
+	primary := &SwitchProvider{Down: true}
+	sender, clock := makeBreakerSender(primary, SuccessProvider{})
+	for i := 0; i < 3; i++ {
+		sender.Send(context.Background(), makeSimpleEmail())
+	}
+	clock.Advance(30 * time.Second)
+	sender.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, 3, primary.Called, "Called provider during cool-down")
+
+	clock.Advance(31 * time.Second)
+	assert.Equal(t, emailsender.BreakerHalfOpen, sender.Breakers()[0].State)
+	primary.Down = false
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 4, primary.Called, "Did not probe half-open provider")
+	assert.Equal(t, emailsender.BreakerClosed, sender.Breakers()[0].State)
+}
+
+func TestBreakerReopensOnFailedProbe(t *testing.T) {
+	primary := &SwitchProvider{Down: true}
+	sender, clock := makeBreakerSender(primary, SuccessProvider{})
+	for i := 0; i < 3; i++ {
+		sender.Send(context.Background(), makeSimpleEmail())
+	}
+	clock.Advance(2 * time.Minute)
+	sender.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, 4, primary.Called)
+	assert.Equal(t, emailsender.BreakerOpen, sender.Breakers()[0].State)
+	sender.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, 4, primary.Called, "Called provider after failed probe")
+}
+
+func TestBreakerFailsFastWhenAllOpen(t *testing.T) {
+	primary := &SwitchProvider{Down: true}
+	sender, _ := makeBreakerSender(primary)
+	for i := 0; i < 3; i++ {
+		assert.NotNil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	}
+	assert.NotNil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 3, primary.Called)
+}
+
+func TestProvidersEndpoint(t *testing.T) {
+	sender, _ := makeBreakerSender(&SwitchProvider{}, SuccessProvider{})
+	app := server.ServerApp{Keys: testKeys, Strategy: sender}
+	req := makeSupportRequest(t, "GET", "/providers", nil)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.NotContains(t, rr.Body.String(), "opened_at", "Closed breakers report when they opened")
+	var statuses []emailsender.BreakerStatus
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&statuses))
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "success", statuses[1].Provider)
+}
+
+func TestBreakerConcurrentFirstSends(t *testing.T) {
+	sender := &emailsender.CircuitBreakerSender{Providers: []emailprovider.Provider{SuccessProvider{}}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sender.Send(context.Background(), makeSimpleEmail())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, emailsender.BreakerClosed, sender.Breakers()[0].State)
+}
+
+func TestBreakerIgnoresCancelledSends(t *testing.T) {
+	sender, _ := makeBreakerSender(HangingProvider{})
+	sender.FailureThreshold = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, sender.Send(ctx, makeSimpleEmail()))
+	assert.Equal(t, emailsender.BreakerClosed, sender.Breakers()[0].State)
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"encoding/json"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
 	"github.com/stretchr/testify/assert"
 	"strings"
@@ -33,3 +34,100 @@ func TestCorrectlyFormattedEmail(t *testing.T) {
 	assert.NotNil(t, withoutName)
 	assert.Nil(t, err)
 }
+
+func TestCanMakeAttachment(t *testing.T) {
+	a, err := emailprovider.MakeAttachment("invoice.pdf", "application/pdf", []byte("%PDF"), "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, emailprovider.DispositionAttachment, a.Disposition())
+}
+
+func TestAttachmentContentTypeNotAllowed(t *testing.T) {
+	_, err := emailprovider.MakeAttachment("virus.exe", "application/x-msdownload", []byte("MZ"), "", "")
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeAttachment("file", "not a type", []byte("data"), "", "")
+	assert.NotNil(t, err)
+}
+
+func TestAttachmentFilenameMustBePlain(t *testing.T) {
+	_, err := emailprovider.MakeAttachment("../etc/passwd", "text/plain", []byte("data"), "", "")
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeAttachment("", "text/plain", []byte("data"), "", "")
+	assert.NotNil(t, err)
+}
+
+func TestAttachmentSizeLimits(t *testing.T) {
+	_, err := emailprovider.MakeAttachment("big.txt", "text/plain", make([]byte, emailprovider.MaxAttachmentSize+1), "", "")
+	assert.NotNil(t, err)
+	a, _ := emailprovider.MakeAttachment("big.txt", "text/plain", make([]byte, emailprovider.MaxAttachmentSize), "", "")
+	assert.Nil(t, emailprovider.CheckAttachmentsSize([]emailprovider.Attachment{a, a}))
+	assert.NotNil(t, emailprovider.CheckAttachmentsSize([]emailprovider.Attachment{a, a, a}))
+}
+
+func TestInlineAttachmentRequiresImageWithContentID(t *testing.T) {
+	_, err := emailprovider.MakeAttachment("logo.png", "image/png", []byte("png"), "inline", "")
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeAttachment("logo.txt", "text/plain", []byte("png"), "inline", "logo")
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeAttachment("logo.png", "image/png", []byte("png"), "inline", "logo")
+	assert.Nil(t, err)
+}
+
+func TestEmailJSONRoundTrip(t *testing.T) {
+	from, _ := emailprovider.MakeEmailAddress("Morten", "morten@example.com")
+	subject, _ := emailprovider.MakeSubject("this is a subject")
+	logo, _ := emailprovider.MakeAttachment("logo.png", "image/png", []byte("PNG"), "inline", "logo")
+	email := emailprovider.Email{
+		ID:          "message-1",
+		From:        from,
+		To:          []emailprovider.EmailAddress{from},
+		Subject:     subject,
+		HtmlBody:    emailprovider.MakeHtmlBody("<img src=\"cid:logo\">"),
+		Attachments: []emailprovider.Attachment{logo},
+	}
+	data, err := json.Marshal(email)
+	assert.Nil(t, err)
+	var decoded emailprovider.Email
+	assert.Nil(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "message-1", decoded.ID)
+	assert.Equal(t, "morten@example.com", decoded.To[0].Address())
+	assert.Equal(t, "PNG", string(decoded.Attachments[0].Data()))
+	assert.Equal(t, "logo", decoded.Attachments[0].ContentID())
+}
+
+func TestMakeHeadersRejectsReservedHeaders(t *testing.T) {
+	for _, name := range []string{"From", "bcc", "Message-ID", "content-type"} {
+		_, err := emailprovider.MakeHeaders(map[string]string{name: "value"})
+		assert.NotNil(t, err, "Accepted reserved header %s", name)
+	}
+}
+
+func TestMakeHeadersValidatesHeaders(t *testing.T) {
+	_, err := emailprovider.MakeHeaders(map[string]string{"X-Bad Name": "value"})
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeHeaders(map[string]string{"X-Injected": "value\r\nBcc: victim@example.com"})
+	assert.NotNil(t, err)
+	headers, err := emailprovider.MakeHeaders(map[string]string{
+		"x-entity-ref-id":  "1234",
+		"List-Unsubscribe": "<mailto:unsubscribe@example.com>",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", headers["X-Entity-Ref-Id"])
+}
+
+func TestMakeTagsAndMetadata(t *testing.T) {
+	_, err := emailprovider.MakeTags([]string{"receipt", ""})
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeTags(make([]string, emailprovider.MaxTags+1))
+	assert.NotNil(t, err)
+	tags, err := emailprovider.MakeTags([]string{"receipt", "webshop"})
+	assert.Nil(t, err)
+	assert.Len(t, tags, 2)
+	_, err = emailprovider.MakeMetadata(map[string]string{"": "value"})
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeMetadata(map[string]string{"order": strings.Repeat("x", emailprovider.MaxMetadataValueLen+1)})
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeMetadata(map[string]string{emailprovider.MessageIDMetadataKey: "1234"})
+	assert.NotNil(t, err)
+	_, err = emailprovider.MakeMetadata(map[string]string{"order": "1234"})
+	assert.Nil(t, err)
+}
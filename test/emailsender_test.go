@@ -1,31 +1,57 @@
 package test
 
 import (
+	"context"
 	"errors"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
 	"github.com/mkj-gram/go_email_service/internal/emailsender"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 type TestProvider struct {
 	send func(m emailprovider.Email) error
 }
 
-func (t TestProvider) Send(m emailprovider.Email) error {
-	return t.send(m)
+func (t TestProvider) Init() error {
+	return nil
+}
+
+func (t TestProvider) Name() string {
+	return "test"
+}
+
+func (t TestProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	return "", t.send(m)
 }
 
 type SuccessProvider struct{}
 
-func (s SuccessProvider) Send(m emailprovider.Email) error {
+func (s SuccessProvider) Init() error {
 	return nil
 }
 
+func (s SuccessProvider) Name() string {
+	return "success"
+}
+
+func (s SuccessProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	return "success-id", nil
+}
+
 type FailProvider struct{}
 
-func (f FailProvider) Send(m emailprovider.Email) error {
-	return errors.New("Some error here")
+func (f FailProvider) Init() error {
+	return nil
+}
+
+func (f FailProvider) Name() string {
+	return "fail"
+}
+
+func (f FailProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	return "", errors.New("Some error here")
 }
 
 func testProviderGenerator(index *int, err error) TestProvider {
@@ -50,7 +76,7 @@ func TestSendChecksForProviders(t *testing.T) {
 	sender := emailsender.RoundRobinSender{
 		Providers: []emailprovider.Provider{},
 	}
-	err := sender.Send(emailprovider.Email{})
+	err := sender.Send(context.Background(), emailprovider.Email{})
 	assert.NotNil(t, err)
 }
 
@@ -61,7 +87,7 @@ func TestWillCallFirstProvider(t *testing.T) {
 			testProviderGenerator(&called, nil),
 		},
 	}
-	err := sender.Send(makeSimpleEmail())
+	err := sender.Send(context.Background(), makeSimpleEmail())
 	assert.Equal(t, 1, called)
 	assert.Nil(t, err)
 }
@@ -74,7 +100,7 @@ func TestWillNotCallAfterSuccessProvider(t *testing.T) {
 			testProviderGenerator(&called, nil),
 		},
 	}
-	sender.Send(makeSimpleEmail())
+	sender.Send(context.Background(), makeSimpleEmail())
 	assert.Equal(t, 0, called, "Called second provider after success")
 }
 
@@ -85,7 +111,7 @@ func TestWillCallAfterFailProvider(t *testing.T) {
 		testProviderGenerator(&called, nil),
 	}
 	sender := emailsender.RoundRobinSender{Providers: providers}
-	sender.Send(makeSimpleEmail())
+	sender.Send(context.Background(), makeSimpleEmail())
 	assert.Equal(t, 1, called, "Not called second provider after fail")
 }
 
@@ -97,7 +123,7 @@ func TestWillNotLoopOnFailingProviders(t *testing.T) {
 	}
 	sender := emailsender.RoundRobinSender{Providers: providers}
 	// This will keep looping forever, if not implemented correctly
-	sender.Send(makeSimpleEmail())
+	sender.Send(context.Background(), makeSimpleEmail())
 }
 
 func TestWillContinueWithLastSuccess(t *testing.T) {
@@ -108,9 +134,52 @@ func TestWillContinueWithLastSuccess(t *testing.T) {
 		testProviderGenerator(&counters[2], nil),
 	}
 	sender := emailsender.RoundRobinSender{Providers: providers}
-	sender.Send(makeSimpleEmail())
-	sender.Send(makeSimpleEmail())
+	sender.Send(context.Background(), makeSimpleEmail())
+	sender.Send(context.Background(), makeSimpleEmail())
 	assert.Equal(t, 1, counters[0], "Calling first provider again")
 	assert.Equal(t, 2, counters[1], "Not starting with last successful provider")
 	assert.Equal(t, 0, counters[2], "Not starting with last successful provider")
 }
+
+// HangingProvider blocks until the context of the send is done.
+type HangingProvider struct{}
+
+func (h HangingProvider) Init() error {
+	return nil
+}
+
+func (h HangingProvider) Name() string {
+	return "hanging"
+}
+
+func (h HangingProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestTimeoutProviderGivesUp(t *testing.T) {
+	called := 0
+	sender := emailsender.RoundRobinSender{Providers: []emailprovider.Provider{
+		emailprovider.TimeoutProvider{Provider: HangingProvider{}, Timeout: 10 * time.Millisecond},
+		testProviderGenerator(&called, nil),
+	}}
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 1, called, "Did not fail over after the timeout")
+}
+
+func TestCancelledSendStopsFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	called := 0
+	providers := []emailprovider.Provider{HangingProvider{}, testProviderGenerator(&called, nil)}
+	senders := []emailsender.Strategy{
+		&emailsender.RoundRobinSender{Providers: providers},
+		&emailsender.PrioritySender{Providers: providers},
+		&emailsender.WeightedSender{Providers: []emailsender.WeightedProvider{{Provider: providers[0], Weight: 1}, {Provider: providers[1], Weight: 0}}},
+		&emailsender.CircuitBreakerSender{Providers: providers},
+	}
+	for _, sender := range senders {
+		assert.Equal(t, context.DeadlineExceeded, sender.Send(ctx, makeSimpleEmail()))
+	}
+	assert.Equal(t, 0, called, "Failed over after the caller gave up")
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/sendgrid"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RefusingProvider fails every send with Err, and counts its calls.
+type RefusingProvider struct {
+	name   string
+	Err    error
+	Called int
+}
+
+func (r *RefusingProvider) Init() error {
+	return nil
+}
+
+func (r *RefusingProvider) Name() string {
+	return r.name
+}
+
+func (r *RefusingProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	r.Called++
+	return "", r.Err
+}
+
+func sendGridFailure(t *testing.T, status int, header map[string]string, body string) error {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer api.Close()
+	provider := sendgrid.SendGridProvider{Host: api.URL}
+	_, err := provider.Send(context.Background(), makeSimpleEmail())
+	return err
+}
+
+func TestSendGridFailureKinds(t *testing.T) {
+	err := sendGridFailure(t, http.StatusBadRequest, nil,
+		`{"errors": [{"message": "Does not contain a valid address.", "field": "personalizations.0.to.0.email"}]}`)
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	assert.Contains(t, err.Error(), "Does not contain a valid address.")
+
+	err = sendGridFailure(t, http.StatusBadRequest, nil, `{"errors": [{"message": "Bad subject", "field": "subject"}]}`)
+	assert.Equal(t, emailprovider.FailureRejected, emailprovider.KindOf(err))
+
+	err = sendGridFailure(t, http.StatusUnauthorized, nil, `{"errors": [{"message": "Bad key"}]}`)
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	assert.False(t, emailprovider.IsPermanent(err))
+
+	err = sendGridFailure(t, http.StatusTooManyRequests, map[string]string{"Retry-After": "30"}, "")
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	assert.Equal(t, 30*time.Second, emailprovider.RetryAfter(err))
+
+	err = sendGridFailure(t, http.StatusBadGateway, nil, "")
+	assert.Equal(t, emailprovider.FailureTransient, emailprovider.KindOf(err))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, 2*time.Minute, emailprovider.ParseRetryAfter("120", now))
+	assert.Equal(t, 90*time.Second, emailprovider.ParseRetryAfter("Thu, 01 Mar 2018 10:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), emailprovider.ParseRetryAfter("soon", now))
+}
+
+func TestPermanentFailureSkipsFailover(t *testing.T) {
+	refusing := &RefusingProvider{name: "refusing", Err: emailprovider.Fail("refusing", emailprovider.FailureInvalidRecipient, errors.New("No such user"))}
+	backup := &SwitchProvider{}
+	strategies := []emailsender.Strategy{
+		&emailsender.RoundRobinSender{Providers: []emailprovider.Provider{refusing, backup}},
+		&emailsender.PrioritySender{Providers: []emailprovider.Provider{refusing, backup}},
+		&emailsender.WeightedSender{Providers: []emailsender.WeightedProvider{{Provider: refusing, Weight: 1}, {Provider: backup}}},
+	}
+	for _, strategy := range strategies {
+		err := strategy.Send(context.Background(), makeSimpleEmail())
+		assert.True(t, emailprovider.IsPermanent(err))
+	}
+	assert.Equal(t, 3, refusing.Called)
+	assert.Equal(t, 0, backup.Called, "Failed over after a permanent failure")
+}
+
+func TestTransientFailureFailsOver(t *testing.T) {
+	refusing := &RefusingProvider{name: "refusing", Err: emailprovider.Fail("refusing", emailprovider.FailureAuth, errors.New("Bad key"))}
+	backup := &SwitchProvider{}
+	sender := emailsender.PrioritySender{Providers: []emailprovider.Provider{refusing, backup}}
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 1, backup.Called)
+}
+
+func TestThrottledProviderIsSkipped(t *testing.T) {
+	clock := &testClock{now: time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)}
+	limited := emailprovider.Fail("throttled", emailprovider.FailureRateLimited, errors.New("Slow down"))
+	limited.RetryAfter = time.Minute
+	throttled := &RefusingProvider{name: "throttled", Err: limited}
+	backup := &SwitchProvider{}
+	sender := emailsender.PrioritySender{Providers: []emailprovider.Provider{throttled, backup}, RecoveryWindow: time.Second, Now: clock.Now}
+	for i := 0; i < 3; i++ {
+		clock.Advance(2 * time.Second)
+		assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	}
+	assert.Equal(t, 1, throttled.Called, "Kept sending to a throttled provider")
+	clock.Advance(time.Minute)
+	sender.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, 2, throttled.Called, "Did not return to provider after retry-after")
+}
+
+func TestAllThrottledReportsRetryAfter(t *testing.T) {
+	first := emailprovider.Fail("first", emailprovider.FailureRateLimited, errors.New("Slow down"))
+	first.RetryAfter = time.Minute
+	second := emailprovider.Fail("second", emailprovider.FailureRateLimited, errors.New("Slow down"))
+	second.RetryAfter = 20 * time.Second
+	sender := emailsender.RoundRobinSender{Providers: []emailprovider.Provider{
+		&RefusingProvider{name: "first", Err: first},
+		&RefusingProvider{name: "second", Err: second},
+	}}
+	err := sender.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	assert.Equal(t, 20*time.Second, emailprovider.RetryAfter(err))
+
+	// Both are now throttled, and are not called again.
+	err = sender.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	assert.InDelta(t, float64(20*time.Second), float64(emailprovider.RetryAfter(err)), float64(time.Second))
+}
+
+func TestBreakerIgnoresPermanentAndThrottledFailures(t *testing.T) {
+	refusing := &RefusingProvider{name: "refusing", Err: emailprovider.Fail("refusing", emailprovider.FailureRejected, errors.New("Too large"))}
+	sender, _ := makeBreakerSender(refusing)
+	for i := 0; i < 5; i++ {
+		sender.Send(context.Background(), makeSimpleEmail())
+	}
+	assert.Equal(t, emailsender.BreakerClosed, sender.Breakers()[0].State)
+	assert.Equal(t, 5, refusing.Called)
+
+	refusing.Err = emailprovider.Fail("refusing", emailprovider.FailureRateLimited, errors.New("Slow down"))
+	for i := 0; i < 5; i++ {
+		sender.Send(context.Background(), makeSimpleEmail())
+	}
+	assert.Equal(t, emailsender.BreakerClosed, sender.Breakers()[0].State)
+}
+
+func TestQueueGivesUpOnPermanentFailure(t *testing.T) {
+	q, _ := openTestQueue(t)
+	calls := 0
+	strategy := TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		calls++
+		return emailprovider.Fail("test", emailprovider.FailureInvalidRecipient, errors.New("No such user"))
+	}}
+	assert.Nil(t, q.Start(strategy, 1))
+	defer q.Stop()
+	q.Enqueue(makeSimpleEmail())
+	waitFor(t, func() bool { return q.Len() == 0 })
+	assert.Equal(t, 1, calls)
+}
+
+func TestSendReportsProviderFailures(t *testing.T) {
+	send := func(err error) *httptest.ResponseRecorder {
+		testStrategy.sendHandler = func(m emailprovider.Email) error {
+			return err
+		}
+		req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+			`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "hello", "body": "hi"}`))
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := send(emailprovider.Fail("test", emailprovider.FailureRejected, errors.New("Too large")))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Result().StatusCode)
+	assert.Equal(t, "rejected_by_provider", decodeProblem(t, rr).Code)
+
+	limited := &emailprovider.SendError{Kind: emailprovider.FailureRateLimited, RetryAfter: 90 * time.Second, Err: errors.New("Slow down")}
+	rr = send(limited)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
+	assert.Equal(t, "90", rr.Result().Header.Get("Retry-After"))
+	assert.Equal(t, "providers_throttled", decodeProblem(t, rr).Code)
+}
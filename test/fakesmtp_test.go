@@ -0,0 +1,267 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeSMTPServer is a minimal in-process SMTP server recording the envelope
+// and data of every delivered message. It supports STARTTLS, implicit TLS
+// and AUTH PLAIN, LOGIN and CRAM-MD5 for a single user.
+type FakeSMTPServer struct {
+	Addr     string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// FailQuit drops the connection instead of answering QUIT.
+	FailQuit bool
+
+	listener  net.Listener
+	tlsConfig *tls.Config
+	implicit  bool
+
+	mu       sync.Mutex
+	messages []FakeSMTPMessage
+}
+
+type FakeSMTPMessage struct {
+	From       string
+	Recipients []string
+	Data       string
+	AuthedAs   string
+	TLS        bool
+}
+
+// selfSignedCertificate creates a certificate valid for 127.0.0.1, along with
+// a pool trusting it.
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startFakeSMTPServer starts a server on a random local port. With implicit
+// set, connections are TLS from the start; otherwise STARTTLS is offered.
+func startFakeSMTPServer(t *testing.T, implicit bool) (*FakeSMTPServer, *x509.CertPool) {
+	cert, pool := selfSignedCertificate(t)
+	s := &FakeSMTPServer{
+		Username:  "starlord",
+		Password:  "uberchallenge",
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		implicit:  implicit,
+	}
+	var err error
+	if implicit {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = s.listener.Addr().String()
+	s.Host = "127.0.0.1"
+	s.Port = s.listener.Addr().(*net.TCPAddr).Port
+	go s.serve()
+	t.Cleanup(func() { s.listener.Close() })
+	return s, pool
+}
+
+func (s *FakeSMTPServer) Messages() []FakeSMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]FakeSMTPMessage(nil), s.messages...)
+}
+
+func (s *FakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *FakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	secure := s.implicit
+	authed := ""
+	var current *FakeSMTPMessage
+	text.PrintfLine("220 fake ESMTP ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-fake greets %s", arg)
+			if !secure {
+				text.PrintfLine("250-STARTTLS")
+			}
+			text.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5")
+		case "STARTTLS":
+			text.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			authed = s.authenticate(text, arg)
+			if authed == "" {
+				text.PrintfLine("535 authentication failed")
+			} else {
+				text.PrintfLine("235 authenticated")
+			}
+		case "MAIL":
+			current = &FakeSMTPMessage{From: envelopeAddress(arg), AuthedAs: authed, TLS: secure}
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			if current == nil {
+				text.PrintfLine("503 need MAIL first")
+				continue
+			}
+			if strings.HasPrefix(envelopeAddress(arg), "unknown@") {
+				text.PrintfLine("550 no such user")
+				continue
+			}
+			current.Recipients = append(current.Recipients, envelopeAddress(arg))
+			text.PrintfLine("250 ok")
+		case "DATA":
+			if current == nil || len(current.Recipients) == 0 {
+				text.PrintfLine("503 need RCPT first")
+				continue
+			}
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, *current)
+			s.mu.Unlock()
+			current = nil
+			text.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			text.PrintfLine("250 ok")
+		case "QUIT":
+			if s.FailQuit {
+				return
+			}
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// authenticate runs an AUTH exchange and returns the authenticated user, or
+// the empty string on failure.
+func (s *FakeSMTPServer) authenticate(text *textproto.Conn, arg string) string {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return ""
+	}
+	challenge := func(prompt string) string {
+		text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, _ := text.ReadLine()
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded)
+	}
+	var username, password string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var response string
+		if len(fields) > 1 {
+			decoded, _ := base64.StdEncoding.DecodeString(fields[1])
+			response = string(decoded)
+		} else {
+			response = challenge("")
+		}
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 {
+			return ""
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		username = challenge("Username:")
+		password = challenge("Password:")
+	case "CRAM-MD5":
+		nonce := fmt.Sprintf("<%d@fake>", time.Now().UnixNano())
+		response := strings.Fields(challenge(nonce))
+		if len(response) != 2 {
+			return ""
+		}
+		mac := hmac.New(md5.New, []byte(s.Password))
+		mac.Write([]byte(nonce))
+		if response[0] == s.Username && response[1] == hex.EncodeToString(mac.Sum(nil)) {
+			return response[0]
+		}
+		return ""
+	default:
+		return ""
+	}
+	if username == s.Username && password == s.Password {
+		return username
+	}
+	return ""
+}
+
+func envelopeAddress(arg string) string {
+	start, end := strings.Index(arg, "<"), strings.Index(arg, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
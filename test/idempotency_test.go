@@ -0,0 +1,169 @@
+package test
+
+import (
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/idempotency"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	store, _ := openTestStore(t, idempotency.Open)
+	stored, err := store.Begin("key", "first")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+	_, err = store.Begin("key", "first")
+	assert.Equal(t, idempotency.ErrInProgress, err)
+	assert.Nil(t, store.Finish("key", idempotency.Response{Status: 202, Body: []byte("{}")}))
+
+	stored, err = store.Begin("key", "first")
+	assert.Nil(t, err)
+	assert.Equal(t, 202, stored.Status)
+	_, err = store.Begin("key", "second")
+	assert.Equal(t, idempotency.ErrMismatch, err)
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	store, _ := openTestStore(t, idempotency.Open)
+	clock := &testClock{now: time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)}
+	store.Now = clock.Now
+	store.TTL = time.Hour
+	store.Begin("key", "first")
+	store.Finish("key", idempotency.Response{Status: 202})
+	clock.Advance(time.Hour)
+	stored, err := store.Begin("key", "second")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
+
+func TestIdempotencyAbortAllowsRetry(t *testing.T) {
+	store, _ := openTestStore(t, idempotency.Open)
+	store.Begin("key", "first")
+	store.Abort("key")
+	stored, err := store.Begin("key", "first")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
+
+func TestIdempotencyCompactsExpiredResponses(t *testing.T) {
+	store, path := openTestStore(t, idempotency.Open)
+	clock := &testClock{now: time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)}
+	store.Now = clock.Now
+	store.TTL = time.Hour
+	store.Begin("expired", "first")
+	store.Finish("expired", idempotency.Response{Status: 202})
+	clock.Advance(30 * time.Minute)
+	store.Begin("kept", "first")
+	store.Finish("kept", idempotency.Response{Status: 202})
+	clock.Advance(30 * time.Minute)
+	assert.Nil(t, store.Compact())
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 1) {
+		assert.Contains(t, lines[0], `"kept"`)
+	}
+}
+
+func TestIdempotencyPersists(t *testing.T) {
+	store, path := openTestStore(t, idempotency.Open)
+	store.Begin("kept", "first")
+	store.Finish("kept", idempotency.Response{Status: 202, ContentType: "application/json", Body: []byte(`{"id": "1"}`)})
+	store.Begin("in-progress", "first")
+	store.Close()
+
+	reopened, err := idempotency.Open(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	stored, err := reopened.Begin("kept", "first")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id": "1"}`, string(stored.Body))
+	stored, err = reopened.Begin("in-progress", "first")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
+
+func TestSendWithIdempotencyKey(t *testing.T) {
+	store, _ := openTestStore(t, idempotency.Open)
+	strategy := &CountingStrategy{}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Idempotency: store}
+	send := func(key string, subject string) *httptest.ResponseRecorder {
+		req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+			`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "`+subject+`", "body": "hi"}`))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+	first := send("order-1234", "hello")
+	assert.Equal(t, http.StatusOK, first.Result().StatusCode)
+	retry := send("order-1234", "hello")
+	assert.Equal(t, http.StatusOK, retry.Result().StatusCode)
+	assert.Equal(t, "true", retry.Result().Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, "application/json", retry.Result().Header.Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, 1, strategy.Attempts(), "Sent a retry again")
+
+	rr := send("order-1234", "changed")
+	assert.Equal(t, http.StatusConflict, rr.Result().StatusCode)
+	assert.Equal(t, "idempotency_key_reused", decodeProblem(t, rr).Code)
+
+	send("order-5678", "hello")
+	assert.Equal(t, 2, strategy.Attempts())
+}
+
+func TestFailedSendIsNotReplayed(t *testing.T) {
+	store, _ := openTestStore(t, idempotency.Open)
+	attempts := 0
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("Provider down")
+		}
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Idempotency: store}
+	send := func() *http.Response {
+		req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+			`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "hello", "body": "hi"}`))
+		req.Header.Set("Idempotency-Key", "order-1234")
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr.Result()
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, send().StatusCode)
+	assert.Equal(t, http.StatusOK, send().StatusCode)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestPanickingSendFreesIdempotencyKey(t *testing.T) {
+	store, _ := openTestStore(t, idempotency.Open)
+	attempts := 0
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		attempts++
+		if attempts == 1 {
+			panic("provider bug")
+		}
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Idempotency: store}
+	send := func() *http.Response {
+		req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+			`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "hello", "body": "hi"}`))
+		req.Header.Set("Idempotency-Key", "order-1234")
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr.Result()
+	}
+	assert.Panics(t, func() { send() })
+	assert.Equal(t, http.StatusOK, send().StatusCode)
+	assert.Equal(t, 2, attempts)
+}
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"context"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/maildir"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestMaildir(t *testing.T) *maildir.MaildirProvider {
+	provider := &maildir.MaildirProvider{Dir: filepath.Join(t.TempDir(), "Maildir")}
+	if err := provider.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func makeCapturedEmail() emailprovider.Email {
+	email := makeFullEmail()
+	email.Subject, _ = emailprovider.MakeSubject("Your receipt, Morten")
+	attachment, _ := emailprovider.MakeAttachment("receipt.txt", "text/plain", []byte("thanks"), "", "")
+	email.Attachments = []emailprovider.Attachment{attachment}
+	return email
+}
+
+func TestMaildirDelivers(t *testing.T) {
+	provider := openTestMaildir(t)
+	id, err := provider.Send(context.Background(), makeCapturedEmail())
+	assert.Nil(t, err)
+	files, _ := ioutil.ReadDir(filepath.Join(provider.Dir, "new"))
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, id, files[0].Name())
+	}
+	files, _ = ioutil.ReadDir(filepath.Join(provider.Dir, "tmp"))
+	assert.Empty(t, files)
+
+	raw, err := provider.Read(id)
+	assert.Nil(t, err)
+	// Bcc recipients are only recorded as envelope recipients
+	assert.Contains(t, string(raw), "Delivered-To: thomas@example.com\r\n")
+	assert.Contains(t, string(raw), "Return-Path: <morten@example.com>\r\n")
+
+	messages, err := provider.List()
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, id, messages[0].ID)
+		assert.Equal(t, "Your receipt, Morten", messages[0].Subject)
+		assert.Equal(t, `"Morten" <morten@example.com>`, messages[0].From)
+	}
+
+	// Messages moved to cur by a mail client keep their id
+	assert.Nil(t, os.Rename(filepath.Join(provider.Dir, "new", id), filepath.Join(provider.Dir, "cur", id+":2,S")))
+	_, err = provider.Read(id)
+	assert.Nil(t, err)
+	messages, _ = provider.List()
+	assert.Equal(t, id, messages[0].ID)
+
+	for _, unknown := range []string{"", "unknown", "../" + id, "."} {
+		_, err = provider.Read(unknown)
+		assert.Equal(t, maildir.ErrNotFound, err, unknown)
+	}
+}
+
+func TestMaildirParse(t *testing.T) {
+	provider := openTestMaildir(t)
+	id, _ := provider.Send(context.Background(), makeCapturedEmail())
+	raw, _ := provider.Read(id)
+	parsed, err := maildir.Parse(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "Your receipt, Morten", parsed.Get("subject"))
+	assert.Equal(t, "this is a body", strings.TrimSpace(parsed.Text))
+	assert.Equal(t, "this is a <em>body</em>", strings.TrimSpace(parsed.Html))
+	if assert.Len(t, parsed.Parts, 1) {
+		assert.Equal(t, "receipt.txt", parsed.Parts[0].Filename)
+		assert.Equal(t, len("thanks"), parsed.Parts[0].Size)
+	}
+	assert.Equal(t, "Return-Path", parsed.Headers[0].Name)
+}
+
+func TestMailboxPage(t *testing.T) {
+	provider := openTestMaildir(t)
+	email := makeCapturedEmail()
+	email.HtmlBody = emailprovider.MakeHtmlBody(`<p onclick="steal()">hello</p>`)
+	id, _ := provider.Send(context.Background(), email)
+	app := server.ServerApp{Keys: testKeys, Mailbox: provider}
+
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeSupportRequest(t, "GET", "/mailbox", nil))
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", rr.Result().Header.Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), `<a href="/mailbox/`+id+`">Your receipt, Morten</a>`)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeSupportRequest(t, "GET", "/mailbox/"+id, nil))
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	body := rr.Body.String()
+	assert.Contains(t, body, "<pre>this is a body")
+	assert.Contains(t, body, "receipt.txt")
+	// The html is only shown escaped in a sandboxed frame
+	assert.Contains(t, body, `<iframe sandbox srcdoc="&lt;p onclick=&#34;steal()&#34;&gt;hello&lt;/p&gt;`)
+	assert.NotContains(t, body, `<p onclick`)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeSupportRequest(t, "GET", "/mailbox/"+id+"/raw", nil))
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Result().Header.Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "Subject: ")
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeSupportRequest(t, "GET", "/mailbox/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+
+	// Browsers are asked for credentials, and senders are not let in
+	rr = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/mailbox", nil)
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+	assert.Equal(t, `Basic realm="mailbox"`, rr.Result().Header.Get("WWW-Authenticate"))
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "GET", "/mailbox", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	server.ServerApp{Keys: testKeys}.Handler().ServeHTTP(rr, makeSupportRequest(t, "GET", "/mailbox", nil))
+	assert.Equal(t, "not_enabled", decodeProblem(t, rr).Code)
+}
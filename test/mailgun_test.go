@@ -0,0 +1,115 @@
+package test
+
+import (
+	"context"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mailgun"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startFakeMailgun serves the messages API of Mailgun, handing every parsed
+// request to handle.
+func startFakeMailgun(t *testing.T, handle func(w http.ResponseWriter, r *http.Request)) *mailgun.MailgunProvider {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "api" || password != "key-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Forbidden"))
+			return
+		}
+		if r.URL.Path != "/v3/mg.example.com/messages" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Domain not found: mg.example.com"}`))
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatal(err)
+		}
+		handle(w, r)
+	}))
+	t.Cleanup(api.Close)
+	provider := &mailgun.MailgunProvider{Domain: "mg.example.com", APIKey: "key-secret", BaseURL: api.URL}
+	assert.Nil(t, provider.Init())
+	return provider
+}
+
+func TestMailgunSend(t *testing.T) {
+	provider := startFakeMailgun(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{`"Morten" <morten@example.com>`}, r.MultipartForm.Value["from"])
+		assert.Equal(t, []string{`"Peter" <peter@example.com>`}, r.MultipartForm.Value["cc"])
+		assert.Equal(t, "this is a subject", r.FormValue("subject"))
+		assert.Equal(t, "this is a body", r.FormValue("text"))
+		assert.Equal(t, "this is a <em>body</em>", r.FormValue("html"))
+		assert.Equal(t, "support@example.com", r.FormValue("h:Reply-To"))
+		assert.Equal(t, "<mailto:unsubscribe@example.com>", r.FormValue("h:List-Unsubscribe"))
+		assert.Equal(t, []string{"one", "two", "three"}, r.MultipartForm.Value["o:tag"])
+		assert.Equal(t, "1234", r.FormValue("v:order"))
+		assert.Equal(t, "abc123", r.FormValue("v:message_id"))
+		files := r.MultipartForm.File["attachment"]
+		if assert.Len(t, files, 1) {
+			assert.Equal(t, "receipt.txt", files[0].Filename)
+			f, _ := files[0].Open()
+			data, _ := ioutil.ReadAll(f)
+			assert.Equal(t, "thanks", string(data))
+		}
+		w.Write([]byte(`{"id": "<20180301100000.1.ABC@mg.example.com>", "message": "Queued. Thank you."}`))
+	})
+	email := makeFullEmail()
+	email.ID = "abc123"
+	email.ReplyTo, _ = emailprovider.MakeEmailAddress("", "support@example.com")
+	email.Headers = map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}
+	email.Tags = []string{"one", "two", "three", "four"}
+	email.Metadata = map[string]string{"order": "1234"}
+	attachment, _ := emailprovider.MakeAttachment("receipt.txt", "text/plain", []byte("thanks"), "", "")
+	email.Attachments = []emailprovider.Attachment{attachment}
+	id, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.Equal(t, "20180301100000.1.ABC@mg.example.com", id)
+}
+
+func TestMailgunFailureKinds(t *testing.T) {
+	status, body := 0, ""
+	provider := startFakeMailgun(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "15")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+	send := func(code int, message string) error {
+		status, body = code, message
+		_, err := provider.Send(context.Background(), makeSimpleEmail())
+		return err
+	}
+	err := send(http.StatusBadRequest, `{"message": "'to' parameter is not a valid address. please check documentation"}`)
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	assert.Contains(t, err.Error(), "not a valid address")
+	err = send(http.StatusBadRequest, `{"message": "Need at least one of 'text' or 'html' parameters specified"}`)
+	assert.Equal(t, emailprovider.FailureRejected, emailprovider.KindOf(err))
+	err = send(http.StatusTooManyRequests, `{"message": "Too many requests"}`)
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	assert.Equal(t, 15*time.Second, emailprovider.RetryAfter(err))
+	err = send(http.StatusInternalServerError, "")
+	assert.Equal(t, emailprovider.FailureTransient, emailprovider.KindOf(err))
+
+	provider.APIKey = "wrong"
+	err = send(http.StatusOK, "")
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	provider.APIKey = "key-secret"
+	provider.Domain = "unknown.example.com"
+	err = send(http.StatusOK, "")
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+}
+
+func TestMailgunRegions(t *testing.T) {
+	provider := &mailgun.MailgunProvider{Domain: "mg.example.com", APIKey: "key-secret", Region: mailgun.RegionEU}
+	assert.Nil(t, provider.Init())
+	assert.Equal(t, "https://api.eu.mailgun.net", provider.BaseURL)
+	provider = &mailgun.MailgunProvider{Domain: "mg.example.com", APIKey: "key-secret", Region: "mars"}
+	assert.NotNil(t, provider.Init())
+	provider = &mailgun.MailgunProvider{APIKey: "key-secret"}
+	assert.NotNil(t, provider.Init())
+}
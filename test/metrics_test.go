@@ -0,0 +1,99 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/metrics"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExpositionFormat(t *testing.T) {
+	r := &metrics.Registry{}
+	counter := r.NewCounter("sends_total", "Sends.", "provider")
+	counter.Inc("spark\"post")
+	counter.Add(2, "sendgrid")
+	r.NewGauge("depth", "Depth.", func() float64 { return 3 })
+	histogram := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	var out bytes.Buffer
+	assert.Nil(t, r.Write(&out))
+	assert.Equal(t, `# HELP sends_total Sends.
+# TYPE sends_total counter
+sends_total{provider="sendgrid"} 2
+sends_total{provider="spark\"post"} 1
+# HELP depth Depth.
+# TYPE depth gauge
+depth 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 0.55
+latency_seconds_count 2
+`, out.String())
+}
+
+func TestMetricsCountAttemptsAndFailovers(t *testing.T) {
+	m := metrics.New()
+	sender := emailsender.RoundRobinSender{
+		Providers: []emailprovider.Provider{FailProvider{}, SuccessProvider{}},
+		Observer:  m,
+	}
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, float64(1), m.ProviderAttempts.Value("fail", "failure"))
+	assert.Equal(t, float64(1), m.ProviderFailures.Value("fail", "transient"))
+	assert.Equal(t, float64(1), m.ProviderAttempts.Value("success", "success"))
+	assert.Equal(t, float64(1), m.Failovers.Value("success"))
+	assert.Equal(t, float64(0), m.Failovers.Value("fail"))
+	assert.Equal(t, uint64(1), m.ProviderLatency.Count("success"))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	m := metrics.New()
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error { return nil }}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Metrics: m}
+	for _, body := range []string{
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "hello", "body": "hi"}`,
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "peter"}], "subject": "hello", "body": "hi"}`,
+	} {
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(body)))
+	}
+	assert.Equal(t, float64(1), m.MessagesAccepted.Value())
+	assert.Equal(t, float64(1), m.MessagesRejected.Value("validation_failed"))
+	assert.Equal(t, uint64(2), m.RequestLatency.Count("/send", "POST"))
+
+	// Requests which never reach validation are not rejected messages, and
+	// made up methods share a label
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "BREW", "/send", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Result().StatusCode)
+	req, _ := http.NewRequest("POST", "/send", strings.NewReader("{}"))
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+	assert.Equal(t, float64(0), m.MessagesRejected.Value("method_not_allowed"))
+	assert.Equal(t, float64(0), m.MessagesRejected.Value("unauthorized"))
+	assert.Equal(t, uint64(1), m.RequestLatency.Count("/send", "other"))
+	assert.Equal(t, uint64(0), m.RequestLatency.Count("/send", "BREW"))
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeSupportRequest(t, "GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Result().Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, rr.Body.String(), "email_messages_accepted_total 1\n")
+	assert.Contains(t, rr.Body.String(), `email_messages_rejected_total{reason="validation_failed"} 1`)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "GET", "/metrics", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+}
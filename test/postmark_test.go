@@ -0,0 +1,321 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/postmark"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/templates"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type postmarkMessage struct {
+	To            string
+	Cc            string
+	Subject       string
+	TextBody      string
+	HtmlBody      string
+	Tag           string
+	Metadata      map[string]string
+	Headers       []struct{ Name, Value string }
+	Attachments   []struct{ Name, ContentType, ContentID string }
+	MessageStream string
+}
+
+// fakePostmark records the requests to a local stand-in of the Postmark API.
+// Messages to addresses starting with inactive@ are refused as inactive
+// recipients by the batch endpoint.
+type fakePostmark struct {
+	mu       sync.Mutex
+	singles  []postmarkMessage
+	batches  [][]postmarkMessage
+	status   int
+	response string
+	// shortFrom makes the batches from the given number on return one
+	// result too few, if set.
+	shortFrom int
+}
+
+func startFakePostmark(t *testing.T) (*fakePostmark, *postmark.PostmarkProvider) {
+	fake := &fakePostmark{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Postmark-Server-Token") != "server-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ErrorCode": 10, "Message": "No Account or Server API tokens were supplied in the HTTP headers."}`))
+			return
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if fake.status != 0 {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(fake.status)
+			w.Write([]byte(fake.response))
+			return
+		}
+		switch r.URL.Path {
+		case "/email":
+			var m postmarkMessage
+			json.NewDecoder(r.Body).Decode(&m)
+			fake.singles = append(fake.singles, m)
+			json.NewEncoder(w).Encode(map[string]interface{}{"To": m.To, "MessageID": "single-id", "ErrorCode": 0, "Message": "OK"})
+		case "/email/batch":
+			var batch []postmarkMessage
+			json.NewDecoder(r.Body).Decode(&batch)
+			fake.batches = append(fake.batches, batch)
+			responses := []map[string]interface{}{}
+			for i, m := range batch {
+				if strings.HasPrefix(m.To, "inactive@") {
+					responses = append(responses, map[string]interface{}{"ErrorCode": 406, "Message": "You tried to send to recipient(s) that have been marked as inactive."})
+					continue
+				}
+				responses = append(responses, map[string]interface{}{"MessageID": "batch-id-" + string(rune('a'+i)), "ErrorCode": 0, "Message": "OK"})
+			}
+			if fake.shortFrom > 0 && len(fake.batches) > fake.shortFrom {
+				responses = responses[1:]
+			}
+			json.NewEncoder(w).Encode(responses)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(api.Close)
+	provider := &postmark.PostmarkProvider{ServerToken: "server-token", BaseURL: api.URL}
+	assert.Nil(t, provider.Init())
+	return fake, provider
+}
+
+func TestPostmarkSend(t *testing.T) {
+	fake, provider := startFakePostmark(t)
+	email := makeFullEmail()
+	email.ID = "abc123"
+	email.Tags = []string{"welcome", "onboarding"}
+	email.Metadata = map[string]string{"order": "1234"}
+	email.Headers = map[string]string{"X-Campaign": "spring"}
+	id, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.Equal(t, "single-id", id)
+	if assert.Len(t, fake.singles, 1) {
+		m := fake.singles[0]
+		assert.Equal(t, `"Peter" <peter@example.com>`, m.Cc)
+		assert.Equal(t, "this is a subject", m.Subject)
+		assert.Equal(t, "this is a <em>body</em>", m.HtmlBody)
+		assert.Equal(t, "welcome", m.Tag)
+		assert.Equal(t, map[string]string{"order": "1234", "message_id": "abc123"}, m.Metadata)
+		assert.Equal(t, []struct{ Name, Value string }{{"X-Campaign", "spring"}}, m.Headers)
+		assert.Equal(t, "outbound", m.MessageStream)
+	}
+
+	email.Stream = emailprovider.StreamBroadcast
+	_, err = provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.Equal(t, "broadcast", fake.singles[1].MessageStream)
+}
+
+func TestPostmarkSendBatch(t *testing.T) {
+	fake, provider := startFakePostmark(t)
+	first, inactive := makeSimpleEmail(), makeSimpleEmail()
+	address, _ := emailprovider.MakeEmailAddress("", "inactive@example.com")
+	inactive.To = []emailprovider.EmailAddress{address}
+	results, err := provider.SendBatch(context.Background(), []emailprovider.Email{first, inactive})
+	assert.Nil(t, err)
+	assert.Len(t, fake.batches, 1)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "batch-id-a", results[0].TransmissionID)
+		assert.Nil(t, results[0].Err)
+		assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(results[1].Err))
+	}
+
+	// Batches larger than Postmark accepts are split
+	emails := make([]emailprovider.Email, postmark.MaxBatchSize+1)
+	for i := range emails {
+		emails[i] = makeSimpleEmail()
+	}
+	results, err = provider.SendBatch(context.Background(), emails)
+	assert.Nil(t, err)
+	assert.Len(t, results, len(emails))
+	if assert.Len(t, fake.batches, 3) {
+		assert.Len(t, fake.batches[1], postmark.MaxBatchSize)
+		assert.Len(t, fake.batches[2], 1)
+	}
+}
+
+func TestPostmarkBatchKeepsSentChunks(t *testing.T) {
+	fake, provider := startFakePostmark(t)
+	fake.shortFrom = 1
+	emails := make([]emailprovider.Email, postmark.MaxBatchSize+2)
+	for i := range emails {
+		emails[i] = makeSimpleEmail()
+	}
+	results, err := provider.SendBatch(context.Background(), emails)
+	// The first chunk was accepted, so only the emails of the second failed
+	assert.Nil(t, err)
+	if assert.Len(t, results, len(emails)) {
+		assert.Nil(t, results[postmark.MaxBatchSize-1].Err)
+		assert.Equal(t, emailprovider.FailureTransient, emailprovider.KindOf(results[postmark.MaxBatchSize].Err))
+		assert.NotNil(t, results[postmark.MaxBatchSize+1].Err)
+	}
+}
+
+func TestPostmarkFailureKinds(t *testing.T) {
+	fake, provider := startFakePostmark(t)
+	send := func(status int, response string) error {
+		fake.mu.Lock()
+		fake.status, fake.response = status, response
+		fake.mu.Unlock()
+		_, err := provider.Send(context.Background(), makeSimpleEmail())
+		return err
+	}
+	err := send(http.StatusUnprocessableEntity, `{"ErrorCode": 300, "Message": "Invalid 'To' address: 'not an address'."}`)
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	assert.Contains(t, err.Error(), "Invalid 'To' address")
+	err = send(http.StatusUnprocessableEntity, `{"ErrorCode": 300, "Message": "Provide either email TextBody or HtmlBody or both."}`)
+	assert.Equal(t, emailprovider.FailureRejected, emailprovider.KindOf(err))
+	err = send(http.StatusUnprocessableEntity, `{"ErrorCode": 406, "Message": "You tried to send to a recipient that has been marked as inactive."}`)
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	err = send(http.StatusUnprocessableEntity, `{"ErrorCode": 400, "Message": "The 'From' address you supplied is not a Sender Signature on your account."}`)
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	err = send(http.StatusUnprocessableEntity, `{"ErrorCode": 1235, "Message": "The message stream for the provided 'MessageStream' was not found."}`)
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	err = send(http.StatusTooManyRequests, `{"ErrorCode": 0, "Message": "Rate limit exceeded"}`)
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	assert.Equal(t, 30*time.Second, emailprovider.RetryAfter(err))
+	err = send(http.StatusServiceUnavailable, "")
+	assert.Equal(t, emailprovider.FailureTransient, emailprovider.KindOf(err))
+
+	send(0, "")
+	provider.ServerToken = "wrong"
+	_, err = provider.Send(context.Background(), makeSimpleEmail())
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+}
+
+// BatchingProvider records the batches and single sends it is handed, and
+// fails the emails to addresses in failing with a transient error.
+type BatchingProvider struct {
+	mu      sync.Mutex
+	batches [][]emailprovider.Email
+	singles []emailprovider.Email
+	failing map[string]bool
+}
+
+func (b *BatchingProvider) Init() error {
+	return nil
+}
+
+func (b *BatchingProvider) Name() string {
+	return "batching"
+}
+
+func (b *BatchingProvider) Send(ctx context.Context, m emailprovider.Email) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.singles = append(b.singles, m)
+	return "single", b.err(m)
+}
+
+func (b *BatchingProvider) SendBatch(ctx context.Context, emails []emailprovider.Email) ([]emailprovider.BatchResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, emails)
+	results := make([]emailprovider.BatchResult, len(emails))
+	for i, m := range emails {
+		results[i] = emailprovider.BatchResult{TransmissionID: "batch", Err: b.err(m)}
+	}
+	return results, nil
+}
+
+func (b *BatchingProvider) err(m emailprovider.Email) error {
+	if b.failing[m.To[0].Address()] {
+		return emailprovider.Fail(b.Name(), emailprovider.FailureTransient, errors.New("unavailable"))
+	}
+	return nil
+}
+
+func TestStrategiesSendBatches(t *testing.T) {
+	flaky, _ := emailprovider.MakeEmailAddress("", "flaky@example.com")
+	emails := []emailprovider.Email{makeSimpleEmail(), makeSimpleEmail(), makeSimpleEmail()}
+	emails[1].To = []emailprovider.EmailAddress{flaky}
+	strategies := map[string]func(providers ...emailprovider.Provider) emailsender.Strategy{
+		"circuitbreaker": func(providers ...emailprovider.Provider) emailsender.Strategy {
+			return &emailsender.CircuitBreakerSender{Providers: providers}
+		},
+		"priority": func(providers ...emailprovider.Provider) emailsender.Strategy {
+			return &emailsender.PrioritySender{Providers: providers}
+		},
+		"roundrobin": func(providers ...emailprovider.Provider) emailsender.Strategy {
+			return &emailsender.RoundRobinSender{Providers: providers}
+		},
+		"weighted": func(providers ...emailprovider.Provider) emailsender.Strategy {
+			weighted := []emailsender.WeightedProvider{{Provider: providers[0], Weight: 1}}
+			for _, p := range providers[1:] {
+				weighted = append(weighted, emailsender.WeightedProvider{Provider: p, Weight: 0})
+			}
+			return &emailsender.WeightedSender{Providers: weighted}
+		},
+	}
+	for name, makeStrategy := range strategies {
+		provider := &BatchingProvider{failing: map[string]bool{"flaky@example.com": true}}
+		strategy := makeStrategy(emailprovider.WithTimeout(provider, time.Second), SuccessProvider{})
+		errs := emailsender.SendBatch(context.Background(), strategy, emails)
+		assert.Equal(t, []error{nil, nil, nil}, errs, name)
+		assert.Len(t, provider.batches, 1, name)
+		// The failed email fails over without going back to the batch provider
+		assert.Empty(t, provider.singles, name)
+
+		// Without another provider, the email fails as the batch failed it
+		provider = &BatchingProvider{failing: map[string]bool{"flaky@example.com": true}}
+		strategy = makeStrategy(emailprovider.WithTimeout(provider, time.Second))
+		errs = emailsender.SendBatch(context.Background(), strategy, emails)
+		assert.Nil(t, errs[0], name)
+		assert.NotNil(t, errs[1], name)
+		assert.Empty(t, provider.singles, name)
+	}
+
+	// Strategies without batch support send one by one
+	sent := 0
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		sent++
+		return nil
+	}}
+	assert.Equal(t, []error{nil, nil, nil}, emailsender.SendBatch(context.Background(), strategy, emails))
+	assert.Equal(t, 3, sent)
+}
+
+func TestTemplatedSendUsesPostmarkBatch(t *testing.T) {
+	store, _ := openTestStore(t, templates.Open)
+	assert.Nil(t, store.Put(welcomeTemplate))
+	fake, provider := startFakePostmark(t)
+	strategy := &emailsender.CircuitBreakerSender{Providers: []emailprovider.Provider{emailprovider.WithTimeout(provider, time.Second)}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Templates: store}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"address": "test@test.com"},
+"to": [{"address": "thomas@test.dk"}, {"address": "peter@test.dk"}],
+"template": "welcome",
+"stream": "broadcast",
+"data": {"product": "Mail", "name": "friend"}
+}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Empty(t, fake.singles)
+	if assert.Len(t, fake.batches, 1) && assert.Len(t, fake.batches[0], 2) {
+		assert.Equal(t, "thomas@test.dk", fake.batches[0][0].To)
+		assert.Equal(t, "broadcast", fake.batches[0][1].MessageStream)
+	}
+
+	req = makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "thomas@test.dk"}], "subject": "hi", "stream": "marketing"}`))
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	assert.Equal(t, "stream", decodeProblem(t, rr).Errors[0].Field)
+}
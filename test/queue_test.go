@@ -0,0 +1,228 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/queue"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// CountingStrategy records every email it is asked to send, and fails the
+// first Failures attempts.
+type CountingStrategy struct {
+	Failures int
+	mu       sync.Mutex
+	sent     []emailprovider.Email
+	attempts int
+}
+
+func (c *CountingStrategy) Send(ctx context.Context, m emailprovider.Email) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	if c.attempts <= c.Failures {
+		return errors.New("Provider down")
+	}
+	c.sent = append(c.sent, m)
+	return nil
+}
+
+func (c *CountingStrategy) Sent() []emailprovider.Email {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]emailprovider.Email(nil), c.sent...)
+}
+
+func (c *CountingStrategy) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts
+}
+
+// openTestQueue opens a queue which retries right away. It is not closed
+// once the test is done, since the tests stop it themselves.
+func openTestQueue(t *testing.T) (*queue.Queue, string) {
+	q, path := openTestStore(t, queue.Open)
+	q.Backoff = func(attempt int) time.Duration { return time.Millisecond }
+	return q, path
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueDeliversEnqueuedEmail(t *testing.T) {
+	q, _ := openTestQueue(t)
+	strategy := &CountingStrategy{}
+	assert.Nil(t, q.Start(strategy, 2))
+	defer q.Stop()
+	id, err := q.Enqueue(makeSimpleEmail())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, id)
+	waitFor(t, func() bool { return len(strategy.Sent()) == 1 })
+	waitFor(t, func() bool { return q.Len() == 0 })
+	assert.Equal(t, "this is a subject", strategy.Sent()[0].Subject.String())
+}
+
+func TestQueueRetriesFailedEmail(t *testing.T) {
+	q, _ := openTestQueue(t)
+	strategy := &CountingStrategy{Failures: 2}
+	assert.Nil(t, q.Start(strategy, 1))
+	defer q.Stop()
+	q.Enqueue(makeSimpleEmail())
+	waitFor(t, func() bool { return len(strategy.Sent()) == 1 })
+	assert.Equal(t, 3, strategy.Attempts())
+}
+
+func TestQueueGivesUpAfterMaxAttempts(t *testing.T) {
+	q, _ := openTestQueue(t)
+	q.MaxAttempts = 3
+	strategy := &CountingStrategy{Failures: 100}
+	assert.Nil(t, q.Start(strategy, 1))
+	defer q.Stop()
+	q.Enqueue(makeSimpleEmail())
+	waitFor(t, func() bool { return q.Len() == 0 })
+	assert.Equal(t, 3, strategy.Attempts())
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	q, path := openTestQueue(t)
+	q.Enqueue(makeFullEmail())
+	q.Enqueue(makeSimpleEmail())
+	q.Stop()
+
+	restored, err := queue.Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, restored.Len())
+	strategy := &CountingStrategy{}
+	assert.Nil(t, restored.Start(strategy, 1))
+	defer restored.Stop()
+	waitFor(t, func() bool { return len(strategy.Sent()) == 2 })
+	for _, m := range strategy.Sent() {
+		if len(m.Bcc) > 0 {
+			assert.Equal(t, "thomas@example.com", m.Bcc[0].Address())
+			assert.Equal(t, "this is a <em>body</em>", m.HtmlBody.String())
+		}
+	}
+}
+
+func TestQueueDropsRecipientsSuppressedWhileQueued(t *testing.T) {
+	q, _ := openTestQueue(t)
+	tracker, _ := openTestStore(t, status.Open)
+	suppressions, _ := openTestStore(t, suppression.Open)
+	q.Tracker = tracker
+	q.Suppressions = suppressions
+	partly, _ := q.Enqueue(makeFullEmail())
+	// The cc-recipient bounces after the message was accepted
+	suppressions.Add(suppression.Entry{Address: "peter@example.com", Reason: suppression.ReasonBounce})
+	strategy := &CountingStrategy{}
+	assert.Nil(t, q.Start(strategy, 1))
+	defer q.Stop()
+	waitFor(t, func() bool { return q.Len() == 0 })
+	if assert.Len(t, strategy.Sent(), 1) {
+		assert.Empty(t, strategy.Sent()[0].Cc)
+		assert.Len(t, strategy.Sent()[0].Bcc, 1)
+	}
+	record, _ := tracker.Get(partly)
+	assert.Contains(t, states(record), status.Suppressed)
+
+	// Without a to-recipient left, the message fails
+	suppressions.Add(suppression.Entry{Address: "morten@example.com", Reason: suppression.ReasonComplaint})
+	wholly, _ := q.Enqueue(makeSimpleEmail())
+	waitFor(t, func() bool { return q.Len() == 0 })
+	assert.Len(t, strategy.Sent(), 1)
+	record, _ = tracker.Get(wholly)
+	assert.Equal(t, status.Failed, record.State)
+}
+
+func TestQueueCompactsWhileRunning(t *testing.T) {
+	q, path := openTestQueue(t)
+	q.CompactAfter = 3
+	strategy := &CountingStrategy{}
+	assert.Nil(t, q.Start(strategy, 1))
+	for i := 0; i < 4; i++ {
+		q.Enqueue(makeSimpleEmail())
+	}
+	waitFor(t, func() bool { return q.Len() == 0 })
+	q.Stop()
+
+	// The third message sent compacts the journal to the last message, which
+	// leaves at most its enqueue and done records, and the done record of the
+	// third message written after the compaction, instead of eight records.
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.True(t, len(lines) <= 3, "journal has %d records", len(lines))
+	restored, err := queue.Open(path)
+	assert.Nil(t, err)
+	defer restored.Stop()
+	assert.Equal(t, 0, restored.Len())
+}
+
+func TestQueueSendsGroupsAsBatches(t *testing.T) {
+	q, path := openTestQueue(t)
+	flaky, _ := emailprovider.MakeEmailAddress("", "flaky@example.com")
+	emails := []emailprovider.Email{makeSimpleEmail(), makeSimpleEmail(), makeSimpleEmail()}
+	emails[1].To = []emailprovider.EmailAddress{flaky}
+	ids, err := q.EnqueueGroup(emails, time.Time{}, "")
+	assert.Nil(t, err)
+	assert.Len(t, ids, 3)
+	q.Enqueue(makeSimpleEmail())
+	q.Stop()
+
+	// The group survives a restart
+	restored, err := queue.Open(path)
+	assert.Nil(t, err)
+	provider := &BatchingProvider{failing: map[string]bool{"flaky@example.com": true}}
+	strategy := &emailsender.PrioritySender{Providers: []emailprovider.Provider{provider, SuccessProvider{}}}
+	assert.Nil(t, restored.Start(strategy, 1))
+	defer restored.Stop()
+	waitFor(t, func() bool { return restored.Len() == 0 })
+	if assert.Len(t, provider.batches, 1) {
+		assert.Len(t, provider.batches[0], 3)
+	}
+	// The message outside the group is sent on its own, and the failed one
+	// of the batch fails over
+	assert.Len(t, provider.singles, 1)
+}
+
+func TestSendEnqueuesWhenQueueConfigured(t *testing.T) {
+	q, _ := openTestQueue(t)
+	defer q.Stop()
+	app := server.ServerApp{Keys: testKeys, Strategy: &CountingStrategy{}, Queue: q}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "test@test.dk"}],
+"subject": "hello",
+"body": "this works"
+}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	var response struct {
+		ID string `json:"id"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.NotEmpty(t, response.ID)
+	assert.Equal(t, 1, q.Len())
+}
@@ -0,0 +1,193 @@
+package test
+
+import (
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/ratelimit"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiterRefills(t *testing.T) {
+	clock := &testClock{now: time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)}
+	limiter := &ratelimit.Limiter{Rate: 1, Burst: 2, Now: clock.Now}
+	ok, _ := limiter.Allow("a")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a")
+	assert.True(t, ok)
+	ok, wait := limiter.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+	ok, _ = limiter.Allow("b")
+	assert.True(t, ok, "Keys share a bucket")
+	clock.Advance(time.Second)
+	ok, _ = limiter.Allow("a")
+	assert.True(t, ok)
+}
+
+func TestQuotasResetDaily(t *testing.T) {
+	quotas, _ := openTestStore(t, ratelimit.OpenQuotas)
+	clock := &testClock{now: time.Date(2018, 3, 1, 23, 0, 0, 0, time.UTC)}
+	quotas.Now = clock.Now
+	usage, ok, _ := quotas.Reserve("webshop", 2, 3, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 1, usage.DailyRemaining)
+	assert.Equal(t, -1, usage.MonthlyRemaining)
+	_, ok, wait := quotas.Reserve("webshop", 2, 3, 0)
+	assert.False(t, ok)
+	assert.Equal(t, time.Hour, wait)
+	clock.Advance(time.Hour)
+	usage, ok, _ = quotas.Reserve("webshop", 2, 3, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 4, usage.Month)
+}
+
+func TestQuotasMonthly(t *testing.T) {
+	quotas, _ := openTestStore(t, ratelimit.OpenQuotas)
+	clock := &testClock{now: time.Date(2018, 3, 31, 12, 0, 0, 0, time.UTC)}
+	quotas.Now = clock.Now
+	_, ok, _ := quotas.Reserve("webshop", 5, 0, 5)
+	assert.True(t, ok)
+	_, ok, wait := quotas.Reserve("webshop", 1, 0, 5)
+	assert.False(t, ok)
+	assert.Equal(t, 12*time.Hour, wait)
+}
+
+func TestQuotasPersist(t *testing.T) {
+	quotas, path := openTestStore(t, ratelimit.OpenQuotas)
+	quotas.Reserve("webshop", 3, 0, 0)
+	quotas.Close()
+
+	reopened, err := ratelimit.OpenQuotas(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	usage, ok, _ := reopened.Reserve("webshop", 1, 5, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 1, usage.DailyRemaining)
+}
+
+func TestQuotasCompactDaily(t *testing.T) {
+	quotas, path := openTestStore(t, ratelimit.OpenQuotas)
+	clock := &testClock{now: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)}
+	quotas.Now = clock.Now
+	for i := 0; i < 5; i++ {
+		quotas.Reserve("webshop", 1, 0, 0)
+	}
+	quotas.Release("webshop", 1, 0, 0)
+	clock.Advance(24 * time.Hour)
+	quotas.Reserve("webshop", 2, 0, 0)
+
+	// The usage of the earlier days of the month is kept as a single record
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"count":4`)
+		assert.Contains(t, lines[1], `"count":2`)
+	}
+}
+
+func TestSendQuotaExceeded(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	key, token, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	keys.SetQuotas(key.ID, 1, 0)
+	quotas, _ := openTestStore(t, ratelimit.OpenQuotas)
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error { return nil }}
+	app := server.ServerApp{Keys: keys, Strategy: strategy, Quotas: quotas}
+	send := func() *http.Response {
+		req := makeTokenRequest(t, token, "POST", "/send", strings.NewReader(
+			`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "hello", "body": "this works"}`))
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr.Result()
+	}
+	response := send()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "0", response.Header.Get("X-Quota-Daily-Remaining"))
+	response = send()
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.NotEqual(t, "", response.Header.Get("Retry-After"))
+}
+
+func TestQuotasRelease(t *testing.T) {
+	quotas, path := openTestStore(t, ratelimit.OpenQuotas)
+	quotas.Reserve("webshop", 3, 5, 0)
+	usage := quotas.Release("webshop", 2, 5, 0)
+	assert.Equal(t, 4, usage.DailyRemaining)
+	quotas.Close()
+
+	reopened, err := ratelimit.OpenQuotas(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	usage, ok, _ := reopened.Reserve("webshop", 4, 5, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 0, usage.DailyRemaining)
+}
+
+func TestFailedSendReleasesQuota(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	key, token, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	keys.SetQuotas(key.ID, 1, 0)
+	quotas, _ := openTestStore(t, ratelimit.OpenQuotas)
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		return emailprovider.Fail("test", emailprovider.FailureRejected, errors.New("refused"))
+	}}
+	app := server.ServerApp{Keys: keys, Strategy: strategy, Quotas: quotas}
+	send := func(path, body string) *http.Response {
+		req := makeTokenRequest(t, token, "POST", path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr.Result()
+	}
+	message := `{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "hello", "body": "this works"}`
+	for i := 0; i < 2; i++ {
+		response := send("/send", message)
+		assert.Equal(t, http.StatusUnprocessableEntity, response.StatusCode)
+		assert.Equal(t, "1", response.Header.Get("X-Quota-Daily-Remaining"))
+	}
+	response := send("/send/batch", "["+message+"]")
+	assert.Equal(t, http.StatusMultiStatus, response.StatusCode)
+	assert.Equal(t, "1", response.Header.Get("X-Quota-Daily-Remaining"))
+}
+
+func TestRateLimitPerKey(t *testing.T) {
+	app := server.ServerApp{
+		Keys:       testKeys,
+		Strategy:   testStrategy,
+		KeyLimiter: &ratelimit.Limiter{Rate: 0.1, Burst: 1},
+	}
+	req := makeSupportRequest(t, "GET", "/providers", nil)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Result().StatusCode)
+	assert.Equal(t, "10", rr.Result().Header.Get("Retry-After"))
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	app := server.ServerApp{
+		Keys:       testKeys,
+		Strategy:   testStrategy,
+		IPLimiter:  &ratelimit.Limiter{Rate: 1, Burst: 1},
+		TrustProxy: true,
+	}
+	request := func(ip string) int {
+		req, _ := http.NewRequest("GET", "/providers", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr.Result().StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.1"))
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1"))
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.2"))
+}
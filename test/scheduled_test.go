@@ -0,0 +1,191 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"github.com/mkj-gram/go_email_service/internal/queue"
+	"github.com/mkj-gram/go_email_service/internal/ratelimit"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueHoldsScheduledMessage(t *testing.T) {
+	q, _ := openTestQueue(t)
+	strategy := &CountingStrategy{}
+	assert.Nil(t, q.Start(strategy, 1))
+	defer q.Stop()
+	id, err := q.EnqueueAt(makeSimpleEmail(), time.Now().Add(100*time.Millisecond), "")
+	assert.Nil(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, strategy.Attempts(), "Sent a message before it was due")
+	m, ok := q.Scheduled(id)
+	assert.True(t, ok)
+	assert.Equal(t, id, m.ID)
+	waitFor(t, func() bool { return len(strategy.Sent()) == 1 })
+	_, ok = q.Scheduled(id)
+	assert.False(t, ok)
+}
+
+func TestQueueCancelsScheduledMessage(t *testing.T) {
+	q, _ := openTestQueue(t)
+	strategy := &CountingStrategy{}
+	assert.Nil(t, q.Start(strategy, 1))
+	defer q.Stop()
+	id, _ := q.EnqueueAt(makeSimpleEmail(), time.Now().Add(50*time.Millisecond), "")
+	assert.Nil(t, q.Cancel(id))
+	assert.Equal(t, queue.ErrUnknownMessage, q.Cancel(id))
+	assert.Equal(t, 0, q.Len())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, strategy.Attempts())
+
+	// Messages sent right away are not scheduled, and cannot be cancelled.
+	id, _ = q.Enqueue(makeSimpleEmail())
+	assert.Equal(t, queue.ErrUnknownMessage, q.Cancel(id))
+}
+
+func TestScheduledMessagesSurviveRestart(t *testing.T) {
+	q, path := openTestQueue(t)
+	sendAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	kept, _ := q.EnqueueAt(makeSimpleEmail(), sendAt, "")
+	cancelled, _ := q.EnqueueAt(makeSimpleEmail(), sendAt, "")
+	q.Cancel(cancelled)
+	q.Stop()
+
+	restored, err := queue.Open(path)
+	assert.Nil(t, err)
+	defer restored.Stop()
+	list := restored.ListScheduled()
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, kept, list[0].ID)
+		assert.True(t, sendAt.Equal(list[0].SendAt))
+	}
+}
+
+func TestSendScheduledEmail(t *testing.T) {
+	q, _ := openTestQueue(t)
+	defer q.Stop()
+	tracker, _ := openTestStore(t, status.Open)
+	q.Tracker = tracker
+	app := server.ServerApp{Keys: testKeys, Strategy: &CountingStrategy{}, Queue: q, Tracker: tracker}
+	sendAt := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "reminder", "body": "hi", "send_at": "`+sendAt+`"}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	var response struct {
+		ID     string `json:"id"`
+		SendAt string `json:"send_at"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, sendAt, response.SendAt)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "GET", "/scheduled/"+response.ID, nil))
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	var scheduled struct {
+		ID      string   `json:"id"`
+		To      []string `json:"to"`
+		Subject string   `json:"subject"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&scheduled))
+	assert.Equal(t, []string{"test@test.dk"}, scheduled.To)
+	assert.Equal(t, "reminder", scheduled.Subject)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "DELETE", "/scheduled/"+response.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	record, _ := tracker.Get(response.ID)
+	assert.Equal(t, status.Cancelled, record.State)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeAuthorizedRequest(t, "GET", "/scheduled/"+response.ID, nil))
+	assert.Equal(t, "not_found", decodeProblem(t, rr).Code)
+}
+
+func TestSendAtRequiresQueue(t *testing.T) {
+	app := server.ServerApp{Keys: testKeys, Strategy: testStrategy}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "reminder", "body": "hi", "send_at": "2030-01-01T10:00:00Z"}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	p := decodeProblem(t, rr)
+	assert.Equal(t, "validation_failed", p.Code)
+	assert.Equal(t, "send_at", p.Errors[0].Field)
+}
+
+func TestScheduledMessagesAreScopedToTheirKey(t *testing.T) {
+	q, _ := openTestQueue(t)
+	defer q.Stop()
+	_, otherToken, _ := testKeys.Create("other team", []apikeys.Scope{apikeys.ScopeSend})
+	_, adminToken, _ := testKeys.Create("scheduled admin", []apikeys.Scope{apikeys.ScopeAdmin})
+	app := server.ServerApp{Keys: testKeys, Strategy: &CountingStrategy{}, Queue: q}
+	sendAt := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "reminder", "body": "hi", "send_at": "`+sendAt+`"}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	var response struct {
+		ID string `json:"id"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+
+	for _, method := range []string{"GET", "DELETE"} {
+		rr = httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, makeTokenRequest(t, otherToken, method, "/scheduled/"+response.ID, nil))
+		assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode, method)
+	}
+	list := func(token string) []interface{} {
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, makeTokenRequest(t, token, "GET", "/scheduled", nil))
+		var messages []interface{}
+		json.NewDecoder(rr.Body).Decode(&messages)
+		return messages
+	}
+	assert.Len(t, list(otherToken), 0)
+	assert.Len(t, list(sendToken), 1)
+	assert.Len(t, list(adminToken), 1)
+	_, ok := q.Scheduled(response.ID)
+	assert.True(t, ok, "Another key cancelled the message")
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeTokenRequest(t, adminToken, "DELETE", "/scheduled/"+response.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+}
+
+func TestCancellingScheduledMessageReleasesQuota(t *testing.T) {
+	q, _ := openTestQueue(t)
+	defer q.Stop()
+	keys, _ := openTestStore(t, apikeys.Open)
+	key, token, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	keys.SetQuotas(key.ID, 1, 0)
+	quotas, _ := openTestStore(t, ratelimit.OpenQuotas)
+	app := server.ServerApp{Keys: keys, Strategy: &CountingStrategy{}, Queue: q, Quotas: quotas}
+	sendAt := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	send := func() *httptest.ResponseRecorder {
+		req := makeTokenRequest(t, token, "POST", "/send", strings.NewReader(
+			`{"from": {"address": "test@test.com"}, "to": [{"address": "test@test.dk"}], "subject": "reminder", "body": "hi", "send_at": "`+sendAt+`"}`))
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+	rr := send()
+	assert.Equal(t, http.StatusAccepted, rr.Result().StatusCode)
+	var response struct {
+		ID string `json:"id"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, http.StatusTooManyRequests, send().Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, makeTokenRequest(t, token, "DELETE", "/scheduled/"+response.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	assert.Equal(t, "1", rr.Result().Header.Get("X-Quota-Daily-Remaining"))
+	assert.Equal(t, http.StatusAccepted, send().Result().StatusCode)
+}
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"context"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWeightedSplitsTraffic(t *testing.T) {
+	primary := &SwitchProvider{}
+	secondary := &SwitchProvider{}
+	values := []float64{0.1, 0.5, 0.79, 0.8, 0.95}
+	sender := emailsender.WeightedSender{
+		Providers: []emailsender.WeightedProvider{
+			{Provider: primary, Weight: 80},
+			{Provider: secondary, Weight: 20},
+		},
+		Rand: func() float64 {
+			value := values[0]
+			values = values[1:]
+			return value
+		},
+	}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	}
+	assert.Equal(t, 3, primary.Called)
+	assert.Equal(t, 2, secondary.Called)
+}
+
+func TestWeightedFailsOverToOtherProviders(t *testing.T) {
+	primary := &SwitchProvider{Down: true}
+	secondary := &SwitchProvider{}
+	sender := emailsender.WeightedSender{
+		Providers: []emailsender.WeightedProvider{
+			{Provider: primary, Weight: 1},
+			{Provider: secondary, Weight: 0},
+		},
+	}
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 1, primary.Called)
+	assert.Equal(t, 1, secondary.Called)
+	primary.Down = false
+	for i := 0; i < 10; i++ {
+		sender.Send(context.Background(), makeSimpleEmail())
+	}
+	assert.Equal(t, 1, secondary.Called, "Sent through provider with zero weight")
+}
+
+func TestWeightedReportsErrorWhenAllFail(t *testing.T) {
+	sender := emailsender.WeightedSender{
+		Providers: []emailsender.WeightedProvider{
+			{Provider: FailProvider{}, Weight: 1},
+			{Provider: FailProvider{}, Weight: 1},
+		},
+	}
+	assert.NotNil(t, sender.Send(context.Background(), makeSimpleEmail()))
+}
+
+func TestParseWeights(t *testing.T) {
+	providers := []emailprovider.Provider{SuccessProvider{}, FailProvider{}}
+	weighted, err := emailsender.ParseWeights("success=80, fail = 0", providers)
+	assert.Nil(t, err)
+	if assert.Len(t, weighted, 2) {
+		assert.Equal(t, 80, weighted[0].Weight)
+		assert.Equal(t, 0, weighted[1].Weight)
+	}
+	weighted, err = emailsender.ParseWeights("", providers)
+	assert.Nil(t, err)
+	if assert.Len(t, weighted, 2) {
+		assert.Equal(t, 1, weighted[0].Weight)
+		assert.Equal(t, 1, weighted[1].Weight)
+	}
+	for _, spec := range []string{"success=-1", "success=high", "success", "sparkpost=80"} {
+		_, err := emailsender.ParseWeights(spec, providers)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestWeightedCountsNegativeWeightsAsZero(t *testing.T) {
+	primary := &SwitchProvider{}
+	secondary := &SwitchProvider{}
+	sender := emailsender.WeightedSender{
+		Providers: []emailsender.WeightedProvider{
+			{Provider: secondary, Weight: -5},
+			{Provider: primary, Weight: 1},
+		},
+		Rand: func() float64 { return 0 },
+	}
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, []error{nil}, sender.SendBatch(context.Background(), []emailprovider.Email{makeSimpleEmail()}))
+	assert.Equal(t, 2, primary.Called)
+	assert.Equal(t, 0, secondary.Called)
+}
+
+func TestPriorityPrefersPrimary(t *testing.T) {
+	primary := &SwitchProvider{}
+	secondary := &SwitchProvider{}
+	sender := emailsender.PrioritySender{
+		Providers:      []emailprovider.Provider{primary, secondary},
+		RecoveryWindow: time.Minute,
+	}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	}
+	assert.Equal(t, 3, primary.Called)
+	assert.Equal(t, 0, secondary.Called)
+}
+
+func TestPriorityReturnsToPrimaryAfterRecoveryWindow(t *testing.T) {
+	clock := &testClock{now: time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)}
+	primary := &SwitchProvider{Down: true}
+	secondary := &SwitchProvider{}
+	sender := emailsender.PrioritySender{
+		Providers:      []emailprovider.Provider{primary, secondary},
+		RecoveryWindow: 5 * time.Minute,
+		Now:            clock.Now,
+	}
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	primary.Down = false
+	clock.Advance(time.Minute)
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 1, primary.Called, "Returned to primary within recovery window")
+	assert.Equal(t, 2, secondary.Called)
+
+	clock.Advance(5 * time.Minute)
+	assert.Nil(t, sender.Send(context.Background(), makeSimpleEmail()))
+	assert.Equal(t, 2, primary.Called, "Did not return to primary after recovery window")
+	assert.Equal(t, 2, secondary.Called)
+}
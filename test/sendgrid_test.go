@@ -0,0 +1,39 @@
+package test
+
+import (
+	"context"
+	"github.com/mkj-gram/go_email_service/internal/sendgrid"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendGridSend(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/mail/send", r.URL.Path)
+		w.Header().Set("X-Message-Id", "14c5d75ce93")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+	provider := sendgrid.SendGridProvider{Host: api.URL}
+	id, err := provider.Send(context.Background(), makeSimpleEmail())
+	assert.Nil(t, err)
+	assert.Equal(t, "14c5d75ce93", id)
+}
+
+func TestSendGridSendHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer api.Close()
+	defer close(release)
+	provider := sendgrid.SendGridProvider{Host: api.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := provider.Send(ctx, makeSimpleEmail())
+	assert.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
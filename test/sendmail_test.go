@@ -0,0 +1,94 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/sendmail"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSendmail writes a script standing in for sendmail, which records its
+// arguments and the message in dir. Recipients starting with unknown@ exit
+// with EX_NOUSER, and those starting with slow@ make it hang.
+const fakeSendmail = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/args"
+cat > "$dir/message"
+case "$*" in
+*unknown@*) echo "unknown@example.com... User unknown" >&2; exit 67 ;;
+*tempfail@*) echo "queue is full" >&2; exit 75 ;;
+*config@*) exit 78 ;;
+*usage@*) echo "sendmail: illegal option" >&2; exit 64 ;;
+*slow@*) exec sleep 5 ;;
+esac
+exit 0
+`
+
+func makeFakeSendmail(t *testing.T) (*sendmail.SendmailProvider, string) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run the fake sendmail")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sendmail")
+	if err := ioutil.WriteFile(path, []byte(fakeSendmail), 0700); err != nil {
+		t.Fatal(err)
+	}
+	provider := &sendmail.SendmailProvider{Path: path, Args: []string{"-i"}}
+	assert.Nil(t, provider.Init())
+	return provider, dir
+}
+
+func TestSendmailPipesMessage(t *testing.T) {
+	provider, dir := makeFakeSendmail(t)
+	email := makeFullEmail()
+	email.ID = "abc123"
+	id, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(id, "<"), id)
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	assert.Equal(t, "-i -f morten@example.com -- morten@example.com peter@example.com thomas@example.com\n", string(args))
+	message, _ := ioutil.ReadFile(filepath.Join(dir, "message"))
+	assert.Contains(t, string(message), "Subject: this is a subject\r\n")
+	assert.NotContains(t, string(message), "thomas@example.com")
+}
+
+func TestSendmailExitCodes(t *testing.T) {
+	provider, _ := makeFakeSendmail(t)
+	send := func(address string) error {
+		email := makeSimpleEmail()
+		to, _ := emailprovider.MakeEmailAddress("", address)
+		email.To = []emailprovider.EmailAddress{to}
+		_, err := provider.Send(context.Background(), email)
+		return err
+	}
+	err := send("unknown@example.com")
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	var exit *sendmail.ExitError
+	if assert.True(t, errors.As(err, &exit)) {
+		assert.Equal(t, 67, exit.Code)
+		assert.Equal(t, "unknown@example.com... User unknown", exit.Stderr)
+	}
+	assert.Equal(t, emailprovider.FailureTransient, emailprovider.KindOf(send("tempfail@example.com")))
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(send("config@example.com")))
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(send("usage@example.com")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	email := makeSimpleEmail()
+	email.To[0], _ = emailprovider.MakeEmailAddress("", "slow@example.com")
+	_, err = provider.Send(ctx, email)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSendmailInit(t *testing.T) {
+	assert.NotNil(t, (&sendmail.SendmailProvider{Path: "/nonexistent/sendmail"}).Init())
+	t.Setenv("SENDMAIL_COMMAND", "sh -t")
+	assert.NotNil(t, (&sendmail.SendmailProvider{}).Init())
+}
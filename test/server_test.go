@@ -1,13 +1,20 @@
 package test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
 	"github.com/mkj-gram/go_email_service/internal/emailprovider"
 	"github.com/mkj-gram/go_email_service/internal/server"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -16,27 +23,67 @@ type TestStrategy struct {
 	sendHandler func(m emailprovider.Email) error
 }
 
-func (t TestStrategy) Send(m emailprovider.Email) error {
+func (t TestStrategy) Send(ctx context.Context, m emailprovider.Email) error {
 	return t.sendHandler(m)
 }
 
 var testStrategy = new(TestStrategy)
 
+// testKeys holds a key for each scope, shared by all tests.
+var testKeys *apikeys.Store
+var sendToken, supportToken string
+
 func TestMain(m *testing.M) {
-	app := server.ServerApp{testStrategy}
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testKeys, err = apikeys.Open(filepath.Join(dir, "keys"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, sendToken, _ = testKeys.Create("send", []apikeys.Scope{apikeys.ScopeSend})
+	_, supportToken, _ = testKeys.Create("support", []apikeys.Scope{apikeys.ScopeReadLogs})
+	app := server.ServerApp{Keys: testKeys, Strategy: testStrategy}
 	app.Serve()
-	m.Run()
+	code := m.Run()
+	testKeys.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
-func makeAuthorizedRequest(t *testing.T, method string, path string, body io.Reader) *http.Request {
+// openTestStore opens a journal-backed store with open, in a file of its own
+// under the temporary directory of the test, and returns it along with the
+// path of the file. Stores which can be closed are closed after the test.
+func openTestStore[S any](t *testing.T, open func(path string) (S, error)) (S, string) {
+	path := filepath.Join(t.TempDir(), "journal")
+	store, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closer, ok := any(store).(io.Closer); ok {
+		t.Cleanup(func() { closer.Close() })
+	}
+	return store, path
+}
+
+func makeTokenRequest(t *testing.T, token string, method string, path string, body io.Reader) *http.Request {
 	req, err := http.NewRequest(method, path, body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	req.Header.Add("Authorization", server.BasicAuthenticationCode)
+	req.Header.Add("Authorization", "Bearer "+token)
 	return req
 }
 
+func makeAuthorizedRequest(t *testing.T, method string, path string, body io.Reader) *http.Request {
+	return makeTokenRequest(t, sendToken, method, path, body)
+}
+
+func makeSupportRequest(t *testing.T, method string, path string, body io.Reader) *http.Request {
+	return makeTokenRequest(t, supportToken, method, path, body)
+}
+
 func TestSendRequireAuth(t *testing.T) {
 	req, err := http.NewRequest("POST", "/send", nil)
 	if err != nil {
@@ -130,3 +177,191 @@ func TestSendOk(t *testing.T) {
 	http.DefaultServeMux.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
 }
+
+func TestSendWithAttachments(t *testing.T) {
+	testStrategy.sendHandler = func(m emailprovider.Email) error {
+		assert.Len(t, m.Attachments, 2)
+		assert.Equal(t, "receipt.txt", m.Attachments[0].Filename())
+		assert.Equal(t, "thanks", string(m.Attachments[0].Data()))
+		assert.Equal(t, "logo", m.Attachments[1].ContentID())
+		return nil
+	}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "test@test.dk"}],
+"subject": "hello",
+"html": "<img src=\"cid:logo\">",
+"attachments": [
+  {"filename": "receipt.txt", "content_type": "text/plain", "content": "dGhhbmtz"},
+  {"filename": "logo.png", "content_type": "image/png", "content": "UE5H", "disposition": "inline", "content_id": "logo"}
+]
+}`))
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+}
+
+func TestSendRejectsInvalidAttachments(t *testing.T) {
+	for _, attachment := range []string{
+		`{"filename": "virus.exe", "content_type": "application/x-msdownload", "content": "TVo="}`,
+		`{"filename": "receipt.txt", "content_type": "text/plain", "content": "not base64!"}`,
+	} {
+		req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+			`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "test@test.dk"}],
+"subject": "hello",
+"body": "this works",
+"attachments": [`+attachment+`]
+}`))
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	}
+}
+
+func TestSendWithReplyToHeadersAndMetadata(t *testing.T) {
+	testStrategy.sendHandler = func(m emailprovider.Email) error {
+		assert.Equal(t, "support@example.com", m.ReplyTo.Address())
+		assert.Equal(t, "<mailto:unsubscribe@example.com>", m.Headers["List-Unsubscribe"])
+		assert.Equal(t, []string{"receipt"}, m.Tags)
+		assert.Equal(t, "1234", m.Metadata["order"])
+		return nil
+	}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "test@test.dk"}],
+"reply_to": {"name": "Support", "address": "support@example.com"},
+"subject": "hello",
+"body": "this works",
+"headers": {"list-unsubscribe": "<mailto:unsubscribe@example.com>"},
+"tags": ["receipt"],
+"metadata": {"order": "1234"}
+}`))
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+}
+
+func TestSendRejectsReservedHeaders(t *testing.T) {
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "test@test.dk"}],
+"subject": "hello",
+"body": "this works",
+"headers": {"Bcc": "someone@example.com"}
+}`))
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+// problemBody is the problem details body of a failed request.
+type problemBody struct {
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+	Errors []struct {
+		Field string `json:"field"`
+		Code  string `json:"code"`
+	} `json:"errors"`
+}
+
+func decodeProblem(t *testing.T, rr *httptest.ResponseRecorder) problemBody {
+	assert.Equal(t, "application/problem+json", rr.Result().Header.Get("Content-Type"))
+	var p problemBody
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, rr.Result().StatusCode, p.Status)
+	return p
+}
+
+func TestSendReportsEveryInvalidField(t *testing.T) {
+	testStrategy.sendHandler = func(m emailprovider.Email) error {
+		t.Error("Sent an invalid email")
+		return nil
+	}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [],
+"cc": [{"address": "ok@example.com"}, {"address": "not an address"}],
+"bcc": [{"address": ""}],
+"body": "this works",
+"tags": ["ok", ""],
+"attachments": [{"filename": "receipt.txt", "content_type": "text/plain", "content": "not base64!"}]
+}`))
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	p := decodeProblem(t, rr)
+	assert.Equal(t, "validation_failed", p.Code)
+	fields := map[string]string{}
+	for _, e := range p.Errors {
+		fields[e.Field] = e.Code
+	}
+	assert.Equal(t, map[string]string{
+		"subject":                emailprovider.CodeRequired,
+		"to":                     emailprovider.CodeRequired,
+		"cc[1].address":          emailprovider.CodeInvalidAddress,
+		"bcc[0].address":         emailprovider.CodeRequired,
+		"tags[1]":                emailprovider.CodeRequired,
+		"attachments[0].content": emailprovider.CodeInvalidEncoding,
+	}, fields)
+}
+
+func TestSendReportsTemplateConflicts(t *testing.T) {
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"address": "test@test.com"},
+"to": [{"address": "test@test.dk"}],
+"cc": [{"address": "cc@test.dk"}],
+"subject": "hello",
+"template": "welcome"
+}`))
+	rr := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rr, req)
+	p := decodeProblem(t, rr)
+	fields := []string{}
+	for _, e := range p.Errors {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{"cc", "subject", "template"}, fields)
+}
+
+func TestFailuresAreProblems(t *testing.T) {
+	for _, c := range []struct {
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{makeTokenRequest(t, "wrong.token", "POST", "/send", nil), http.StatusUnauthorized, "unauthorized"},
+		{makeSupportRequest(t, "POST", "/send", nil), http.StatusForbidden, "forbidden"},
+		{makeAuthorizedRequest(t, "GET", "/send", nil), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{makeAuthorizedRequest(t, "POST", "/send", strings.NewReader("{from: test,")), http.StatusBadRequest, "invalid_json"},
+		{makeAuthorizedRequest(t, "GET", "/thisisnotapath", nil), http.StatusNotFound, "not_found"},
+		{makeAuthorizedRequest(t, "GET", "/templates", nil), http.StatusNotFound, "not_enabled"},
+	} {
+		rr := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rr, c.req)
+		assert.Equal(t, c.status, rr.Result().StatusCode, c.req.URL.Path)
+		assert.Equal(t, c.code, decodeProblem(t, rr).Code, c.req.URL.Path)
+	}
+}
+
+func TestValidationErrorPaths(t *testing.T) {
+	_, err := emailprovider.MakeEmailAddress("", "not an address")
+	v, ok := err.(*emailprovider.ValidationError)
+	if assert.True(t, ok) {
+		assert.Equal(t, "cc[2].address", v.At("cc[2]").Field)
+		assert.Equal(t, "address", v.Field, "At modified the error")
+	}
+	_, err = emailprovider.MakeTags([]string{"ok", ""})
+	assert.Equal(t, "tags[1]", err.(*emailprovider.ValidationError).At("tags").Field)
+	_, err = emailprovider.MakeSubject("")
+	assert.Equal(t, "subject", err.(*emailprovider.ValidationError).At("subject").Field)
+}
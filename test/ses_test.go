@@ -0,0 +1,233 @@
+package test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/ses"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sesSigningTime = time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// verifySignature checks the SigV4 signature of a request to SES in
+// us-east-1, signed by the test credentials at sesSigningTime.
+func verifySignature(r *http.Request, body []byte) bool {
+	authorization := r.Header.Get("Authorization")
+	prefix := "AWS4-HMAC-SHA256 Credential=AKIDTEST/20180301/us-east-1/ses/aws4_request, SignedHeaders="
+	if !strings.HasPrefix(authorization, prefix) || r.Header.Get("X-Amz-Date") != "20180301T100000Z" {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(authorization, prefix), ", Signature=")
+	if len(parts) != 2 {
+		return false
+	}
+	signed := strings.Split(parts[0], ";")
+	if !sort.StringsAreSorted(signed) {
+		return false
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	bodyHash := sha256.Sum256(body)
+	canonical := "POST\n/v2/email/outbound-emails\n\n" + headers.String() + "\n" + parts[0] + "\n" + hex.EncodeToString(bodyHash[:])
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n20180301T100000Z\n20180301/us-east-1/ses/aws4_request\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4secret")
+	for _, data := range []string{"20180301", "us-east-1", "ses", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		key = mac.Sum(nil)
+	}
+	return hmac.Equal([]byte(hex.EncodeToString(key)), []byte(parts[1]))
+}
+
+// startFakeSES serves SendEmail of the SES v2 API, handing every request with
+// a valid signature to handle along with its decoded body.
+func startFakeSES(t *testing.T, handle func(w http.ResponseWriter, request map[string]interface{})) *ses.SESProvider {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.URL.Path != "/v2/email/outbound-emails" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !verifySignature(r, body) {
+			w.Header().Set("X-Amzn-ErrorType", "SignatureDoesNotMatch")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "The request signature we calculated does not match the signature you provided."}`))
+			return
+		}
+		var request map[string]interface{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Fatal(err)
+		}
+		handle(w, request)
+	}))
+	t.Cleanup(api.Close)
+	provider := &ses.SESProvider{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDTEST",
+		SecretAccessKey: "secret",
+		Endpoint:        api.URL,
+		Now:             func() time.Time { return sesSigningTime },
+	}
+	assert.Nil(t, provider.Init())
+	return provider
+}
+
+func TestSignerVector(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signer := ses.Signer{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+	}
+	signer.Sign(req, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+func TestSESSendSimple(t *testing.T) {
+	var request map[string]interface{}
+	provider := startFakeSES(t, func(w http.ResponseWriter, r map[string]interface{}) {
+		request = r
+		w.Write([]byte(`{"MessageId": "0100016fe0f8a1b2-abc"}`))
+	})
+	provider.ConfigurationSet = "transactional"
+	email := makeFullEmail()
+	email.ID = "abc123"
+	email.Tags = []string{"welcome"}
+	email.Metadata = map[string]string{"order": "12.34"}
+	id, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.Equal(t, "0100016fe0f8a1b2-abc", id)
+	assert.Equal(t, `"Morten" <morten@example.com>`, request["FromEmailAddress"])
+	assert.Equal(t, "transactional", request["ConfigurationSetName"])
+	destination := request["Destination"].(map[string]interface{})
+	assert.Equal(t, []interface{}{`"Peter" <peter@example.com>`}, destination["CcAddresses"])
+	simple := request["Content"].(map[string]interface{})["Simple"].(map[string]interface{})
+	assert.Equal(t, "this is a subject", simple["Subject"].(map[string]interface{})["Data"])
+	body := simple["Body"].(map[string]interface{})
+	assert.Equal(t, "this is a body", body["Text"].(map[string]interface{})["Data"])
+	assert.Equal(t, "this is a <em>body</em>", body["Html"].(map[string]interface{})["Data"])
+	tags := map[string]interface{}{}
+	for _, tag := range request["EmailTags"].([]interface{}) {
+		tag := tag.(map[string]interface{})
+		tags[tag["Name"].(string)] = tag["Value"]
+	}
+	assert.Equal(t, map[string]interface{}{"welcome": "true", "order": "12_34", "message_id": "abc123"}, tags)
+}
+
+func TestSESTagsFitLimits(t *testing.T) {
+	var request map[string]interface{}
+	provider := startFakeSES(t, func(w http.ResponseWriter, r map[string]interface{}) {
+		request = r
+		w.Write([]byte(`{"MessageId": "tagged"}`))
+	})
+	email := makeSimpleEmail()
+	email.Tags = []string{"a_b"}
+	email.Metadata = map[string]string{"a.b": "clash", "long": strings.Repeat("x", 300)}
+	_, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	tags := map[string]string{}
+	for _, tag := range request["EmailTags"].([]interface{}) {
+		tag := tag.(map[string]interface{})
+		name := tag["Name"].(string)
+		assert.NotContains(t, tags, name, "Duplicate tag name")
+		tags[name] = tag["Value"].(string)
+	}
+	assert.Equal(t, "true", tags["a_b"])
+	assert.Len(t, tags["long"], ses.MaxTagLength)
+}
+
+func TestSESSendRaw(t *testing.T) {
+	var request map[string]interface{}
+	provider := startFakeSES(t, func(w http.ResponseWriter, r map[string]interface{}) {
+		request = r
+		w.Write([]byte(`{"MessageId": "raw-id"}`))
+	})
+	provider.SessionToken = "session"
+	email := makeSimpleEmail()
+	bcc, _ := emailprovider.MakeEmailAddress("", "hidden@example.com")
+	email.Bcc = []emailprovider.EmailAddress{bcc}
+	attachment, _ := emailprovider.MakeAttachment("receipt.txt", "text/plain", []byte("thanks"), "", "")
+	email.Attachments = []emailprovider.Attachment{attachment}
+	id, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.Equal(t, "raw-id", id)
+	content := request["Content"].(map[string]interface{})
+	assert.Nil(t, content["Simple"])
+	// The raw message is base64 encoded, and Bcc is only in the destination
+	var raw struct{ Data []byte }
+	encoded, _ := json.Marshal(content["Raw"])
+	json.Unmarshal(encoded, &raw)
+	assert.Contains(t, string(raw.Data), "filename=receipt.txt")
+	assert.NotContains(t, string(raw.Data), "hidden@example.com")
+	destination := request["Destination"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"hidden@example.com"}, destination["BccAddresses"])
+}
+
+func TestSESFailureKinds(t *testing.T) {
+	status, errorType, message := 0, "", ""
+	provider := startFakeSES(t, func(w http.ResponseWriter, r map[string]interface{}) {
+		if errorType != "" {
+			w.Header().Set("X-Amzn-ErrorType", errorType+":http://internal.amazon.com/coral/com.amazonaws.sesv2/")
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	})
+	send := func(code int, kind, text string) error {
+		status, errorType, message = code, kind, text
+		_, err := provider.Send(context.Background(), makeSimpleEmail())
+		return err
+	}
+	err := send(http.StatusBadRequest, "BadRequestException", "Illegal address")
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	assert.Contains(t, err.Error(), "Illegal address")
+	err = send(http.StatusBadRequest, "MessageRejected", "Email address is not verified. The following identities failed the check in region US-EAST-1: morten@example.com")
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	err = send(http.StatusBadRequest, "MessageRejected", "Transaction failed: Message too large")
+	assert.Equal(t, emailprovider.FailureRejected, emailprovider.KindOf(err))
+	err = send(http.StatusBadRequest, "SendingPausedException", "Sending is paused for this account")
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	err = send(http.StatusTooManyRequests, "TooManyRequestsException", "Too many requests")
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	err = send(http.StatusBadRequest, "LimitExceededException", "Maximum sending rate exceeded")
+	assert.Equal(t, emailprovider.FailureRateLimited, emailprovider.KindOf(err))
+	err = send(http.StatusInternalServerError, "InternalFailure", "")
+	assert.Equal(t, emailprovider.FailureTransient, emailprovider.KindOf(err))
+
+	// A wrong secret fails the signature check
+	provider.SecretAccessKey = "wrong"
+	err = send(http.StatusOK, "", "")
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	assert.Contains(t, err.Error(), "SignatureDoesNotMatch")
+}
+
+func TestSESInit(t *testing.T) {
+	t.Setenv("SES_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	provider := &ses.SESProvider{}
+	assert.Nil(t, provider.Init())
+	assert.Equal(t, "https://email.eu-west-1.amazonaws.com", provider.Endpoint)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	assert.NotNil(t, (&ses.SESProvider{}).Init())
+}
@@ -0,0 +1,231 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/mimemessage"
+	"github.com/mkj-gram/go_email_service/internal/smtp"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeFullEmail() emailprovider.Email {
+	email := makeSimpleEmail()
+	cc, _ := emailprovider.MakeEmailAddress("Peter", "peter@example.com")
+	bcc, _ := emailprovider.MakeEmailAddress("Thomas", "thomas@example.com")
+	email.Cc = []emailprovider.EmailAddress{cc}
+	email.Bcc = []emailprovider.EmailAddress{bcc}
+	email.HtmlBody = emailprovider.MakeHtmlBody("this is a <em>body</em>")
+	return email
+}
+
+func TestMimeMessageHeaders(t *testing.T) {
+	data, err := mimemessage.Build(makeFullEmail())
+	assert.Nil(t, err)
+	message, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, `"Morten" <morten@example.com>`, message.Header.Get("From"))
+	assert.Equal(t, `"Peter" <peter@example.com>`, message.Header.Get("Cc"))
+	assert.Equal(t, "", message.Header.Get("Bcc"), "Bcc leaked into headers")
+	assert.NotEqual(t, "", message.Header.Get("Message-ID"))
+	assert.True(t, strings.HasPrefix(message.Header.Get("Content-Type"), "multipart/alternative"))
+	assert.NotContains(t, string(data), "thomas@example.com")
+}
+
+func TestMimeMessageReplyToAndCustomHeaders(t *testing.T) {
+	email := makeSimpleEmail()
+	email.ReplyTo, _ = emailprovider.MakeEmailAddress("Support", "support@example.com")
+	email.Headers = map[string]string{"X-Entity-Ref-Id": "1234"}
+	data, err := mimemessage.Build(email)
+	assert.Nil(t, err)
+	message, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, `"Support" <support@example.com>`, message.Header.Get("Reply-To"))
+	assert.Equal(t, "1234", message.Header.Get("X-Entity-Ref-Id"))
+}
+
+func TestMimeMessageSingleBody(t *testing.T) {
+	data, err := mimemessage.Build(makeSimpleEmail())
+	assert.Nil(t, err)
+	message, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", message.Header.Get("Content-Type"))
+}
+
+func TestMimeMessageAttachments(t *testing.T) {
+	email := makeFullEmail()
+	invoice, _ := emailprovider.MakeAttachment("invoice.pdf", "application/pdf", []byte("%PDF-1.4"), "", "")
+	logo, _ := emailprovider.MakeAttachment("logo.png", "image/png", []byte("PNG"), "inline", "logo")
+	email.Attachments = []emailprovider.Attachment{invoice, logo}
+	data, err := mimemessage.Build(email)
+	assert.Nil(t, err)
+	message, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.Nil(t, err)
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	mixed := multipart.NewReader(message.Body, params["boundary"])
+	related, err := mixed.NextPart()
+	assert.Nil(t, err)
+	mediaType, params, _ = mime.ParseMediaType(related.Header.Get("Content-Type"))
+	assert.Equal(t, "multipart/related", mediaType)
+	relatedReader := multipart.NewReader(related, params["boundary"])
+	alternative, _ := relatedReader.NextPart()
+	assert.True(t, strings.HasPrefix(alternative.Header.Get("Content-Type"), "multipart/alternative"))
+	inline, _ := relatedReader.NextPart()
+	assert.Equal(t, "<logo>", inline.Header.Get("Content-Id"))
+
+	attachment, err := mixed.NextPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "invoice.pdf", attachment.FileName())
+	content, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	assert.Equal(t, "%PDF-1.4", string(content))
+}
+
+func TestMimeMessageRecipients(t *testing.T) {
+	recipients := mimemessage.Recipients(makeFullEmail())
+	assert.Equal(t, []string{"morten@example.com", "peter@example.com", "thomas@example.com"}, recipients)
+}
+
+func TestSMTPRequiresHost(t *testing.T) {
+	provider := smtp.SMTPProvider{}
+	_, err := provider.Send(context.Background(), makeSimpleEmail())
+	assert.NotNil(t, err)
+}
+
+func TestSMTPAuthMechanisms(t *testing.T) {
+	for _, mechanism := range []string{"", smtp.AuthPlain, smtp.AuthLogin, smtp.AuthCRAMMD5} {
+		server, pool := startFakeSMTPServer(t, false)
+		provider := smtp.SMTPProvider{
+			Host:      server.Host,
+			Port:      server.Port,
+			Username:  server.Username,
+			Password:  server.Password,
+			Security:  smtp.SecurityStartTLS,
+			Auth:      mechanism,
+			TLSConfig: &tls.Config{RootCAs: pool, ServerName: server.Host},
+		}
+		assert.Nil(t, provider.Init())
+		_, err := provider.Send(context.Background(), makeFullEmail())
+		assert.Nil(t, err, "Sending with mechanism %q", mechanism)
+		messages := server.Messages()
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, server.Username, messages[0].AuthedAs)
+			assert.True(t, messages[0].TLS, "Did not upgrade with STARTTLS")
+			assert.Equal(t, "morten@example.com", messages[0].From)
+			assert.Equal(t, []string{"morten@example.com", "peter@example.com", "thomas@example.com"}, messages[0].Recipients)
+			assert.Contains(t, messages[0].Data, "Subject: this is a subject")
+		}
+	}
+}
+
+func TestSMTPImplicitTLS(t *testing.T) {
+	server, pool := startFakeSMTPServer(t, true)
+	provider := smtp.SMTPProvider{
+		Host:      server.Host,
+		Port:      server.Port,
+		Username:  server.Username,
+		Password:  server.Password,
+		Security:  smtp.SecurityTLS,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: server.Host},
+	}
+	_, err := provider.Send(context.Background(), makeSimpleEmail())
+	assert.Nil(t, err)
+	assert.Len(t, server.Messages(), 1)
+}
+
+func TestSMTPWrongPassword(t *testing.T) {
+	server, pool := startFakeSMTPServer(t, false)
+	provider := smtp.SMTPProvider{
+		Host:      server.Host,
+		Port:      server.Port,
+		Username:  server.Username,
+		Password:  "wrong",
+		Security:  smtp.SecurityStartTLS,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: server.Host},
+	}
+	_, err := provider.Send(context.Background(), makeSimpleEmail())
+	assert.NotNil(t, err)
+	assert.Equal(t, emailprovider.FailureAuth, emailprovider.KindOf(err))
+	assert.Len(t, server.Messages(), 0)
+}
+
+func TestSMTPRefusedRecipientIsPermanent(t *testing.T) {
+	server, _ := startFakeSMTPServer(t, false)
+	provider := smtp.SMTPProvider{Host: server.Host, Port: server.Port, Security: smtp.SecurityNone}
+	email := makeSimpleEmail()
+	email.To[0], _ = emailprovider.MakeEmailAddress("", "unknown@example.com")
+	_, err := provider.Send(context.Background(), email)
+	assert.Equal(t, emailprovider.FailureInvalidRecipient, emailprovider.KindOf(err))
+	assert.True(t, emailprovider.IsPermanent(err))
+}
+
+func TestSMTPReportsMessageID(t *testing.T) {
+	server, _ := startFakeSMTPServer(t, false)
+	provider := smtp.SMTPProvider{Host: server.Host, Port: server.Port, Security: smtp.SecurityNone}
+	email := makeSimpleEmail()
+	email.ID = "abc123"
+	id, err := provider.Send(context.Background(), email)
+	assert.Nil(t, err)
+	assert.Equal(t, "<abc123@example.com>", id)
+	assert.Contains(t, server.Messages()[0].Data, "Message-ID: <abc123@example.com>")
+}
+
+func TestSMTPIgnoresFailedQuitAfterDelivery(t *testing.T) {
+	server, _ := startFakeSMTPServer(t, false)
+	server.FailQuit = true
+	provider := smtp.SMTPProvider{Host: server.Host, Port: server.Port, Security: smtp.SecurityNone}
+	_, err := provider.Send(context.Background(), makeSimpleEmail())
+	assert.Nil(t, err)
+	assert.Len(t, server.Messages(), 1)
+}
+
+func TestSMTPPlainConnectionWithoutAuth(t *testing.T) {
+	server, _ := startFakeSMTPServer(t, false)
+	provider := smtp.SMTPProvider{
+		Host:     server.Host,
+		Port:     server.Port,
+		Security: smtp.SecurityNone,
+	}
+	_, err := provider.Send(context.Background(), makeSimpleEmail())
+	assert.Nil(t, err)
+	messages := server.Messages()
+	if assert.Len(t, messages, 1) {
+		assert.False(t, messages[0].TLS)
+		assert.Equal(t, "", messages[0].AuthedAs)
+	}
+}
+
+func TestSMTPGivesUpOnHangingRelay(t *testing.T) {
+	// The relay accepts connections but never greets.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	provider := smtp.SMTPProvider{Host: "127.0.0.1", Port: addr.Port, Security: smtp.SecurityNone}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = provider.Send(ctx, makeSimpleEmail())
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,168 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/emailsender"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func states(r status.Record) []status.State {
+	result := make([]status.State, 0, len(r.Events))
+	for _, e := range r.Events {
+		result = append(result, e.State)
+	}
+	return result
+}
+
+func TestStrategyReportsAttempts(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	sender := emailsender.RoundRobinSender{
+		Providers: []emailprovider.Provider{FailProvider{}, SuccessProvider{}},
+		Observer:  tracker,
+	}
+	email := makeSimpleEmail()
+	email.ID = "message-1"
+	assert.Nil(t, sender.Send(context.Background(), email))
+	record, ok := tracker.Get("message-1")
+	assert.True(t, ok)
+	assert.Equal(t, []status.State{status.Attempted, status.ProviderAccepted}, states(record))
+	assert.Equal(t, "fail", record.Events[0].Provider)
+	assert.Equal(t, "Some error here", record.Events[0].Detail)
+	assert.Equal(t, "success-id", record.Events[1].TransmissionID)
+	assert.Equal(t, status.ProviderAccepted, record.State)
+	id, ok := tracker.LookupTransmission("success", "success-id")
+	assert.True(t, ok)
+	assert.Equal(t, "message-1", id)
+}
+
+func TestTrackerSurvivesRestart(t *testing.T) {
+	tracker, path := openTestStore(t, status.Open)
+	tracker.Record("message-1", status.Event{State: status.Accepted})
+	tracker.Record("message-1", status.Event{State: status.Delivered})
+	tracker.Close()
+	restored, err := status.Open(path)
+	assert.Nil(t, err)
+	defer restored.Close()
+	record, ok := restored.Get("message-1")
+	assert.True(t, ok)
+	assert.Equal(t, []status.State{status.Accepted, status.Delivered}, states(record))
+}
+
+func TestTrackerStateIgnoresEventsOutOfOrder(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	at := time.Unix(1519898400, 0)
+	tracker.Record("message-1", status.Event{State: status.Queued, Time: at})
+	tracker.Record("message-1", status.Event{State: status.Attempted, Time: at.Add(time.Second)})
+	tracker.Record("message-1", status.Event{State: status.Queued, Time: at.Add(2 * time.Second)})
+	record, _ := tracker.Get("message-1")
+	assert.Equal(t, status.Queued, record.State)
+
+	tracker.Record("message-1", status.Event{State: status.ProviderAccepted, Time: at.Add(3 * time.Second)})
+	tracker.Record("message-1", status.Event{State: status.Opened, Time: at.Add(5 * time.Second)})
+	// The delivery is reported after the open
+	tracker.Record("message-1", status.Event{State: status.Delivered, Time: at.Add(4 * time.Second)})
+	record, _ = tracker.Get("message-1")
+	assert.Equal(t, status.Opened, record.State)
+	assert.Equal(t, []status.State{status.Queued, status.Attempted, status.Queued, status.ProviderAccepted, status.Delivered, status.Opened}, states(record))
+}
+
+func TestTrackerCompactsExpiredMessages(t *testing.T) {
+	tracker, path := openTestStore(t, status.Open)
+	clock := &testClock{now: time.Unix(1519898400, 0)}
+	tracker.Now = clock.Now
+	tracker.Retention = time.Hour
+	tracker.Record("old", status.Event{State: status.ProviderAccepted, Provider: "success", TransmissionID: "old-id"})
+	clock.Advance(30 * time.Minute)
+	tracker.Record("new", status.Event{State: status.Accepted})
+	clock.Advance(31 * time.Minute)
+	assert.Nil(t, tracker.Compact())
+	_, ok := tracker.Get("old")
+	assert.False(t, ok)
+	_, ok = tracker.LookupTransmission("success", "old-id")
+	assert.False(t, ok)
+	tracker.Close()
+
+	restored, err := status.Open(path)
+	assert.Nil(t, err)
+	defer restored.Close()
+	_, ok = restored.Get("old")
+	assert.False(t, ok)
+	record, ok := restored.Get("new")
+	assert.True(t, ok)
+	assert.Equal(t, status.Accepted, record.State)
+}
+
+func TestQueueRecordsLifecycle(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	q, _ := openTestQueue(t)
+	q.Tracker = tracker
+	q.MaxAttempts = 2
+	assert.Nil(t, q.Start(&CountingStrategy{Failures: 100}, 1))
+	defer q.Stop()
+	email := makeSimpleEmail()
+	email.ID = "message-1"
+	q.Enqueue(email)
+	waitFor(t, func() bool {
+		record, _ := tracker.Get("message-1")
+		return record.State == status.Failed
+	})
+	record, _ := tracker.Get("message-1")
+	assert.Equal(t, []status.State{status.Queued, status.Queued, status.Failed}, states(record))
+}
+
+func TestMessageEndpoint(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	q, _ := openTestQueue(t)
+	defer q.Stop()
+	q.Tracker = tracker
+	app := server.ServerApp{Keys: testKeys, Queue: q, Tracker: tracker}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "test@test.dk"}],
+"subject": "hello",
+"body": "this works"
+}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	var accepted struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&accepted)
+
+	req = makeSupportRequest(t, "GET", "/messages/"+accepted.ID, nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	var record status.Record
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&record))
+	assert.Equal(t, accepted.ID, record.ID)
+	assert.Equal(t, []status.State{status.Accepted, status.Queued}, states(record))
+}
+
+func TestMessageEndpointUnknownMessage(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	app := server.ServerApp{Keys: testKeys, Tracker: tracker}
+	req := makeSupportRequest(t, "GET", "/messages/nothere", nil)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+}
+
+func TestMessageEndpointRequiresReadLogsScope(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	app := server.ServerApp{Keys: testKeys, Tracker: tracker}
+	req := makeAuthorizedRequest(t, "GET", "/messages/nothere", nil)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+}
@@ -0,0 +1,320 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mkj-gram/go_email_service/internal/apikeys"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/sendgrid"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/sparkpost"
+	"github.com/mkj-gram/go_email_service/internal/suppression"
+	"github.com/mkj-gram/go_email_service/internal/webhooks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSuppressionStore(t *testing.T) {
+	store, path := openTestStore(t, suppression.Open)
+	assert.Nil(t, store.Add(suppression.Entry{Address: "Peter@Example.com", Reason: suppression.ReasonBounce, Source: "sparkpost"}))
+	assert.Nil(t, store.Add(suppression.Entry{Address: "thomas@example.com", Reason: suppression.ReasonManual}))
+	assert.NotNil(t, store.Add(suppression.Entry{Address: "anders@example.com"}))
+	entry, ok := store.Get("peter@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "peter@example.com", entry.Address)
+	assert.False(t, entry.Time.IsZero())
+	ok, err := store.Remove("THOMAS@example.com")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	store.Close()
+
+	reopened, err := suppression.Open(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	list := reopened.List()
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "peter@example.com", list[0].Address)
+		assert.Equal(t, "sparkpost", list[0].Source)
+	}
+}
+
+func TestSuppressionFilter(t *testing.T) {
+	store, _ := openTestStore(t, suppression.Open)
+	store.Add(suppression.Entry{Address: "peter@example.com", Reason: suppression.ReasonComplaint})
+	peter, _ := emailprovider.MakeEmailAddress("Peter", "PETER@example.com")
+	morten, _ := emailprovider.MakeEmailAddress("Morten", "morten@example.com")
+	kept, dropped := store.Filter([]emailprovider.EmailAddress{peter, morten})
+	assert.Equal(t, []emailprovider.EmailAddress{morten}, kept)
+	assert.Equal(t, []string{"PETER@example.com"}, dropped)
+}
+
+func TestSendStripsSuppressedRecipients(t *testing.T) {
+	store, _ := openTestStore(t, suppression.Open)
+	store.Add(suppression.Entry{Address: "peter@test.dk", Reason: suppression.ReasonBounce})
+	var sent emailprovider.Email
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		sent = m
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Suppressions: store}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "thomas@test.dk"}],
+"cc": [{"name": "peter", "address": "peter@test.dk"}],
+"subject": "hello",
+"body": "this works"
+}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	var response struct {
+		Suppressed []string `json:"suppressed"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, []string{"peter@test.dk"}, response.Suppressed)
+	assert.Len(t, sent.Cc, 0)
+	assert.Len(t, sent.To, 1)
+}
+
+func TestSendRejectsWhenAllRecipientsSuppressed(t *testing.T) {
+	store, _ := openTestStore(t, suppression.Open)
+	store.Add(suppression.Entry{Address: "thomas@test.dk", Reason: suppression.ReasonBounce})
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		t.Error("Sent to a suppressed recipient")
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Suppressions: store}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "thomas@test.dk"}], "subject": "hello", "body": "this works"}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Result().StatusCode)
+}
+
+func TestPermanentFailuresAreSuppressed(t *testing.T) {
+	batch := `[
+{"event": "bounce", "email": "hard@example.com", "timestamp": 1519898402, "sg_message_id": "14c5d75ce93.filter0001", "type": "bounce", "reason": "550 5.1.1 User unknown"},
+{"event": "bounce", "email": "blocked@example.com", "timestamp": 1519898402, "sg_message_id": "14c5d75ce93.filter0001", "type": "blocked", "reason": "421 Try again later"},
+{"event": "spamreport", "email": "angry@example.com", "timestamp": 1519898403, "sg_message_id": "14c5d75ce93.filter0001"}
+]`
+	private, public := makeWebhookKey(t)
+	store, _ := openTestStore(t, suppression.Open)
+	app := server.ServerApp{SendGridWebhookKey: public, Suppressions: store}
+	signature, timestamp := signSendGrid(t, private, batch)
+	req, _ := http.NewRequest("POST", "/webhooks/sendgrid", strings.NewReader(batch))
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Signature", signature)
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	entry, ok := store.Get("hard@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, suppression.ReasonBounce, entry.Reason)
+	assert.Equal(t, "sendgrid", entry.Source)
+	_, ok = store.Get("blocked@example.com")
+	assert.False(t, ok, "Suppressed a soft bounce")
+	entry, ok = store.Get("angry@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, suppression.ReasonComplaint, entry.Reason)
+}
+
+func TestSparkPostSoftBounceIsNotPermanent(t *testing.T) {
+	events, err := webhooks.ParseSparkPost([]byte(`[
+{"msys": {"message_event": {"type": "bounce", "rcpt_to": "full@example.com", "bounce_class": "22", "timestamp": "1519898402"}}},
+{"msys": {"message_event": {"type": "bounce", "rcpt_to": "gone@example.com", "bounce_class": "10", "timestamp": "1519898402"}}}
+]`))
+	assert.Nil(t, err)
+	if assert.Len(t, events, 2) {
+		assert.False(t, events[0].Permanent)
+		assert.True(t, events[1].Permanent)
+	}
+}
+
+func TestSuppressionsEndpoint(t *testing.T) {
+	keys, _ := openTestStore(t, apikeys.Open)
+	_, admin, _ := keys.Create("admin", []apikeys.Scope{apikeys.ScopeAdmin})
+	store, _ := openTestStore(t, suppression.Open)
+	app := server.ServerApp{Keys: keys, Suppressions: store}
+
+	_, sender, _ := keys.Create("webshop", []apikeys.Scope{apikeys.ScopeSend})
+	req := makeTokenRequest(t, sender, "GET", "/suppressions", nil)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+
+	req = makeTokenRequest(t, admin, "PUT", "/suppressions/peter@example.com", strings.NewReader(`{"reason": "manual"}`))
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	entry, ok := store.Get("peter@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "api:admin", entry.Source)
+
+	req = makeTokenRequest(t, admin, "PUT", "/suppressions/not-an-address", strings.NewReader(""))
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	req = makeTokenRequest(t, admin, "GET", "/suppressions", nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	var list []suppression.Entry
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&list))
+	assert.Len(t, list, 1)
+
+	req = makeTokenRequest(t, admin, "DELETE", "/suppressions/peter@example.com", nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	_, ok = store.Get("peter@example.com")
+	assert.False(t, ok)
+}
+
+type fakeList struct {
+	name    string
+	entries []suppression.Entry
+	pushed  []suppression.Entry
+	err     error
+}
+
+func (f *fakeList) Name() string {
+	return f.name
+}
+
+func (f *fakeList) Suppressions() ([]suppression.Entry, error) {
+	return f.entries, f.err
+}
+
+func (f *fakeList) Suppress(entries []suppression.Entry) error {
+	f.pushed = append(f.pushed, entries...)
+	return nil
+}
+
+func addresses(entries []suppression.Entry) []string {
+	list := []string{}
+	for _, e := range entries {
+		list = append(list, e.Address)
+	}
+	return list
+}
+
+func TestSyncMergesProviderLists(t *testing.T) {
+	store, _ := openTestStore(t, suppression.Open)
+	store.Add(suppression.Entry{Address: "local@example.com", Reason: suppression.ReasonManual, Source: "api:admin"})
+	first := &fakeList{name: "first", entries: []suppression.Entry{
+		{Address: "Bounced@example.com", Reason: suppression.ReasonBounce},
+	}}
+	second := &fakeList{name: "second", entries: []suppression.Entry{
+		{Address: "angry@example.com", Reason: suppression.ReasonComplaint},
+		{Address: "local@example.com", Reason: suppression.ReasonManual},
+	}}
+	broken := &fakeList{name: "broken", err: errors.New("unavailable")}
+	syncer := &suppression.Syncer{Store: store, Lists: []suppression.List{first, second, broken}}
+
+	err := syncer.Sync()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "broken")
+	assert.Equal(t, []string{"angry@example.com", "bounced@example.com", "local@example.com"}, addresses(store.List()))
+	entry, _ := store.Get("bounced@example.com")
+	assert.Equal(t, "first", entry.Source)
+	assert.Equal(t, []string{"angry@example.com", "local@example.com"}, addresses(first.pushed))
+	assert.Equal(t, []string{"bounced@example.com"}, addresses(second.pushed))
+	assert.Len(t, broken.pushed, 0)
+}
+
+func TestSparkPostSuppressionSync(t *testing.T) {
+	var upserted struct {
+		Recipients []struct {
+			Recipient string `json:"recipient"`
+			Type      string `json:"type"`
+		} `json:"recipients"`
+	}
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("cursor") == "":
+			fmt.Fprint(w, `{"results": [{"recipient": "angry@example.com", "source": "Spam Complaint", "type": "non_transactional", "created": "2018-03-01T10:00:00+00:00"}],
+"links": [{"href": "/api/v1/suppression-list?cursor=next", "rel": "next"}]}`)
+		case r.Method == "GET":
+			fmt.Fprint(w, `{"results": [{"recipient": "gone@example.com", "source": "Bounce Rule", "type": "transactional"}]}`)
+		case r.Method == "PUT":
+			json.NewDecoder(r.Body).Decode(&upserted)
+			fmt.Fprint(w, `{"results": {"message": "Suppression List successfully updated"}}`)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer api.Close()
+	provider := sparkpost.SparkPostProvider{BaseURL: api.URL, HTTPClient: api.Client()}
+	assert.Nil(t, provider.Init())
+
+	entries, err := provider.Suppressions()
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "angry@example.com", entries[0].Address)
+		assert.Equal(t, suppression.ReasonComplaint, entries[0].Reason)
+		assert.Equal(t, "sparkpost", entries[0].Source)
+		assert.Equal(t, 2018, entries[0].Time.Year())
+		assert.Equal(t, suppression.ReasonBounce, entries[1].Reason)
+	}
+
+	assert.Nil(t, provider.Suppress([]suppression.Entry{{Address: "peter@example.com", Reason: suppression.ReasonManual}}))
+	if assert.Len(t, upserted.Recipients, 2) {
+		assert.Equal(t, "peter@example.com", upserted.Recipients[0].Recipient)
+		assert.Equal(t, "transactional", upserted.Recipients[0].Type)
+		assert.Equal(t, "non_transactional", upserted.Recipients[1].Type)
+	}
+}
+
+func TestSendGridSuppressionSync(t *testing.T) {
+	var global struct {
+		RecipientEmails []string `json:"recipient_emails"`
+	}
+	var pushed []int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v3/suppression/bounces":
+			fmt.Fprint(w, `[{"email": "gone@example.com", "created": 1519898400, "reason": "550 5.1.1 User unknown"}]`)
+		case "GET /v3/suppression/spam_reports":
+			fmt.Fprint(w, `[{"email": "angry@example.com", "created": 1519898400}]`)
+		case "GET /v3/suppression/unsubscribes":
+			fmt.Fprint(w, `[]`)
+		case "POST /v3/asm/suppressions/global":
+			json.NewDecoder(r.Body).Decode(&global)
+			pushed = append(pushed, len(global.RecipientEmails))
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"recipient_emails": []}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+	provider := sendgrid.SendGridProvider{Host: api.URL}
+
+	entries, err := provider.Suppressions()
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "gone@example.com", entries[0].Address)
+		assert.Equal(t, suppression.ReasonBounce, entries[0].Reason)
+		assert.Equal(t, int64(1519898400), entries[0].Time.Unix())
+		assert.Equal(t, suppression.ReasonComplaint, entries[1].Reason)
+	}
+
+	assert.Nil(t, provider.Suppress([]suppression.Entry{{Address: "peter@example.com", Reason: suppression.ReasonManual}}))
+	assert.Equal(t, []string{"peter@example.com"}, global.RecipientEmails)
+
+	// Large lists are pushed in batches of 1000
+	pushed = nil
+	many := make([]suppression.Entry, 2500)
+	for i := range many {
+		many[i] = suppression.Entry{Address: fmt.Sprintf("user%d@example.com", i), Reason: suppression.ReasonManual}
+	}
+	assert.Nil(t, provider.Suppress(many))
+	assert.Equal(t, []int{1000, 1000, 500}, pushed)
+}
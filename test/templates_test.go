@@ -0,0 +1,192 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mkj-gram/go_email_service/internal/emailprovider"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/templates"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var welcomeTemplate = templates.Template{
+	ID:      "welcome",
+	Subject: "Welcome, {{.name}}",
+	Text:    "Hi {{.name}}, welcome to {{.product}}.",
+	Html:    "<p>Hi {{.name}}, welcome to {{.product}}.</p>",
+}
+
+func TestTemplateRenderEscapesHtml(t *testing.T) {
+	rendered, err := welcomeTemplate.Render(map[string]interface{}{"name": "<b>Bo</b>", "product": "Mail"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Welcome, <b>Bo</b>", rendered.Subject)
+	assert.Equal(t, "Hi <b>Bo</b>, welcome to Mail.", rendered.Text)
+	assert.Equal(t, "<p>Hi &lt;b&gt;Bo&lt;/b&gt;, welcome to Mail.</p>", rendered.Html)
+}
+
+func TestTemplateRenderRequiresAllKeys(t *testing.T) {
+	_, err := welcomeTemplate.Render(map[string]interface{}{"name": "Bo"})
+	assert.NotNil(t, err)
+}
+
+func TestTemplateValidation(t *testing.T) {
+	assert.Nil(t, welcomeTemplate.Validate())
+	broken := welcomeTemplate
+	broken.Html = "{{.name"
+	assert.NotNil(t, broken.Validate())
+	noBody := templates.Template{ID: "empty", Subject: "hello"}
+	assert.NotNil(t, noBody.Validate())
+	badID := welcomeTemplate
+	badID.ID = "../welcome"
+	assert.NotNil(t, badID.Validate())
+}
+
+func TestTemplateStorePersists(t *testing.T) {
+	store, path := openTestStore(t, templates.Open)
+	assert.Nil(t, store.Put(welcomeTemplate))
+	receipt := welcomeTemplate
+	receipt.ID = "receipt"
+	assert.Nil(t, store.Put(receipt))
+	ok, err := store.Delete("receipt")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	store.Close()
+
+	reopened, err := templates.Open(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, []templates.Template{welcomeTemplate}, reopened.List())
+}
+
+func TestTemplatesEndpoint(t *testing.T) {
+	store, _ := openTestStore(t, templates.Open)
+	app := server.ServerApp{Keys: testKeys, Templates: store}
+	req := makeAuthorizedRequest(t, "PUT", "/templates/welcome", strings.NewReader(
+		`{"subject": "Welcome, {{.name}}", "text": "Hi {{.name}}"}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+
+	req = makeAuthorizedRequest(t, "GET", "/templates/welcome", nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	var stored templates.Template
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, "welcome", stored.ID)
+
+	req = makeAuthorizedRequest(t, "PUT", "/templates/broken", strings.NewReader(
+		`{"subject": "{{.name", "text": "Hi"}`))
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	req = makeAuthorizedRequest(t, "DELETE", "/templates/welcome", nil)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Result().StatusCode)
+	_, ok := store.Get("welcome")
+	assert.False(t, ok)
+}
+
+func TestSendWithTemplate(t *testing.T) {
+	store, _ := openTestStore(t, templates.Open)
+	assert.Nil(t, store.Put(welcomeTemplate))
+	var mu sync.Mutex
+	sent := []emailprovider.Email{}
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, m)
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Templates: store}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "thomas@test.dk"}, {"name": "peter", "address": "peter@test.dk"}],
+"template": "welcome",
+"data": {"product": "Mail", "name": "friend"},
+"recipient_data": {"thomas@test.dk": {"name": "Thomas"}}
+}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	var response struct {
+		IDs []string `json:"ids"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Len(t, response.IDs, 2)
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, "Welcome, Thomas", sent[0].Subject.String())
+		assert.Equal(t, "thomas@test.dk", sent[0].To[0].Address())
+		assert.Equal(t, "Hi friend, welcome to Mail.", sent[1].Body)
+		assert.Len(t, sent[1].To, 1)
+		assert.NotEqual(t, sent[0].ID, sent[1].ID)
+	}
+}
+
+func TestSendWithTemplateReportsPartialFailure(t *testing.T) {
+	store, _ := openTestStore(t, templates.Open)
+	assert.Nil(t, store.Put(welcomeTemplate))
+	strategy := &TestStrategy{sendHandler: func(m emailprovider.Email) error {
+		if m.To[0].Address() == "peter@test.dk" {
+			return emailprovider.Fail("test", emailprovider.FailureInvalidRecipient, errors.New("Mailbox unavailable"))
+		}
+		return nil
+	}}
+	app := server.ServerApp{Keys: testKeys, Strategy: strategy, Templates: store}
+	req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(
+		`{
+"from": {"name": "anders", "address": "test@test.com"},
+"to": [{"name": "thomas", "address": "thomas@test.dk"}, {"name": "peter", "address": "peter@test.dk"}],
+"template": "welcome",
+"data": {"product": "Mail", "name": "friend"}
+}`))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusMultiStatus, rr.Result().StatusCode)
+	var response struct {
+		Accepted int `json:"accepted"`
+		Failed   int `json:"failed"`
+		Results  []struct {
+			Index int    `json:"index"`
+			ID    string `json:"id"`
+			Error *struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		} `json:"results"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, 1, response.Accepted)
+	assert.Equal(t, 1, response.Failed)
+	if assert.Len(t, response.Results, 2) {
+		assert.NotEmpty(t, response.Results[0].ID)
+		assert.Nil(t, response.Results[0].Error)
+		assert.Equal(t, 1, response.Results[1].Index)
+		if assert.NotNil(t, response.Results[1].Error) {
+			assert.Equal(t, "rejected_by_provider", response.Results[1].Error.Code)
+		}
+	}
+}
+
+func TestSendWithTemplateRejectsMissingData(t *testing.T) {
+	store, _ := openTestStore(t, templates.Open)
+	assert.Nil(t, store.Put(welcomeTemplate))
+	app := server.ServerApp{Keys: testKeys, Strategy: testStrategy, Templates: store}
+	for _, body := range []string{
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "thomas@test.dk"}], "template": "welcome", "data": {"name": "Thomas"}}`,
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "thomas@test.dk"}], "template": "unknown"}`,
+		`{"from": {"address": "test@test.com"}, "to": [{"address": "thomas@test.dk"}], "template": "welcome", "subject": "hello", "data": {"name": "Thomas", "product": "Mail"}}`,
+	} {
+		req := makeAuthorizedRequest(t, "POST", "/send", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode, body)
+	}
+}
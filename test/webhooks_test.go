@@ -0,0 +1,181 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/mkj-gram/go_email_service/internal/server"
+	"github.com/mkj-gram/go_email_service/internal/status"
+	"github.com/mkj-gram/go_email_service/internal/webhooks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sentAt is just before the events of the test batches.
+var sentAt = time.Unix(1519898000, 0)
+
+const sparkPostBatch = `[
+{"msys": {"message_event": {"type": "injection", "transmission_id": "1001", "rcpt_to": "peter@example.com", "timestamp": "1519898400"}}},
+{"msys": {"message_event": {"type": "delivery", "transmission_id": "1001", "rcpt_to": "peter@example.com", "timestamp": "1519898401", "rcpt_meta": {"message_id": "abc123", "order": "1234"}}}},
+{"msys": {"message_event": {"type": "bounce", "transmission_id": "1002", "rcpt_to": "thomas@example.com", "timestamp": "1519898402", "reason": "550 5.1.1 User unknown"}}},
+{"msys": {"track_event": {"type": "click", "transmission_id": "1001", "rcpt_to": "peter@example.com", "timestamp": "1519898403", "target_link_url": "https://example.com", "rcpt_meta": {"message_id": "abc123"}}}}
+]`
+
+const sendGridBatch = `[
+{"event": "processed", "email": "peter@example.com", "timestamp": 1519898400, "sg_message_id": "14c5d75ce93.filter0001.16648.5515E0B88.0"},
+{"event": "delivered", "email": "peter@example.com", "timestamp": 1519898401, "sg_message_id": "14c5d75ce93.filter0001.16648.5515E0B88.0", "response": "250 OK", "message_id": "abc123"},
+{"event": "bounce", "email": "thomas@example.com", "timestamp": 1519898402, "sg_message_id": "14c5d75ce93.filter0001.16648.5515E0B88.0", "reason": "550 5.1.1 User unknown"},
+{"event": "click", "email": "peter@example.com", "timestamp": 1519898403, "sg_message_id": "14c5d75ce93.filter0001.16648.5515E0B88.0", "url": "https://example.com", "category": ["receipt"]}
+]`
+
+func TestParseSparkPostEvents(t *testing.T) {
+	events, err := webhooks.ParseSparkPost([]byte(sparkPostBatch))
+	assert.Nil(t, err)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, status.Delivered, events[0].State)
+		assert.Equal(t, "abc123", events[0].MessageID)
+		assert.Equal(t, "sparkpost", events[0].Provider)
+		assert.Equal(t, int64(1519898401), events[0].Time.Unix())
+		assert.Equal(t, status.Bounced, events[1].State)
+		assert.Equal(t, "", events[1].MessageID)
+		assert.Equal(t, "1002", events[1].TransmissionID)
+		assert.Equal(t, "550 5.1.1 User unknown", events[1].Detail)
+		assert.Equal(t, status.Clicked, events[2].State)
+		assert.Equal(t, "https://example.com", events[2].Detail)
+	}
+}
+
+func TestParseSendGridEvents(t *testing.T) {
+	events, err := webhooks.ParseSendGrid([]byte(sendGridBatch))
+	assert.Nil(t, err)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, status.Delivered, events[0].State)
+		assert.Equal(t, "abc123", events[0].MessageID)
+		assert.Equal(t, "14c5d75ce93", events[0].TransmissionID)
+		assert.Equal(t, "250 OK", events[0].Detail)
+		assert.Equal(t, status.Bounced, events[1].State)
+		assert.Equal(t, "thomas@example.com", events[1].Recipient)
+		assert.Equal(t, "https://example.com", events[2].Detail)
+	}
+}
+
+// signSendGrid signs the body like the Send Grid signed event webhook, and
+// returns the signature and timestamp headers.
+func signSendGrid(t *testing.T, key *ecdsa.PrivateKey, body string) (string, string) {
+	return signSendGridAt(t, key, body, time.Now())
+}
+
+// signSendGridAt signs the body with the timestamp of the given time.
+func signSendGridAt(t *testing.T, key *ecdsa.PrivateKey, body string, at time.Time) (string, string) {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	hash := sha256.Sum256([]byte(timestamp + body))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), timestamp
+}
+
+func makeWebhookKey(t *testing.T) (*ecdsa.PrivateKey, *ecdsa.PublicKey) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	public, err := webhooks.ParsePublicKey(base64.StdEncoding.EncodeToString(der))
+	assert.Nil(t, err)
+	return private, public
+}
+
+func TestVerifySendGridSignature(t *testing.T) {
+	private, public := makeWebhookKey(t)
+	now := time.Unix(1519898400, 0)
+	signature, timestamp := signSendGridAt(t, private, sendGridBatch, now)
+	assert.Nil(t, webhooks.VerifySendGrid(public, signature, timestamp, []byte(sendGridBatch), now))
+	assert.NotNil(t, webhooks.VerifySendGrid(public, signature, timestamp, []byte(sendGridBatch+" "), now))
+	assert.NotNil(t, webhooks.VerifySendGrid(public, signature, "1519898401", []byte(sendGridBatch), now))
+	assert.NotNil(t, webhooks.VerifySendGrid(public, "", timestamp, []byte(sendGridBatch), now))
+}
+
+func TestVerifySendGridRejectsStaleTimestamps(t *testing.T) {
+	private, public := makeWebhookKey(t)
+	now := time.Unix(1519898400, 0)
+	signature, timestamp := signSendGridAt(t, private, sendGridBatch, now)
+	assert.Nil(t, webhooks.VerifySendGrid(public, signature, timestamp, []byte(sendGridBatch), now.Add(webhooks.SendGridTolerance)))
+	assert.NotNil(t, webhooks.VerifySendGrid(public, signature, timestamp, []byte(sendGridBatch), now.Add(webhooks.SendGridTolerance+time.Second)))
+	assert.NotNil(t, webhooks.VerifySendGrid(public, signature, timestamp, []byte(sendGridBatch), now.Add(-webhooks.SendGridTolerance-time.Second)))
+
+	signature, timestamp = signSendGridAt(t, private, sendGridBatch, time.Now().Add(-time.Hour))
+	app := server.ServerApp{SendGridWebhookKey: public}
+	req, _ := http.NewRequest("POST", "/webhooks/sendgrid", strings.NewReader(sendGridBatch))
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Signature", signature)
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func TestSparkPostWebhookAttachesEvents(t *testing.T) {
+	tracker, _ := openTestStore(t, status.Open)
+	tracker.Record("abc123", status.Event{State: status.Accepted, Time: sentAt})
+	tracker.Record("def456", status.Event{State: status.ProviderAccepted, Provider: "sparkpost", TransmissionID: "1002", Time: sentAt})
+	app := server.ServerApp{Tracker: tracker, SparkPostWebhookUser: "sparkpost", SparkPostWebhookPassword: "secret"}
+
+	req, _ := http.NewRequest("POST", "/webhooks/sparkpost", strings.NewReader(sparkPostBatch))
+	req.SetBasicAuth("sparkpost", "wrong")
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	req, _ = http.NewRequest("POST", "/webhooks/sparkpost", strings.NewReader(sparkPostBatch))
+	req.SetBasicAuth("sparkpost", "secret")
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	record, _ := tracker.Get("abc123")
+	assert.Equal(t, []status.State{status.Accepted, status.Delivered, status.Clicked}, states(record))
+	assert.Equal(t, "peter@example.com", record.Events[1].Recipient)
+	record, _ = tracker.Get("def456")
+	assert.Equal(t, status.Bounced, record.State)
+}
+
+func TestSendGridWebhookRequiresSignature(t *testing.T) {
+	private, public := makeWebhookKey(t)
+	tracker, _ := openTestStore(t, status.Open)
+	tracker.Record("abc123", status.Event{State: status.ProviderAccepted, Provider: "sendgrid", TransmissionID: "14c5d75ce93", Time: sentAt})
+	app := server.ServerApp{Tracker: tracker, SendGridWebhookKey: public}
+
+	req, _ := http.NewRequest("POST", "/webhooks/sendgrid", strings.NewReader(sendGridBatch))
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+
+	signature, timestamp := signSendGrid(t, private, sendGridBatch)
+	req, _ = http.NewRequest("POST", "/webhooks/sendgrid", strings.NewReader(sendGridBatch))
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Signature", signature)
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	rr = httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	record, _ := tracker.Get("abc123")
+	assert.Equal(t, []status.State{status.ProviderAccepted, status.Delivered, status.Bounced, status.Clicked}, states(record))
+}
+
+func TestWebhooksDisabledWithoutConfiguration(t *testing.T) {
+	app := server.ServerApp{}
+	for _, path := range []string{"/webhooks/sparkpost", "/webhooks/sendgrid"} {
+		req, _ := http.NewRequest("POST", path, strings.NewReader("[]"))
+		rr := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Result().StatusCode)
+	}
+}